@@ -35,6 +35,9 @@ func newFilerCommand(ctx context.Context, opts *options.Options) *cobra.Command
 
 			if err := run(ctx, opts, logger); err != nil {
 				logger.Errorf("run error: %v", err)
+				if writeErr := application.WriteTerminationMessage(opts.AppFiler.TerminationMessagePath, err); writeErr != nil {
+					logger.Warnf("failed to write termination message: %v", writeErr)
+				}
 				return err
 			}
 			return nil
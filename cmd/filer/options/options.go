@@ -38,6 +38,7 @@ func (o *Options) Validate() error {
 
 func (o *Options) AddFlags(fs *pflag.FlagSet) {
 	o.Log.AddFlags(fs)
+	o.AppFiler.AddFlags(fs)
 	o.RepoConfig.AddFlags(fs)
 }
 
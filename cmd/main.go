@@ -3,13 +3,20 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/GBA-BI/tes-filer/cmd/filer"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
 )
 
 func main() {
-	command := filer.NewFilerCommand(context.Background())
-	if err := command.Execute(); err != nil {
-		os.Exit(1)
+	// the transfers are cancelled when the task is cancelled and the pod is deleted
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	command := filer.NewFilerCommand(ctx)
+	err := command.Execute()
+	stop()
+	if err != nil {
+		os.Exit(apperror.ExitCode(err))
 	}
 }
@@ -3,6 +3,8 @@ package application
 import (
 	"strings"
 
+	"github.com/spf13/pflag"
+
 	apperror "github.com/GBA-BI/tes-filer/pkg/error"
 	utilsstrings "github.com/GBA-BI/tes-filer/pkg/utils/strings"
 )
@@ -10,10 +12,16 @@ import (
 type Config struct {
 	Path string `env:"POD_INFO_ANNOTATIONS_FILE"`
 	Mode string `env:"FILER_MODE"`
+
+	// TerminationMessagePath is where the failure summary is written for
+	// kubernetes, no message is written if empty.
+	TerminationMessagePath string `env:"TERMINATION_MESSAGE_PATH"`
 }
 
 func NewConfig() *Config {
-	return &Config{}
+	return &Config{
+		TerminationMessagePath: "/dev/termination-log",
+	}
 }
 
 func (c *Config) Validate() error {
@@ -25,3 +33,7 @@ func (c *Config) Validate() error {
 	}
 	return nil
 }
+
+func (c *Config) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.TerminationMessagePath, "termination-message-path", c.TerminationMessagePath, "file the failure summary is written to, empty to disable")
+}
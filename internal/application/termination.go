@@ -0,0 +1,121 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+)
+
+const (
+	// kubernetes truncates the termination message to 4096 bytes, which would
+	// leave an invalid json
+	maxTerminationBytes      = 4096
+	maxTerminationMessageLen = 1024
+	maxTerminationFailures   = 10
+)
+
+// userInfoReg matches the credentials in urls of error messages
+var userInfoReg = regexp.MustCompile(`://[^/@\s]+@`)
+
+type terminationMessage struct {
+	Code     string               `json:"code"`
+	Message  string               `json:"message"`
+	Failures []terminationFailure `json:"failures,omitempty"`
+}
+
+type terminationFailure struct {
+	Mode string `json:"mode"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Code string `json:"code"`
+}
+
+// WriteTerminationMessage writes the summary of err to path as json, so that
+// it is shown in the pod status. Nothing is written if path is empty.
+func WriteTerminationMessage(path string, err error) error {
+	if path == "" || err == nil {
+		return nil
+	}
+	content, err := marshalTerminationMessage(newTerminationMessage(err))
+	if err != nil {
+		return apperror.NewInternalError(err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return apperror.NewInternalError(err)
+	}
+	return nil
+}
+
+func newTerminationMessage(err error) *terminationMessage {
+	msg := &terminationMessage{
+		Code:    apperror.CodeOf(err),
+		Message: userInfoReg.ReplaceAllString(err.Error(), "://"),
+	}
+	msg.Message = truncateMessage(msg.Message, maxTerminationMessageLen)
+	for _, fileDirErr := range fileDirErrors(err) {
+		if len(msg.Failures) == maxTerminationFailures {
+			break
+		}
+		msg.Failures = append(msg.Failures, terminationFailure{
+			Mode: string(fileDirErr.Mode),
+			Name: fileDirErr.Name,
+			URL:  fileDirErr.URL,
+			Code: apperror.CodeOf(fileDirErr.Err),
+		})
+	}
+	return msg
+}
+
+// marshalTerminationMessage marshals msg within maxTerminationBytes, dropping
+// the last failures and then shortening the message until it fits.
+func marshalTerminationMessage(msg *terminationMessage) ([]byte, error) {
+	for {
+		content, err := json.Marshal(msg)
+		if err != nil || len(content) <= maxTerminationBytes {
+			return content, err
+		}
+		if len(msg.Failures) > 0 {
+			msg.Failures = msg.Failures[:len(msg.Failures)-1]
+			continue
+		}
+		// the escaped message is at most 6 times longer than itself
+		msg.Message = truncateMessage(msg.Message, len(msg.Message)/2)
+	}
+}
+
+// truncateMessage cuts message to at most maxLen bytes on a rune boundary,
+// marking it with "..." if cut.
+func truncateMessage(message string, maxLen int) string {
+	if len(message) <= maxLen {
+		return message
+	}
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(message[cut]) {
+		cut--
+	}
+	return message[:cut] + "..."
+}
+
+// fileDirErrors collects the FileDirErrors in the chain of err, including the
+// ones aggregated by errors.Join.
+func fileDirErrors(err error) []*domain.FileDirError {
+	for err != nil {
+		switch e := err.(type) {
+		case *domain.FileDirError:
+			return []*domain.FileDirError{e}
+		case interface{ Unwrap() []error }:
+			var res []*domain.FileDirError
+			for _, inner := range e.Unwrap() {
+				res = append(res, fileDirErrors(inner)...)
+			}
+			return res
+		}
+		err = errors.Unwrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package application
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+)
+
+func TestWriteTerminationMessage(t *testing.T) {
+	fileDirA := &domain.FileDir{Name: "a", Path: "/outputs/a", URL: "s3://bucket/a"}
+	fileDirB := &domain.FileDir{Name: "b", Path: "/outputs/b", URL: "s3://bucket/b"}
+	tests := []struct {
+		name           string
+		err            error
+		expectCode     string
+		expectFailures []string
+	}{
+		{
+			name:           "single failed FileDir",
+			err:            domain.NewFileDirError(consts.TransputModeOutputs, fileDirA, apperror.NewRequiredOutputMissingError("/outputs/a")),
+			expectCode:     "1000005",
+			expectFailures: []string{"a"},
+		},
+		{
+			name: "aggregated failed FileDirs",
+			err: apperror.NewMultiError([]error{
+				domain.NewFileDirError(consts.TransputModeOutputs, fileDirA, apperror.NewInternalError(errors.New("upload error"))),
+				domain.NewFileDirError(consts.TransputModeOutputs, fileDirB, apperror.NewRequiredOutputMissingError("/outputs/b")),
+			}),
+			expectCode:     "1000001",
+			expectFailures: []string{"a", "b"},
+		},
+		{
+			name:       "failed before transfer",
+			err:        apperror.NewInvalidArgumentError("Config.Mode", "unknown"),
+			expectCode: "1000002",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			path := filepath.Join(t.TempDir(), "termination-log")
+			convey.So(WriteTerminationMessage(path, tc.err), convey.ShouldBeNil)
+
+			content, err := os.ReadFile(path)
+			convey.So(err, convey.ShouldBeNil)
+			msg := &terminationMessage{}
+			convey.So(json.Unmarshal(content, msg), convey.ShouldBeNil)
+			convey.So(msg.Code, convey.ShouldEqual, tc.expectCode)
+			names := make([]string, 0, len(msg.Failures))
+			for _, failure := range msg.Failures {
+				names = append(names, failure.Name)
+			}
+			convey.So(names, convey.ShouldResemble, append([]string{}, tc.expectFailures...))
+		})
+	}
+
+	convey.Convey("cut long message on a rune boundary", t, func() {
+		msg := newTerminationMessage(errors.New("x" + strings.Repeat("文件", 1000)))
+		convey.So(utf8.ValidString(msg.Message), convey.ShouldBeTrue)
+		convey.So(len(msg.Message), convey.ShouldBeLessThanOrEqualTo, maxTerminationMessageLen+len("..."))
+		convey.So(strings.HasSuffix(msg.Message, "..."), convey.ShouldBeTrue)
+	})
+
+	convey.Convey("drop failures to fit the termination message", t, func() {
+		errs := make([]error, 0, maxTerminationFailures)
+		for i := 0; i < maxTerminationFailures; i++ {
+			fileDir := &domain.FileDir{Name: fmt.Sprintf("%d", i), Path: "/outputs/a", URL: "s3://bucket/" + strings.Repeat("<a>", 40)}
+			errs = append(errs, domain.NewFileDirError(consts.TransputModeOutputs, fileDir, apperror.NewInternalError(errors.New("upload error"))))
+		}
+		path := filepath.Join(t.TempDir(), "termination-log")
+		convey.So(WriteTerminationMessage(path, apperror.NewMultiError(errs)), convey.ShouldBeNil)
+
+		content, err := os.ReadFile(path)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(len(content), convey.ShouldBeLessThanOrEqualTo, maxTerminationBytes)
+		msg := &terminationMessage{}
+		convey.So(json.Unmarshal(content, msg), convey.ShouldBeNil)
+		convey.So(len(msg.Failures), convey.ShouldBeBetween, 0, maxTerminationFailures)
+		convey.So(msg.Failures[0].Name, convey.ShouldEqual, "0")
+	})
+
+	convey.Convey("redact credentials in message", t, func() {
+		msg := newTerminationMessage(errors.New("failed to get s3://ak:sk@bucket/a"))
+		convey.So(msg.Message, convey.ShouldEqual, "failed to get s3://bucket/a")
+	})
+}
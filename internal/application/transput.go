@@ -33,6 +33,10 @@ func (t *TransputCmd) Transput(ctx context.Context) error {
 	}
 
 	if err := t.fileDirsRepo.Transput(ctx, fileDirs); err != nil {
+		// whatever the transfers failed with, they are stopped by the cancellation
+		if ctx.Err() != nil {
+			return apperror.Wrap(apperror.ErrCancelled, err)
+		}
 		return err
 	}
 
@@ -2,13 +2,17 @@ package domain
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+	"path"
+	"path/filepath"
 	"strings"
 
 	"github.com/jinzhu/copier"
 
 	"github.com/GBA-BI/tes-filer/pkg/consts"
 	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	utilsstrings "github.com/GBA-BI/tes-filer/pkg/utils/strings"
 )
 
 type FileDir struct {
@@ -16,6 +20,19 @@ type FileDir struct {
 	Description string
 	URL         string
 	Path        string
+	// PathPrefix is removed from the paths matched by a wildcard path to
+	// build their urls, see path_prefix of TES 1.1 outputs.
+	PathPrefix string
+	// Content is the literal content of an input file, used instead of URL.
+	// It is nil if not given, an empty content creates an empty file.
+	Content *string
+	// Optional inputs are skipped if not exist remotely, and optional outputs
+	// are skipped if not exist locally, others fail the task.
+	Optional bool
+	// Include and Exclude are glob patterns selecting the files of a directory
+	// by their paths relative to it, see transput.Filter.
+	Include []string
+	Exclude []string
 
 	Typ      consts.FileType
 	Scheme   consts.Scheme
@@ -82,6 +99,55 @@ func (f *FileDirs) SetMode(mode string) error {
 	return nil
 }
 
+// HasContent reports whether the FileDir is an input with literal content.
+func (f *FileDir) HasContent() bool {
+	return f.Content != nil
+}
+
+// HasWildcard reports whether the path is a glob pattern.
+func (f *FileDir) HasWildcard() bool {
+	return strings.ContainsAny(f.Path, "*?[")
+}
+
+// Expand returns the FileDir of a path matched by the wildcard path, its url
+// is the url joined with the matched path relative to the path prefix.
+func (f *FileDir) Expand(match string, typ consts.FileType) (*FileDir, error) {
+	prefix := f.PathPrefix
+	if prefix == "" {
+		prefix = wildcardBase(f.Path)
+	}
+	relPath, ok := relativePath(prefix, match)
+	if !ok || relPath == "." {
+		return nil, apperror.NewInvalidArgumentError("FileDir.PathPrefix", prefix)
+	}
+
+	expanded := *f
+	expanded.Path = match
+	expanded.URL = fmt.Sprintf("%s%s", utilsstrings.CheckDir(f.URL), filepath.ToSlash(relPath))
+	expanded.Typ = typ
+	return &expanded, nil
+}
+
+// relativePath returns target relative to base, ok is false if target is not
+// base or under it. Paths are compared by elements, so /outputs is not under
+// /out.
+func relativePath(base, target string) (relPath string, ok bool) {
+	relPath, err := filepath.Rel(base, target)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return relPath, true
+}
+
+// wildcardBase returns the longest leading directory of the pattern without wildcards.
+func wildcardBase(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
 func (f *FileDir) URLForLog() string {
 	if f.UserInfo == nil {
 		return f.URL
@@ -91,13 +157,46 @@ func (f *FileDir) URLForLog() string {
 	return parsedURL.String()
 }
 
+// FileDirError is the error of transferring a FileDir.
+type FileDirError struct {
+	Mode consts.TransputMode
+	Name string
+	Path string
+	// URL is redacted, it is shown to users
+	URL string
+	Err error
+}
+
+func NewFileDirError(mode consts.TransputMode, fileDir *FileDir, err error) *FileDirError {
+	return &FileDirError{
+		Mode: mode,
+		Name: fileDir.Name,
+		Path: fileDir.Path,
+		URL:  fileDir.URLForLog(),
+		Err:  err,
+	}
+}
+
+func (e *FileDirError) Error() string {
+	return fmt.Sprintf("%s %s (path %s, url %s): %v", e.Mode, e.Name, e.Path, e.URL, e.Err)
+}
+
+func (e *FileDirError) Unwrap() error {
+	return e.Err
+}
+
 // Factory // hackable
 type CreateFileDirParam struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	URL         string `json:"url"`
-	Path        string `json:"path"`
-	Typ         string `json:"type"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	URL         string   `json:"url"`
+	Path        string   `json:"path"`
+	PathPrefix  string   `json:"path_prefix"`
+	Content     *string  `json:"content"`
+	Optional    bool     `json:"optional"`
+	Include     []string `json:"include"`
+	Exclude     []string `json:"exclude"`
+	Typ         string   `json:"type"`
 }
 
 type FileDirFactory interface {
@@ -115,12 +214,55 @@ func (i *fileDirFactoryImpl) New(param *CreateFileDirParam) (*FileDir, error) {
 	if err := copier.Copy(fileDir, param); err != nil {
 		return nil, apperror.NewInternalError(err)
 	}
+	if fileDir.HasContent() {
+		return newContentFileDir(fileDir, param)
+	}
 	if err := fileDir.SetTyp(param.Typ); err != nil {
 		return nil, err
 	}
 	if err := fileDir.Complete(); err != nil {
 		return nil, err
 	}
+	if _, ok := relativePath(fileDir.PathPrefix, fileDir.Path); fileDir.PathPrefix != "" && !ok {
+		return nil, apperror.NewInvalidArgumentError("FileDir.PathPrefix", fileDir.PathPrefix)
+	}
+	if err := validatePatterns("FileDir.Include", fileDir.Include); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns("FileDir.Exclude", fileDir.Exclude); err != nil {
+		return nil, err
+	}
+	return fileDir, nil
+}
+
+func validatePatterns(name string, patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.Trim(pattern, "/") == "" {
+			return apperror.NewInvalidArgumentError(name, pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return apperror.NewInvalidArgumentError(name, pattern)
+		}
+	}
+	return nil
+}
+
+// newContentFileDir validates an input carrying literal content, which is
+// always a file and has no url to transfer from.
+func newContentFileDir(fileDir *FileDir, param *CreateFileDirParam) (*FileDir, error) {
+	if fileDir.URL != "" {
+		// the url is left out, its credentials are not parsed yet to be redacted
+		return nil, apperror.NewInvalidArgumentError("FileDir.URL", "exclusive with content")
+	}
+	if param.Typ == "" {
+		param.Typ = "file"
+	}
+	if err := fileDir.SetTyp(param.Typ); err != nil {
+		return nil, err
+	}
+	if fileDir.Typ != consts.FileTypeFile {
+		return nil, apperror.NewInvalidArgumentError("FileDir.Typ", param.Typ)
+	}
 	return fileDir, nil
 }
 
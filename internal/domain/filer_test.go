@@ -0,0 +1,220 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+func TestFileDir_Expand(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		pathPrefix  string
+		url         string
+		match       string
+		expectedURL string
+		expectErr   bool
+	}{
+		{
+			name:        "with path prefix",
+			path:        "/outputs/*.bam",
+			pathPrefix:  "/outputs/",
+			url:         "s3://bucket/results",
+			match:       "/outputs/a.bam",
+			expectedURL: "s3://bucket/results/a.bam",
+		},
+		{
+			name:        "nested match with path prefix",
+			path:        "/outputs/*/*.bam",
+			pathPrefix:  "/outputs",
+			url:         "s3://bucket/results/",
+			match:       "/outputs/sample1/a.bam",
+			expectedURL: "s3://bucket/results/sample1/a.bam",
+		},
+		{
+			name:        "without path prefix",
+			path:        "/outputs/bam/*.bam",
+			url:         "s3://bucket/results",
+			match:       "/outputs/bam/a.bam",
+			expectedURL: "s3://bucket/results/a.bam",
+		},
+		{
+			name:        "match named like a parent directory",
+			path:        "/outputs/*",
+			pathPrefix:  "/outputs",
+			url:         "s3://bucket/results",
+			match:       "/outputs/..bam",
+			expectedURL: "s3://bucket/results/..bam",
+		},
+		{
+			name:       "match outside path prefix",
+			path:       "/outputs/*.bam",
+			pathPrefix: "/outputs/bam",
+			url:        "s3://bucket/results",
+			match:      "/outputs/a.bam",
+			expectErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			fileDir := &FileDir{
+				Path:       tc.path,
+				PathPrefix: tc.pathPrefix,
+				URL:        tc.url,
+				Typ:        consts.FileTypeFile,
+				Scheme:     consts.SchemeS3,
+			}
+			convey.So(fileDir.HasWildcard(), convey.ShouldBeTrue)
+
+			expanded, err := fileDir.Expand(tc.match, consts.FileTypeFile)
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(expanded.Path, convey.ShouldEqual, tc.match)
+				convey.So(expanded.URL, convey.ShouldEqual, tc.expectedURL)
+				convey.So(expanded.Scheme, convey.ShouldEqual, consts.SchemeS3)
+			}
+		})
+	}
+}
+
+func TestFileDirFactory_NewWithPathPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		pathPrefix string
+		expectErr  bool
+	}{
+		{
+			name:       "path under path prefix",
+			path:       "/outputs/*.bam",
+			pathPrefix: "/outputs/",
+		},
+		{
+			name:       "path under path prefix without trailing slash",
+			path:       "/outputs/*/*.bam",
+			pathPrefix: "/outputs",
+		},
+		{
+			name:       "path prefix as a string prefix only",
+			path:       "/outputs/*.bam",
+			pathPrefix: "/out",
+			expectErr:  true,
+		},
+		{
+			name:       "path outside path prefix",
+			path:       "/inputs/*.bam",
+			pathPrefix: "/outputs",
+			expectErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			_, err := NewFileDirFactory().New(&CreateFileDirParam{
+				Path:       tc.path,
+				PathPrefix: tc.pathPrefix,
+				URL:        "s3://bucket/results",
+				Typ:        "file",
+			})
+			convey.So(err != nil, convey.ShouldEqual, tc.expectErr)
+		})
+	}
+}
+
+func TestFileDirFactory_NewWithContent(t *testing.T) {
+	content := "echo hello"
+	empty := ""
+	tests := []struct {
+		name      string
+		param     *CreateFileDirParam
+		expectErr bool
+	}{
+		{
+			name:  "content without type",
+			param: &CreateFileDirParam{Path: "/inputs/run.sh", Content: &content},
+		},
+		{
+			name:  "empty content",
+			param: &CreateFileDirParam{Path: "/inputs/empty", Content: &empty},
+		},
+		{
+			name:      "content with url",
+			param:     &CreateFileDirParam{Path: "/inputs/run.sh", URL: "s3://bucket/run.sh", Content: &content},
+			expectErr: true,
+		},
+		{
+			name:      "content with credentialed url",
+			param:     &CreateFileDirParam{Path: "/inputs/run.sh", URL: "s3://ak:secret@bucket/run.sh", Content: &content},
+			expectErr: true,
+		},
+		{
+			name:      "content with directory type",
+			param:     &CreateFileDirParam{Path: "/inputs", Content: &content, Typ: "directory"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			fileDir, err := NewFileDirFactory().New(tc.param)
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(err.Error(), convey.ShouldNotContainSubstring, "secret")
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(fileDir.HasContent(), convey.ShouldBeTrue)
+				convey.So(fileDir.Typ, convey.ShouldEqual, consts.FileTypeFile)
+			}
+		})
+	}
+}
+
+func TestFileDirFactory_NewWithFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		expectErr bool
+	}{
+		{
+			name:    "valid patterns",
+			include: []string{"*.cram", "logs/*.log"},
+			exclude: []string{".snakemake/"},
+		},
+		{
+			name:      "malformed pattern",
+			include:   []string{"[a-"},
+			expectErr: true,
+		},
+		{
+			name:      "empty pattern",
+			exclude:   []string{"/"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			fileDir, err := NewFileDirFactory().New(&CreateFileDirParam{
+				Path:    "/inputs/dir",
+				URL:     "s3://bucket/dir",
+				Typ:     "directory",
+				Include: tc.include,
+				Exclude: tc.exclude,
+			})
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(fileDir.Include, convey.ShouldResemble, tc.include)
+				convey.So(fileDir.Exclude, convey.ShouldResemble, tc.exclude)
+			}
+		})
+	}
+}
@@ -1,27 +1,300 @@
 package repo
 
-import "github.com/spf13/pflag"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
+)
 
 type Config struct {
 	S3ConfigPath         string `env:"S3SDK_CONFIG_FILE"`
 	ExpirationConfigPath string `env:"AWS_CREDENTIALS_EXPIRED_TIME_FILE"`
 	S3SecretPath         string `env:"AWS_SHARED_CREDENTIALS_FILE"`
 
+	// TOS* configure the tos scheme, they fall back to the S3* ones when empty,
+	// so that an S3SDK config whose s3_type is tos keeps working for tos urls.
+	TOSConfigPath           string `env:"TOSSDK_CONFIG_FILE"`
+	TOSExpirationConfigPath string `env:"TOS_CREDENTIALS_EXPIRED_TIME_FILE"`
+	TOSSecretPath           string `env:"TOS_SHARED_CREDENTIALS_FILE"`
+
 	OffloadType string `env:"OFFLOAD_TYPE"`
+	// OffloadSQL* locate the offloaded inputs/outputs when OffloadType is sql,
+	// the content column is selected from the row whose ref column equals the ref.
+	OffloadSQLDSN           string `env:"OFFLOAD_SQL_DSN"`
+	OffloadSQLTable         string `env:"OFFLOAD_SQL_TABLE"`
+	OffloadSQLRefColumn     string `env:"OFFLOAD_SQL_REF_COLUMN"`
+	OffloadSQLContentColumn string `env:"OFFLOAD_SQL_CONTENT_COLUMN"`
 
 	IsMountTOS string `env:"IS_MOUNT_TOS"`
+
+	// GlobNoMatchPolicy is warn or error, it decides whether a wildcard output
+	// path matching nothing fails the task.
+	GlobNoMatchPolicy string `env:"OUTPUT_GLOB_NO_MATCH_POLICY"`
+
+	// SymlinkPolicy is follow, skip, preserve or fail, it decides how the symlinks
+	// in output directories are uploaded. preserve keeps them as empty objects
+	// with the link target in metadata, only supported by s3 and tos.
+	SymlinkPolicy string `env:"UPLOAD_SYMLINK_POLICY"`
+	// SymlinkConfine fails the upload of an output directory if a followed
+	// symlink in it resolves outside of it.
+	SymlinkConfine string `env:"UPLOAD_SYMLINK_CONFINE"`
+
+	// DirMarkers uploads the empty directories of outputs as zero-byte objects
+	// whose keys end with slash, and recreates them when downloading inputs.
+	DirMarkers string `env:"DIRECTORY_MARKERS"`
+
+	// DefaultFileMode and DefaultDirMode are the octal permissions, e.g. 0644,
+	// of the files and directories created when downloading inputs. The mode
+	// recorded in the metadata of an object wins over DefaultFileMode. The
+	// umask applies if empty.
+	DefaultFileMode string `env:"DEFAULT_FILE_MODE"`
+	DefaultDirMode  string `env:"DEFAULT_DIR_MODE"`
+	// InputUID and InputGID chown the files and directories created when
+	// downloading inputs, for the executors not running as root. The owner is
+	// not changed if empty.
+	InputUID string `env:"INPUT_UID"`
+	InputGID string `env:"INPUT_GID"`
+	// InputReadOnly clears the write bits of the downloaded input files.
+	InputReadOnly string `env:"INPUT_READ_ONLY"`
+
+	// ContinueOnError attempts all inputs/outputs even if some of them failed,
+	// and reports all failures at the end.
+	ContinueOnError string `env:"CONTINUE_ON_ERROR"`
+
+	// ResultPath is the json file listing the result of every transferred file,
+	// no result file is written if empty.
+	ResultPath string `env:"TRANSPUT_RESULT_FILE"`
+	// ResultChecksum adds the md5 of every transferred file to the result file,
+	// which reads each file again after its transfer.
+	ResultChecksum string `env:"TRANSPUT_RESULT_CHECKSUM"`
+
+	// StateDir keeps the journal of the done file transfers, so that a restarted
+	// filer skips them. It should be on a volume surviving the pod. It is the
+	// .tes-filer-state directory in the deepest directory containing all inputs
+	// and outputs if empty.
+	StateDir string `env:"TRANSPUT_STATE_DIR"`
+	// CheckpointDir keeps the checkpoints of the multipart transfers of s3 and
+	// tos, so that a restarted filer resumes the parts already transferred. It
+	// is the checkpoints directory in the state dir if empty.
+	CheckpointDir string `env:"TRANSPUT_CHECKPOINT_DIR"`
+
+	// UploadBandwidth, DownloadBandwidth and TotalBandwidth limit the bytes per
+	// second of all uploads, all downloads and both of them, shared by all
+	// schemes and parallel transfers. No limit if empty or 0. The max_band_width
+	// of the S3SDK configs further limits each s3/tos transput, which backs off
+	// on the throttling of its server.
+	UploadBandwidth   string `env:"UPLOAD_BANDWIDTH"`
+	DownloadBandwidth string `env:"DOWNLOAD_BANDWIDTH"`
+	TotalBandwidth    string `env:"TOTAL_BANDWIDTH"`
+
+	// Concurrency is the number of single file transfers running at the same time.
+	Concurrency string `env:"TRANSPUT_CONCURRENCY"`
+	// SchemeConcurrency limits the file transfers per scheme, e.g. "s3=16,ftp=2".
+	SchemeConcurrency string `env:"TRANSPUT_SCHEME_CONCURRENCY"`
 }
 
 func NewConfig() *Config {
 	return &Config{
 		OffloadType: "pvc",
+
+		OffloadSQLTable:         "task_offload",
+		OffloadSQLRefColumn:     "ref",
+		OffloadSQLContentColumn: "content",
+
+		GlobNoMatchPolicy: consts.GlobNoMatchWarn,
+		SymlinkPolicy:     consts.SymlinkPolicyFollow,
+
+		Concurrency: "8",
 	}
 }
 
 func (c *Config) Validate() error {
+	switch c.OffloadType {
+	case consts.OffloadTypePVC:
+	case consts.OffloadTypeSQL:
+		if c.OffloadSQLDSN == "" {
+			return apperror.NewInvalidArgumentError("Config.OffloadSQLDSN", c.OffloadSQLDSN)
+		}
+		if !sqlIdentifierReg.MatchString(c.OffloadSQLTable) {
+			return apperror.NewInvalidArgumentError("Config.OffloadSQLTable", c.OffloadSQLTable)
+		}
+		if !sqlIdentifierReg.MatchString(c.OffloadSQLRefColumn) {
+			return apperror.NewInvalidArgumentError("Config.OffloadSQLRefColumn", c.OffloadSQLRefColumn)
+		}
+		if !sqlIdentifierReg.MatchString(c.OffloadSQLContentColumn) {
+			return apperror.NewInvalidArgumentError("Config.OffloadSQLContentColumn", c.OffloadSQLContentColumn)
+		}
+	default:
+		return apperror.NewInvalidArgumentError("Config.OffloadType", c.OffloadType)
+	}
+	switch c.GlobNoMatchPolicy {
+	case consts.GlobNoMatchWarn, consts.GlobNoMatchError:
+	default:
+		return apperror.NewInvalidArgumentError("Config.GlobNoMatchPolicy", c.GlobNoMatchPolicy)
+	}
+	switch c.SymlinkPolicy {
+	case consts.SymlinkPolicyFollow, consts.SymlinkPolicySkip, consts.SymlinkPolicyPreserve, consts.SymlinkPolicyFail:
+	default:
+		return apperror.NewInvalidArgumentError("Config.SymlinkPolicy", c.SymlinkPolicy)
+	}
+	if _, err := c.localAttrs(); err != nil {
+		return err
+	}
+	if _, err := c.limits(); err != nil {
+		return err
+	}
+	if _, err := c.concurrency(); err != nil {
+		return err
+	}
+	if _, err := c.schemeConcurrency(); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (c *Config) AddFlags(fs *pflag.FlagSet) {
-	return
+	fs.StringVar(&c.OffloadSQLDSN, "offload-sql-dsn", c.OffloadSQLDSN, "dsn of the database storing offloaded inputs/outputs")
+	fs.StringVar(&c.SymlinkPolicy, "symlink-policy", c.SymlinkPolicy, "how symlinks in output directories are uploaded, follow, skip, preserve or fail")
+	fs.StringVar(&c.SymlinkConfine, "symlink-confine", c.SymlinkConfine, "fail if a followed symlink resolves outside of its output directory, true or false")
+	fs.StringVar(&c.DirMarkers, "dir-markers", c.DirMarkers, "keep empty directories as markers ending with slash, true or false")
+	fs.StringVar(&c.DefaultFileMode, "default-file-mode", c.DefaultFileMode, "octal permission of the downloaded files, e.g. 0644")
+	fs.StringVar(&c.DefaultDirMode, "default-dir-mode", c.DefaultDirMode, "octal permission of the directories created by downloads, e.g. 0755")
+	fs.StringVar(&c.InputUID, "input-uid", c.InputUID, "uid owning the downloaded inputs")
+	fs.StringVar(&c.InputGID, "input-gid", c.InputGID, "gid owning the downloaded inputs")
+	fs.StringVar(&c.InputReadOnly, "input-read-only", c.InputReadOnly, "make the downloaded input files read-only, true or false")
+	fs.StringVar(&c.ContinueOnError, "continue-on-error", c.ContinueOnError, "attempt all inputs/outputs even if some of them failed, true or false")
+	fs.StringVar(&c.ResultPath, "result-file", c.ResultPath, "json file listing the result of every transferred file")
+	fs.StringVar(&c.ResultChecksum, "result-checksum", c.ResultChecksum, "add the md5 of every transferred file to the result file, true or false")
+	fs.StringVar(&c.StateDir, "state-dir", c.StateDir, "directory of the journal to resume file transfers from")
+	fs.StringVar(&c.CheckpointDir, "checkpoint-dir", c.CheckpointDir, "directory of the checkpoints to resume multipart transfers from")
+	fs.StringVar(&c.UploadBandwidth, "upload-bandwidth", c.UploadBandwidth, "bytes per second of all uploads, no limit if 0")
+	fs.StringVar(&c.DownloadBandwidth, "download-bandwidth", c.DownloadBandwidth, "bytes per second of all downloads, no limit if 0")
+	fs.StringVar(&c.TotalBandwidth, "total-bandwidth", c.TotalBandwidth, "bytes per second of all uploads and downloads, no limit if 0")
+	fs.StringVar(&c.Concurrency, "concurrency", c.Concurrency, "number of file transfers running at the same time")
+	fs.StringVar(&c.SchemeConcurrency, "scheme-concurrency", c.SchemeConcurrency, "number of file transfers running at the same time per scheme, e.g. s3=16,ftp=2")
+}
+
+func (c *Config) localAttrs() (*transput.LocalAttrs, error) {
+	fileMode, err := parseMode(c.DefaultFileMode)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("Config.DefaultFileMode", c.DefaultFileMode)
+	}
+	dirMode, err := parseMode(c.DefaultDirMode)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("Config.DefaultDirMode", c.DefaultDirMode)
+	}
+	uid, err := parseID(c.InputUID)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("Config.InputUID", c.InputUID)
+	}
+	gid, err := parseID(c.InputGID)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("Config.InputGID", c.InputGID)
+	}
+	attrs := &transput.LocalAttrs{
+		FileMode: fileMode,
+		DirMode:  dirMode,
+		ReadOnly: strings.ToLower(c.InputReadOnly) == "true",
+	}
+	if uid >= 0 || gid >= 0 {
+		attrs.Owner = &transput.Owner{UID: uid, GID: gid}
+	}
+	return attrs, nil
+}
+
+// parseID parses the uid or gid, -1 if empty.
+func parseID(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid id %q", s)
+	}
+	return id, nil
+}
+
+// parseMode parses the octal permission, 0 if empty.
+func parseMode(s string) (os.FileMode, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	num, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || num == 0 || num > 0777 {
+		return 0, fmt.Errorf("invalid mode %q", s)
+	}
+	return os.FileMode(num), nil
+}
+
+func (c *Config) limits() (*ratelimit.Limits, error) {
+	upload, err := parseBandwidth(c.UploadBandwidth)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("Config.UploadBandwidth", c.UploadBandwidth)
+	}
+	download, err := parseBandwidth(c.DownloadBandwidth)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("Config.DownloadBandwidth", c.DownloadBandwidth)
+	}
+	total, err := parseBandwidth(c.TotalBandwidth)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("Config.TotalBandwidth", c.TotalBandwidth)
+	}
+	return ratelimit.NewLimits(upload, download, total), nil
+}
+
+// parseBandwidth parses the bytes per second, 0 if empty.
+func parseBandwidth(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	num, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q", s)
+	}
+	return num, nil
+}
+
+func (c *Config) concurrency() (int, error) {
+	num, err := strconv.Atoi(strings.TrimSpace(c.Concurrency))
+	if err != nil || num <= 0 {
+		return 0, apperror.NewInvalidArgumentError("Config.Concurrency", c.Concurrency)
+	}
+	return num, nil
+}
+
+func (c *Config) schemeConcurrency() (map[consts.Scheme]int, error) {
+	res := make(map[consts.Scheme]int)
+	for _, item := range strings.Split(c.SchemeConcurrency, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, apperror.NewInvalidArgumentError("Config.SchemeConcurrency", c.SchemeConcurrency)
+		}
+		num, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || num <= 0 {
+			return nil, apperror.NewInvalidArgumentError("Config.SchemeConcurrency", c.SchemeConcurrency)
+		}
+		scheme := consts.Scheme(strings.ToUpper(strings.TrimSpace(parts[0])))
+		switch scheme {
+		case consts.SchemeHTTP, consts.SchemeFTP, consts.SchemeS3, consts.SchemeTOS, consts.SchemeDRS, consts.SchemeFILE:
+		default:
+			return nil, apperror.NewInvalidArgumentError("Config.SchemeConcurrency", c.SchemeConcurrency)
+		}
+		res[scheme] = num
+	}
+	return res, nil
 }
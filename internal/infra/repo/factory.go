@@ -0,0 +1,249 @@
+package repo
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
+	"github.com/GBA-BI/tes-filer/pkg/transput/drs"
+	"github.com/GBA-BI/tes-filer/pkg/transput/file"
+	"github.com/GBA-BI/tes-filer/pkg/transput/ftp"
+	"github.com/GBA-BI/tes-filer/pkg/transput/http"
+	"github.com/GBA-BI/tes-filer/pkg/transput/s3"
+	"github.com/GBA-BI/tes-filer/pkg/transput/tos"
+	"github.com/GBA-BI/tes-filer/pkg/viper"
+)
+
+const defaultFTPPort = "21"
+
+func newTransputFactory(cfg *Config, limits *ratelimit.Limits, logger log.Logger) *transputFactory {
+	return &transputFactory{
+		s3ConfigPath:         cfg.S3ConfigPath,
+		expirationConfigPath: cfg.ExpirationConfigPath,
+		s3SecretPath:         cfg.S3SecretPath,
+
+		tosConfigPath:           firstNonEmpty(cfg.TOSConfigPath, cfg.S3ConfigPath),
+		tosExpirationConfigPath: firstNonEmpty(cfg.TOSExpirationConfigPath, cfg.ExpirationConfigPath),
+		tosSecretPath:           firstNonEmpty(cfg.TOSSecretPath, cfg.S3SecretPath),
+
+		sdkConfigs: map[consts.Scheme]*sdkConfigEntry{
+			consts.SchemeS3:  {},
+			consts.SchemeTOS: {},
+		},
+		transputs: make(map[transputKey]*transputEntry),
+		limits:    limits,
+		logger:    logger,
+	}
+}
+
+type transputFactory struct {
+	s3ConfigPath         string
+	expirationConfigPath string
+	s3SecretPath         string
+
+	tosConfigPath           string
+	tosExpirationConfigPath string
+	tosSecretPath           string
+
+	// sdkConfigs is not written after newTransputFactory, each entry guards
+	// the loading of its scheme
+	sdkConfigs map[consts.Scheme]*sdkConfigEntry
+	// lock guards transputs, FileDirs transferring at the same time ask for
+	// transputs. It is not held while reading a config file or creating a
+	// client, which may load credentials or dial the server.
+	lock      sync.Mutex
+	transputs map[transputKey]*transputEntry
+	// limits are the bandwidth budgets shared by all transputs
+	limits *ratelimit.Limits
+	logger log.Logger
+}
+
+// transputKey identifies a transput by everything its client is bound to, so
+// FileDirs with different credentials or servers never share a client.
+type transputKey struct {
+	scheme   consts.Scheme
+	endpoint string
+	userInfo string
+}
+
+// sdkConfigEntry keeps the S3SDK config of a scheme after its first successful
+// load, a failed load is tried again by the next FileDir.
+type sdkConfigEntry struct {
+	lock      sync.Mutex
+	sdkConfig *transput.S3SDKConfig
+}
+
+// transputEntry creates the transput of a key once, the FileDirs asking for
+// it meanwhile wait for the creation without blocking the other keys.
+type transputEntry struct {
+	once  sync.Once
+	trans transput.Transput
+	err   error
+}
+
+func (t *transputFactory) NewTransput(fileDir *domain.FileDir) (transput.Transput, error) {
+	key, err := t.transputKeyOf(fileDir)
+	if err != nil {
+		return nil, err
+	}
+	var sdkConfig *transput.S3SDKConfig
+	if _, ok := t.sdkConfigs[fileDir.Scheme]; ok {
+		// loaded by transputKeyOf already
+		if sdkConfig, err = t.sdkConfigOf(fileDir.Scheme); err != nil {
+			return nil, err
+		}
+	}
+
+	t.lock.Lock()
+	entry, ok := t.transputs[key]
+	if !ok {
+		entry = &transputEntry{}
+		t.transputs[key] = entry
+	}
+	t.lock.Unlock()
+
+	entry.once.Do(func() {
+		entry.trans, entry.err = t.newTransput(fileDir, key, sdkConfig)
+	})
+	if entry.err != nil {
+		// not cached, so that the next FileDir tries again
+		t.lock.Lock()
+		if t.transputs[key] == entry {
+			delete(t.transputs, key)
+		}
+		t.lock.Unlock()
+		return nil, entry.err
+	}
+	return entry.trans, nil
+}
+
+// newTransput creates the transput of key, sdkConfig is the loaded S3SDK
+// config of the s3 and tos schemes.
+func (t *transputFactory) newTransput(fileDir *domain.FileDir, key transputKey, sdkConfig *transput.S3SDKConfig) (transput.Transput, error) {
+	var newTrans transput.Transput
+	var err error
+	userInfo := fileDir.UserInfo
+
+	switch fileDir.Scheme {
+	case consts.SchemeHTTP:
+		cfg := &http.Config{}
+		newTrans, err = http.NewHTTPTransput(cfg, t.limits)
+	case consts.SchemeDRS:
+		cfg := &drs.Config{}
+		viper.SetConfigFromEnv(cfg)
+		newTrans, err = drs.NewDRSTransput(cfg, t.limits, t.logger)
+	case consts.SchemeFTP:
+		cfg := &ftp.Config{}
+		viper.SetConfigFromEnv(cfg)
+		if key.endpoint != "" {
+			cfg.URL = key.endpoint
+		}
+		newTrans, err = ftp.NewFTPTransput(cfg, userInfo, t.limits)
+	case consts.SchemeFILE:
+		cfg := &file.Config{}
+		viper.SetConfigFromEnv(cfg)
+		newTrans, err = file.NewFileTransput(cfg, t.limits, t.logger)
+	case consts.SchemeS3:
+		if strings.EqualFold(sdkConfig.S3Type, string(consts.SchemeTOS)) {
+			cfg := &tos.Config{
+				CredentialFilePath: t.s3SecretPath,
+				ExpirationFilePath: t.expirationConfigPath,
+
+				S3SDKConfig: *sdkConfig,
+			}
+			newTrans, err = tos.NewTOSTransput(cfg, userInfo, t.limits, t.logger)
+		} else {
+			cfg := &s3.Config{
+				CredentialFilePath: t.s3SecretPath,
+				ExpirationFilePath: t.expirationConfigPath,
+
+				S3SDKConfig: *sdkConfig,
+			}
+			newTrans, err = s3.NewS3Transput(cfg, userInfo, t.limits)
+		}
+	case consts.SchemeTOS:
+		cfg := &tos.Config{
+			CredentialFilePath: t.tosSecretPath,
+			ExpirationFilePath: t.tosExpirationConfigPath,
+
+			S3SDKConfig: *sdkConfig,
+		}
+		newTrans, err = tos.NewTOSTransput(cfg, userInfo, t.limits, t.logger)
+	default:
+		return nil, apperror.NewInvalidArgumentError("transput.Scheme", string(fileDir.Scheme))
+	}
+	if err != nil {
+		return nil, apperror.NewInternalError(err)
+	}
+	return newTrans, nil
+}
+
+func (t *transputFactory) transputKeyOf(fileDir *domain.FileDir) (transputKey, error) {
+	key := transputKey{scheme: fileDir.Scheme}
+	if fileDir.UserInfo != nil {
+		key.userInfo = fileDir.UserInfo.String()
+	}
+
+	switch fileDir.Scheme {
+	case consts.SchemeS3, consts.SchemeTOS:
+		sdkConfig, err := t.sdkConfigOf(fileDir.Scheme)
+		if err != nil {
+			return key, err
+		}
+		key.endpoint = sdkConfig.Endpoint
+	case consts.SchemeFTP:
+		parsedURL, err := url.Parse(fileDir.URL)
+		if err != nil {
+			return key, apperror.NewInvalidArgumentError("FileDir.URL", fileDir.URLForLog())
+		}
+		if host := parsedURL.Host; host != "" {
+			if parsedURL.Port() == "" {
+				host = net.JoinHostPort(parsedURL.Hostname(), defaultFTPPort)
+			}
+			key.endpoint = host
+		}
+	}
+	return key, nil
+}
+
+// sdkConfigOf loads the S3SDK config of the scheme once, all transputs of the
+// scheme share the same endpoint and region. Only the FileDirs of the scheme
+// wait for the loading.
+func (t *transputFactory) sdkConfigOf(scheme consts.Scheme) (*transput.S3SDKConfig, error) {
+	entry, ok := t.sdkConfigs[scheme]
+	if !ok {
+		return nil, apperror.NewInvalidArgumentError("transput.Scheme", string(scheme))
+	}
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+	if entry.sdkConfig != nil {
+		return entry.sdkConfig, nil
+	}
+
+	configPath := t.s3ConfigPath
+	if scheme == consts.SchemeTOS {
+		configPath = t.tosConfigPath
+	}
+	sdkConfig := &transput.S3SDKConfig{}
+	if err := viper.SetConfigFromFileINI(configPath, "", sdkConfig); err != nil {
+		return nil, apperror.NewInternalError(err)
+	}
+	entry.sdkConfig = sdkConfig
+	return sdkConfig, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+package repo
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	"github.com/GBA-BI/tes-filer/pkg/log"
+)
+
+func TestTransputFactory_transputKeyOf(t *testing.T) {
+	s3ConfigPath := filepath.Join(t.TempDir(), "s3sdk.ini")
+	if err := os.WriteFile(s3ConfigPath, []byte("[default]\nendpoint_url = https://s3.example.com\n"), 0644); err != nil {
+		t.Fatalf("Failed to write s3 config: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		urlA       string
+		urlB       string
+		expectSame bool
+	}{
+		{
+			name:       "same s3 credentials",
+			urlA:       "s3://ak:sk@bucket/a",
+			urlB:       "s3://ak:sk@bucket/b",
+			expectSame: true,
+		},
+		{
+			name:       "different s3 credentials",
+			urlA:       "s3://ak1:sk1@bucket/a",
+			urlB:       "s3://ak2:sk2@bucket/b",
+			expectSame: false,
+		},
+		{
+			name:       "inline and shared credentials",
+			urlA:       "s3://ak:sk@bucket/a",
+			urlB:       "s3://bucket/b",
+			expectSame: false,
+		},
+		{
+			name:       "same ftp host",
+			urlA:       "ftp://ftp.example.com/a",
+			urlB:       "ftp://ftp.example.com:21/b",
+			expectSame: true,
+		},
+		{
+			name:       "different ftp hosts",
+			urlA:       "ftp://ftp1.example.com/a",
+			urlB:       "ftp://ftp2.example.com/b",
+			expectSame: false,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			factory := newTransputFactory(&Config{S3ConfigPath: s3ConfigPath}, nil, log.NewNopLogger())
+			fileDirFactory := domain.NewFileDirFactory()
+
+			fileDirA, err := fileDirFactory.New(&domain.CreateFileDirParam{URL: tc.urlA, Path: "/a", Typ: "file"})
+			convey.So(err, convey.ShouldBeNil)
+			fileDirB, err := fileDirFactory.New(&domain.CreateFileDirParam{URL: tc.urlB, Path: "/b", Typ: "file"})
+			convey.So(err, convey.ShouldBeNil)
+
+			keyA, err := factory.transputKeyOf(fileDirA)
+			convey.So(err, convey.ShouldBeNil)
+			keyB, err := factory.transputKeyOf(fileDirB)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(keyA == keyB, convey.ShouldEqual, tc.expectSame)
+		})
+	}
+}
+
+func TestTransputFactory_NewTransput_slowEndpoint(t *testing.T) {
+	convey.Convey("a slow endpoint does not block the other schemes", t, func() {
+		// accepts the ftp connection but never greets
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		convey.So(err, convey.ShouldBeNil)
+		defer listener.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		factory := newTransputFactory(&Config{}, nil, log.NewNopLogger())
+		fileDirFactory := domain.NewFileDirFactory()
+		ftpFileDir, err := fileDirFactory.New(&domain.CreateFileDirParam{URL: "ftp://" + listener.Addr().String() + "/a", Path: "/a", Typ: "file"})
+		convey.So(err, convey.ShouldBeNil)
+		fileFileDir, err := fileDirFactory.New(&domain.CreateFileDirParam{URL: "file:///b", Path: "/b", Typ: "file"})
+		convey.So(err, convey.ShouldBeNil)
+
+		ftpErr := make(chan error, 1)
+		go func() {
+			_, err := factory.NewTransput(ftpFileDir)
+			ftpErr <- err
+		}()
+		conn := <-accepted
+
+		fileDone := make(chan error, 1)
+		go func() {
+			_, err := factory.NewTransput(fileFileDir)
+			fileDone <- err
+		}()
+		select {
+		case err := <-fileDone:
+			convey.So(err, convey.ShouldBeNil)
+		case <-time.After(5 * time.Second):
+			t.Fatal("file transput blocked by the ftp dial")
+		}
+
+		// the failed creation is not cached
+		convey.So(conn.Close(), convey.ShouldBeNil)
+		convey.So(<-ftpErr, convey.ShouldNotBeNil)
+		key, err := factory.transputKeyOf(ftpFileDir)
+		convey.So(err, convey.ShouldBeNil)
+		_, ok := factory.transputs[key]
+		convey.So(ok, convey.ShouldBeFalse)
+	})
+}
+
+func TestTransputFactory_NewTransput_slowConfig(t *testing.T) {
+	convey.Convey("other schemes are not blocked by reading the s3 config", t, func() {
+		// reading a fifo blocks until it is written
+		s3ConfigPath := filepath.Join(t.TempDir(), "s3sdk.ini")
+		convey.So(syscall.Mkfifo(s3ConfigPath, 0600), convey.ShouldBeNil)
+
+		factory := newTransputFactory(&Config{S3ConfigPath: s3ConfigPath}, nil, log.NewNopLogger())
+		fileDirFactory := domain.NewFileDirFactory()
+		s3FileDir, err := fileDirFactory.New(&domain.CreateFileDirParam{URL: "s3://ak:sk@bucket/a", Path: "/a", Typ: "file"})
+		convey.So(err, convey.ShouldBeNil)
+		fileFileDir, err := fileDirFactory.New(&domain.CreateFileDirParam{URL: "file:///b", Path: "/b", Typ: "file"})
+		convey.So(err, convey.ShouldBeNil)
+
+		s3Done := make(chan error, 1)
+		go func() {
+			_, err := factory.NewTransput(s3FileDir)
+			s3Done <- err
+		}()
+
+		fileDone := make(chan error, 1)
+		go func() {
+			_, err := factory.NewTransput(fileFileDir)
+			fileDone <- err
+		}()
+		select {
+		case err := <-fileDone:
+			convey.So(err, convey.ShouldBeNil)
+		case <-time.After(5 * time.Second):
+			t.Fatal("file transput blocked by the s3 config")
+		}
+
+		convey.So(os.WriteFile(s3ConfigPath, []byte("[default]\nendpoint_url = https://s3.example.com\n"), 0600), convey.ShouldBeNil)
+		// the s3 client itself may fail on the environment, the config is loaded anyway
+		<-s3Done
+		key, err := factory.transputKeyOf(s3FileDir)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(key.endpoint, convey.ShouldEqual, "https://s3.example.com")
+	})
+}
+
+func TestTransputFactory_NewTransput_tos(t *testing.T) {
+	configDir := t.TempDir()
+	s3ConfigPath := filepath.Join(configDir, "s3sdk.ini")
+	if err := os.WriteFile(s3ConfigPath, []byte("[default]\nendpoint_url = https://s3.example.com\n"), 0644); err != nil {
+		t.Fatalf("Failed to write s3 config: %v", err)
+	}
+	tosConfigPath := filepath.Join(configDir, "tossdk.ini")
+	if err := os.WriteFile(tosConfigPath, []byte("[default]\nendpoint_url = https://tos.example.com\nregion = cn-beijing\n"), 0644); err != nil {
+		t.Fatalf("Failed to write tos config: %v", err)
+	}
+
+	convey.Convey("tos urls are served by a cached tos transput", t, func() {
+		factory := newTransputFactory(&Config{
+			S3ConfigPath:  s3ConfigPath,
+			TOSConfigPath: tosConfigPath,
+			TOSSecretPath: filepath.Join(configDir, "not-exist"),
+		}, nil, log.NewNopLogger())
+		fileDirFactory := domain.NewFileDirFactory()
+		newFileDir := func(url string) *domain.FileDir {
+			fileDir, err := fileDirFactory.New(&domain.CreateFileDirParam{URL: url, Path: "/a", Typ: "file"})
+			convey.So(err, convey.ShouldBeNil)
+			return fileDir
+		}
+
+		tosFileDir := newFileDir("tos://ak:sk@bucket/a")
+		trans, err := factory.NewTransput(tosFileDir)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(fmt.Sprintf("%T", trans), convey.ShouldEqual, "*tos.tosTransput")
+
+		key, err := factory.transputKeyOf(tosFileDir)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(key.endpoint, convey.ShouldEqual, "https://tos.example.com")
+		again, err := factory.NewTransput(newFileDir("tos://ak:sk@bucket/b"))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(again, convey.ShouldEqual, trans)
+
+		// the same credentials on the s3 endpoint are another client
+		s3Key, err := factory.transputKeyOf(newFileDir("s3://ak:sk@bucket/a"))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(s3Key.endpoint, convey.ShouldEqual, "https://s3.example.com")
+		convey.So(s3Key == key, convey.ShouldBeFalse)
+
+		// the shared credentials are missing, the failed creation is not cached
+		sharedFileDir := newFileDir("tos://bucket/a")
+		_, err = factory.NewTransput(sharedFileDir)
+		convey.So(err, convey.ShouldNotBeNil)
+		sharedKey, err := factory.transputKeyOf(sharedFileDir)
+		convey.So(err, convey.ShouldBeNil)
+		_, ok := factory.transputs[sharedKey]
+		convey.So(ok, convey.ShouldBeFalse)
+	})
+}
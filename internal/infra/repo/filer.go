@@ -3,58 +3,106 @@ package repo
 import (
 	"bufio"
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/sync/errgroup"
+
 	"github.com/GBA-BI/tes-filer/internal/domain"
 	"github.com/GBA-BI/tes-filer/pkg/consts"
 	apperror "github.com/GBA-BI/tes-filer/pkg/error"
 	"github.com/GBA-BI/tes-filer/pkg/log"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
-	"github.com/GBA-BI/tes-filer/pkg/transput/drs"
-	"github.com/GBA-BI/tes-filer/pkg/transput/file"
-	"github.com/GBA-BI/tes-filer/pkg/transput/ftp"
-	"github.com/GBA-BI/tes-filer/pkg/transput/http"
-	"github.com/GBA-BI/tes-filer/pkg/transput/s3"
-	"github.com/GBA-BI/tes-filer/pkg/transput/tos"
 	utilspath "github.com/GBA-BI/tes-filer/pkg/utils/path"
 	"github.com/GBA-BI/tes-filer/pkg/utils/retry"
-	"github.com/GBA-BI/tes-filer/pkg/viper"
 )
 
 func NewFilerRepo(cfg *Config, logger log.Logger) (domain.Filer, error) {
 	if cfg == nil {
 		return nil, apperror.NewInvalidArgumentError("repo.Config", "")
 	}
+	concurrency, err := cfg.concurrency()
+	if err != nil {
+		return nil, err
+	}
+	schemeConcurrency, err := cfg.schemeConcurrency()
+	if err != nil {
+		return nil, err
+	}
+	localAttrs, err := cfg.localAttrs()
+	if err != nil {
+		return nil, err
+	}
+	limits, err := cfg.limits()
+	if err != nil {
+		return nil, err
+	}
+	offload, err := newOffloadReader(cfg)
+	if err != nil {
+		return nil, err
+	}
 	return &filerRepo{
-		transputFactory: newTransputFactory(cfg, logger),
-
-		offloadType: cfg.OffloadType,
-		logger:      logger,
-		isMountTOS:  strings.ToLower(cfg.IsMountTOS) == "true",
+		transputFactory: newTransputFactory(cfg, limits, logger),
+		engine:          transput.NewEngine(concurrency, schemeConcurrency),
+
+		offload:    offload,
+		logger:     logger,
+		isMountTOS: strings.ToLower(cfg.IsMountTOS) == "true",
+
+		globNoMatchPolicy: cfg.GlobNoMatchPolicy,
+		symlinkPolicy: &transput.SymlinkPolicy{
+			Mode:    cfg.SymlinkPolicy,
+			Confine: strings.ToLower(cfg.SymlinkConfine) == "true",
+		},
+		dirMarkers:      strings.ToLower(cfg.DirMarkers) == "true",
+		localAttrs:      localAttrs,
+		continueOnError: strings.ToLower(cfg.ContinueOnError) == "true",
+		resultPath:      cfg.ResultPath,
+		resultChecksum:  strings.ToLower(cfg.ResultChecksum) == "true",
+		stateDir:        cfg.StateDir,
+		checkpointDir:   cfg.CheckpointDir,
 	}, nil
 }
 
 type filerRepo struct {
 	transputFactory *transputFactory
+	// engine schedules the single file transfers of all FileDirs
+	engine *transput.Engine
 
-	offloadType string
+	offload offloadReader
 
 	logger log.Logger
 
 	isMountTOS bool
+
+	globNoMatchPolicy string
+	symlinkPolicy     *transput.SymlinkPolicy
+	// dirMarkers keeps the empty directories of directory transfers
+	dirMarkers bool
+	// localAttrs are the attributes of the files and directories created by downloads
+	localAttrs *transput.LocalAttrs
+	// continueOnError attempts all FileDirs even if some of them failed
+	continueOnError bool
+	// resultPath is where the json result of all files is written, disabled if empty
+	resultPath string
+	// resultChecksum adds the md5 of the files to the result
+	resultChecksum bool
+	// stateDir keeps the journal of done file transfers to resume from, see
+	// defaultStateDir if empty
+	stateDir string
+	// checkpointDir keeps the checkpoints of multipart transfers to resume
+	// from, the checkpoints directory in the state dir if empty
+	checkpointDir string
 }
 
 func (r *filerRepo) BuildFromFile(ctx context.Context, path string, mode string) (*domain.FileDirs, error) {
-	inputsStr, outputsStr, err := r.readFile(path)
+	inputsStr, outputsStr, err := r.readFile(ctx, path)
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +125,10 @@ func (r *filerRepo) BuildFromFile(ctx context.Context, path string, mode string)
 			if err != nil {
 				return nil, err
 			}
+			// only outputs are matched against the local file system
+			if tempFileDir.HasWildcard() {
+				return nil, apperror.NewInvalidArgumentError("FileDir.Path", tempFileDir.Path)
+			}
 			inputFileDirList = append(inputFileDirList, tempFileDir)
 		}
 	}
@@ -91,6 +143,9 @@ func (r *filerRepo) BuildFromFile(ctx context.Context, path string, mode string)
 			if err != nil {
 				return nil, err
 			}
+			if tempFileDir.HasContent() {
+				return nil, apperror.NewInvalidArgumentError("FileDir.Content", "of output "+tempFileDir.Path)
+			}
 			outputFileDirList = append(outputFileDirList, tempFileDir)
 		}
 	}
@@ -99,8 +154,43 @@ func (r *filerRepo) BuildFromFile(ctx context.Context, path string, mode string)
 	return fileDirsFactory.New(inputFileDirList, outputFileDirList, mode)
 }
 
-func (r *filerRepo) Transput(ctx context.Context, fileDirs *domain.FileDirs) error {
+func (r *filerRepo) Transput(ctx context.Context, fileDirs *domain.FileDirs) (err error) {
 	startTime := time.Now()
+	rep := &report{}
+	ctx = withReport(ctx, rep)
+	defer rep.log(r.logger)
+	if r.resultPath != "" {
+		// checksums of the files are only computed for the result file
+		ctx = transput.WithRecorder(ctx, rep)
+		ctx = transput.WithRecordChecksum(ctx, r.resultChecksum)
+		defer func() {
+			if writeErr := rep.writeResult(r.resultPath); writeErr != nil {
+				r.logger.Errorf("failed to write result file %s: %v", r.resultPath, writeErr)
+				if err == nil {
+					err = writeErr
+				}
+			}
+		}()
+	}
+	stateDir := r.stateDir
+	if stateDir == "" {
+		stateDir = defaultStateDir(fileDirs)
+	}
+	if stateDir != "" {
+		j, err := openJournal(stateDir, r.logger)
+		if err != nil {
+			return err
+		}
+		defer j.close()
+		ctx = transput.WithJournal(ctx, j)
+	}
+	checkpointDir := r.checkpointDir
+	if checkpointDir == "" && stateDir != "" {
+		checkpointDir = filepath.Join(stateDir, "checkpoints")
+	}
+	if checkpointDir != "" {
+		ctx = transput.WithCheckpointDir(ctx, checkpointDir)
+	}
 	switch fileDirs.Mode {
 	case consts.TransputModeOutputs:
 		return r.upload(ctx, fileDirs)
@@ -129,50 +219,168 @@ func (r *filerRepo) upload(ctx context.Context, fileDirs *domain.FileDirs) error
 		return nil
 	}
 
-	for _, fileDir := range fileDirs.Outputs {
-		if err := retry.MountTOSRetry(r.logger, r.isMountTOS, func() error {
-			return r.uploadFileDir(ctx, fileDir)
-		}); err != nil {
-			return err
+	outputs, failed := r.expandWildcards(ctx, fileDirs.Outputs)
+	if len(failed) > 0 && !r.continueOnError {
+		return failed[0]
+	}
+	return r.forEachFileDir(ctx, consts.TransputModeOutputs, outputs, failed, r.uploadFileDir)
+}
+
+// expandWildcards replaces the outputs with wildcard paths by one output per
+// matched file or directory. The errors of the outputs failed to expand are
+// returned, the first one stops expanding unless continueOnError.
+func (r *filerRepo) expandWildcards(ctx context.Context, fileDirList []*domain.FileDir) ([]*domain.FileDir, []error) {
+	res := make([]*domain.FileDir, 0, len(fileDirList))
+	var errs []error
+	for _, fileDir := range fileDirList {
+		if !fileDir.HasWildcard() {
+			res = append(res, fileDir)
+			continue
+		}
+		expanded, err := r.expandWildcard(ctx, fileDir)
+		if err != nil {
+			fileDirErr := domain.NewFileDirError(consts.TransputModeOutputs, fileDir, err)
+			reportFrom(ctx).fail(fileDirErr)
+			errs = append(errs, fileDirErr)
+			if !r.continueOnError {
+				return nil, errs
+			}
+			continue
+		}
+		res = append(res, expanded...)
+	}
+	return res, errs
+}
+
+// expandWildcard returns the outputs of the files and directories matched by
+// the wildcard path of fileDir.
+func (r *filerRepo) expandWildcard(ctx context.Context, fileDir *domain.FileDir) ([]*domain.FileDir, error) {
+	matches, err := filepath.Glob(fileDir.Path)
+	if err != nil {
+		return nil, apperror.NewInvalidArgumentError("FileDir.Path", fileDir.Path)
+	}
+	if len(matches) == 0 {
+		if !fileDir.Optional && r.globNoMatchPolicy == consts.GlobNoMatchError {
+			err := apperror.NewRequiredOutputMissingError(fileDir.Path)
+			transput.Report(ctx, transput.NewRecord(consts.TransputModeOutputs, fileDir.Path, fileDir.URL, err))
+			return nil, err
+		}
+		r.logger.Warnf("upload %s: %s matches nothing, just skip", fileDir.Typ, fileDir.Path)
+		reportFrom(ctx).skip(consts.TransputModeOutputs, fileDir, "matches nothing")
+		return nil, nil
+	}
+
+	res := make([]*domain.FileDir, 0, len(matches))
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, apperror.NewInternalError(err)
 		}
+		typ := consts.FileTypeFile
+		if info.IsDir() {
+			typ = consts.FileTypeDir
+		}
+		expanded, err := fileDir.Expand(match, typ)
+		if err != nil {
+			return nil, err
+		}
+		r.logger.Infof("output %s matches %s %s", fileDir.Path, typ, match)
+		res = append(res, expanded)
 	}
+	return res, nil
+}
 
+// forEachFileDir transfers the FileDirs at the same time, the number of
+// running file transfers is bounded by the engine. It stops at the first
+// failed FileDir, or attempts all of them if continueOnError. failed are the
+// errors of the FileDirs which failed before transferring, returned along
+// with the others.
+func (r *filerRepo) forEachFileDir(ctx context.Context, mode consts.TransputMode, fileDirList []*domain.FileDir, failed []error, fn func(context.Context, *domain.FileDir) error) error {
+	parent := ctx
+	g := &errgroup.Group{}
+	if !r.continueOnError {
+		g, ctx = errgroup.WithContext(ctx)
+	}
+	rep := reportFrom(ctx)
+	var lock sync.Mutex
+	errs := failed
+	for _, fileDir := range fileDirList {
+		fileDir := fileDir
+		g.Go(func() error {
+			fileDirCtx := transput.WithEngine(ctx, r.engine, fileDir.Scheme)
+			err := retry.MountTOSRetry(r.logger, r.isMountTOS, func() error {
+				return fn(fileDirCtx, fileDir)
+			})
+			if err == nil {
+				return nil
+			}
+			fileDirErr := domain.NewFileDirError(mode, fileDir, err)
+			if !r.continueOnError {
+				// not reported if interrupted by the failure of another FileDir,
+				// which is the one returned
+				if ctx.Err() == nil || parent.Err() != nil || !isCancelled(err) {
+					rep.fail(fileDirErr)
+				}
+				return fileDirErr
+			}
+			rep.fail(fileDirErr)
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, fileDirErr)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return apperror.NewMultiError(errs)
+	}
 	return nil
 }
 
+// isCancelled reports whether err is caused by the cancellation of its ctx.
+func isCancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || apperror.CodeOf(err) == fmt.Sprintf("%d", apperror.ErrCancelled)
+}
+
 func (r *filerRepo) uploadFileDir(ctx context.Context, fileDir *domain.FileDir) error {
-	if r.checkFinished(fileDir, string(consts.TransputModeOutputs)) {
-		r.logger.Infof("already upload file %s", fileDir.Path)
-		return nil
-	}
-	// if file not exist , log warning and skip
+	// if optional file not exist, log warning and skip
 	_, err := os.Stat(fileDir.Path)
 	if os.IsNotExist(err) {
+		if !fileDir.Optional {
+			err := apperror.NewRequiredOutputMissingError(fileDir.Path)
+			transput.Report(ctx, transput.NewRecord(consts.TransputModeOutputs, fileDir.Path, fileDir.URL, err))
+			return err
+		}
 		r.logger.Warnf("upload %s: %s not exist, just skip", fileDir.Typ, fileDir.Path)
+		reportFrom(ctx).skip(consts.TransputModeOutputs, fileDir, "not exist")
 		return nil
 	}
 	if err != nil {
 		return apperror.NewInternalError(err)
 	}
-	transput, err := r.transputFactory.NewTransput(fileDir.Scheme, fileDir.UserInfo)
+	trans, err := r.transputFactory.NewTransput(fileDir)
 	if err != nil {
 		return err
 	}
 	if fileDir.Typ == consts.FileTypeDir {
+		ctx = transput.WithFilter(ctx, transput.NewFilter(fileDir.Include, fileDir.Exclude))
+		ctx = transput.WithSymlinkPolicy(ctx, r.symlinkPolicy)
+		ctx = transput.WithDirMarkers(ctx, r.dirMarkers)
 		r.logger.Infof("start uploading dir %s to url %s ", fileDir.Path, fileDir.URLForLog())
-		if err := transput.UploadDir(ctx, fileDir.Path, fileDir.URL); err != nil {
+		if err := trans.UploadDir(ctx, fileDir.Path, fileDir.URL); err != nil {
 			return apperror.NewInternalError(err)
 		}
 		r.logger.Infof("finish uploading dir %s to url %s", fileDir.Path, fileDir.URLForLog())
 	}
 	if fileDir.Typ == consts.FileTypeFile {
 		r.logger.Infof("start uploading file %s to url %s", fileDir.Path, fileDir.URLForLog())
-		if err := transput.UploadFile(ctx, fileDir.Path, fileDir.URL); err != nil {
+		if err := transput.RunUpload(ctx, trans, fileDir.Path, fileDir.URL); err != nil {
 			return apperror.NewInternalError(err)
 		}
 		r.logger.Infof("finish uploading file %s to url %s", fileDir.Path, fileDir.URLForLog())
 	}
-	r.setFinished(fileDir, string(consts.TransputModeOutputs))
 	return nil
 }
 
@@ -182,44 +390,70 @@ func (r *filerRepo) download(ctx context.Context, fileDirs *domain.FileDirs) err
 		return nil
 	}
 
-	for _, fileDir := range fileDirs.Inputs {
-		if err := retry.MountTOSRetry(r.logger, r.isMountTOS, func() error {
-			return r.downloadFileDir(ctx, fileDir)
-		}); err != nil {
-			return err
-		}
-	}
-	return nil
+	return r.forEachFileDir(ctx, consts.TransputModeInputs, fileDirs.Inputs, nil, r.downloadFileDir)
 }
 
 func (r *filerRepo) downloadFileDir(ctx context.Context, fileDir *domain.FileDir) error {
-	if r.checkFinished(fileDir, string(consts.TransputModeInputs)) {
-		r.logger.Infof("already download file %s", fileDir.Path)
-		return nil
+	ctx = transput.WithLocalAttrs(ctx, r.localAttrs)
+	// literal content is cheap to write, no need to journal
+	if fileDir.HasContent() {
+		return r.writeContent(ctx, fileDir)
 	}
-	transput, err := r.transputFactory.NewTransput(fileDir.Scheme, fileDir.UserInfo)
+	trans, err := r.transputFactory.NewTransput(fileDir)
 	if err != nil {
 		return err
 	}
 	if fileDir.Typ == consts.FileTypeDir {
+		ctx = transput.WithFilter(ctx, transput.NewFilter(fileDir.Include, fileDir.Exclude))
+		ctx = transput.WithDirMarkers(ctx, r.dirMarkers)
 		r.logger.Infof("start downloading dir %s from url %s", fileDir.Path, fileDir.URLForLog())
-		if err := transput.DownloadDir(ctx, fileDir.Path, fileDir.URL); err != nil {
-			return apperror.NewInternalError(err)
+		if err := trans.DownloadDir(ctx, fileDir.Path, fileDir.URL); err != nil {
+			return r.skipOptionalInput(ctx, fileDir, err)
 		}
 		r.logger.Infof("finish downloading dir %s from url %s", fileDir.Path, fileDir.URLForLog())
 	}
 	if fileDir.Typ == consts.FileTypeFile {
 		r.logger.Infof("start downloading file %s from url %s", fileDir.Path, fileDir.URLForLog())
-		if err := transput.DownloadFile(ctx, fileDir.Path, fileDir.URL); err != nil {
-			return apperror.NewInternalError(err)
+		if err := transput.RunDownload(ctx, trans, fileDir.Path, fileDir.URL); err != nil {
+			return r.skipOptionalInput(ctx, fileDir, err)
 		}
 		r.logger.Infof("finish downloading file %s from url %s", fileDir.Path, fileDir.URLForLog())
 	}
-	r.setFinished(fileDir, string(consts.TransputModeInputs))
 	return nil
 }
 
-func (r *filerRepo) readFile(path string) (string, string, error) {
+// skipOptionalInput skips the optional input whose remote does not exist,
+// other download errors are returned.
+func (r *filerRepo) skipOptionalInput(ctx context.Context, fileDir *domain.FileDir, err error) error {
+	if !fileDir.Optional || !errors.Is(err, transput.ErrNotExist) {
+		return apperror.NewInternalError(err)
+	}
+	r.logger.Warnf("download %s: url %s not exist, just skip: %v", fileDir.Typ, fileDir.URLForLog(), err)
+	reportFrom(ctx).skip(consts.TransputModeInputs, fileDir, "not exist")
+	return nil
+}
+
+func (r *filerRepo) writeContent(ctx context.Context, fileDir *domain.FileDir) error {
+	r.logger.Infof("start writing content of input %s to %s", fileDir.Name, fileDir.Path)
+	// written like the downloads, so that a restart never sees a partial
+	// content and the configured owner and read-only apply
+	file, err := transput.CreateAtomic(ctx, fileDir.Path)
+	if err != nil {
+		return apperror.NewInternalError(transput.ClassifyError(err))
+	}
+	defer file.Abort()
+	file.SetMode(os.FileMode(consts.DefaultContentFileMode))
+	if _, err := file.WriteString(*fileDir.Content); err != nil {
+		return apperror.NewInternalError(transput.ClassifyError(err))
+	}
+	if err := file.Commit(int64(len(*fileDir.Content)), nil); err != nil {
+		return apperror.NewInternalError(transput.ClassifyError(err))
+	}
+	r.logger.Infof("finish writing content of input %s to %s", fileDir.Name, fileDir.Path)
+	return nil
+}
+
+func (r *filerRepo) readFile(ctx context.Context, path string) (string, string, error) {
 	exist, err := utilspath.FileExists(path)
 	if err != nil {
 		return "", "", apperror.NewInternalError(err)
@@ -260,136 +494,16 @@ func (r *filerRepo) readFile(path string) (string, string, error) {
 		case "task-outputs":
 			outputsStr = anno
 		case "task-inputs-ref":
-			if r.offloadType == consts.OffloadTypePVC {
-				inputsStr, err = r.getFromPVC(anno)
-				if err != nil {
-					return "", "", err
-				}
+			inputsStr, err = r.offload.Read(ctx, anno)
+			if err != nil {
+				return "", "", err
 			}
 		case "task-outputs-ref":
-			if r.offloadType == consts.OffloadTypePVC {
-				outputsStr, err = r.getFromPVC(anno)
-				if err != nil {
-					return "", "", err
-				}
+			outputsStr, err = r.offload.Read(ctx, anno)
+			if err != nil {
+				return "", "", err
 			}
 		}
 	}
 	return inputsStr, outputsStr, nil
 }
-
-func (r *filerRepo) getFromPVC(ref string) (string, error) {
-	exist, err := utilspath.FileExists(ref)
-	if err != nil {
-		return "{}", apperror.NewInternalError(err)
-	}
-	if !exist {
-		return "{}", nil
-	}
-
-	content, err := os.ReadFile(ref)
-	if err != nil {
-		return "", apperror.NewInternalError(err)
-	}
-
-	return string(content), nil
-}
-
-func (r *filerRepo) setFinished(fileDir *domain.FileDir, mode string) {
-	finishPath := genFinishPath(fileDir.Path, string(fileDir.Scheme), fileDir.URL, mode)
-	if _, err := os.Create(finishPath); err != nil {
-		r.logger.Debugf("Unable to create finish file: %v", err)
-	}
-}
-
-func (r *filerRepo) checkFinished(fileDir *domain.FileDir, mode string) bool {
-	finishPath := genFinishPath(fileDir.Path, string(fileDir.Scheme), fileDir.URL, mode)
-	if _, err := os.Stat(finishPath); err != nil {
-		if !os.IsNotExist(err) {
-			r.logger.Debugf("Unable to check finishPath %s: %v", finishPath, err)
-		}
-		return false
-	}
-	return true
-}
-
-func newTransputFactory(cfg *Config, logger log.Logger) *transputFactory {
-	return &transputFactory{
-		s3ConfigPath:         cfg.S3ConfigPath,
-		expirationConfigPath: cfg.ExpirationConfigPath,
-		s3SecretPath:         cfg.S3SecretPath,
-		transputMap:          sync.Map{},
-		logger:               logger,
-	}
-}
-
-type transputFactory struct {
-	s3ConfigPath         string
-	expirationConfigPath string
-	s3SecretPath         string
-	transputMap          sync.Map
-	logger               log.Logger
-}
-
-func (t *transputFactory) NewTransput(schema consts.Scheme, userInfo *url.Userinfo) (transput.Transput, error) {
-	if trans, ok := t.transputMap.Load(schema); ok {
-		return trans.(transput.Transput), nil
-	}
-	var newTrans transput.Transput
-	var err error
-
-	switch schema {
-	case consts.SchemeHTTP:
-		cfg := &http.Config{}
-		newTrans, err = http.NewHTTPTransput(cfg)
-	case consts.SchemeDRS:
-		cfg := &drs.Config{}
-		viper.SetConfigFromEnv(cfg)
-		newTrans, err = drs.NewDRSTransput(cfg, t.logger)
-	case consts.SchemeFTP:
-		cfg := &ftp.Config{}
-		viper.SetConfigFromEnv(cfg)
-		newTrans, err = ftp.NewFTPTransput(cfg)
-	case consts.SchemeFILE:
-		cfg := &file.Config{}
-		viper.SetConfigFromEnv(cfg)
-		newTrans, err = file.NewFileTransput(cfg, t.logger)
-	case consts.SchemeS3:
-		s3SDKConfig := &transput.S3SDKConfig{}
-		if err := viper.SetConfigFromFileINI(t.s3ConfigPath, "", s3SDKConfig); err != nil {
-			return nil, apperror.NewInternalError(err)
-		}
-
-		if strings.ToLower(s3SDKConfig.S3Type) == strings.ToLower(string(consts.SchemeTOS)) {
-			cfg := &tos.Config{
-				CredentialFilePath: t.s3SecretPath,
-				ExpirationFilePath: t.expirationConfigPath,
-
-				S3SDKConfig: *s3SDKConfig,
-			}
-			newTrans, err = tos.NewTOSTransput(cfg, userInfo, t.logger)
-		} else {
-			cfg := &s3.Config{
-				CredentialFilePath: t.s3SecretPath,
-				ExpirationFilePath: t.expirationConfigPath,
-
-				S3SDKConfig: *s3SDKConfig,
-			}
-			newTrans, err = s3.NewS3Transput(cfg, userInfo)
-		}
-	default:
-		return nil, apperror.NewInvalidArgumentError("transput.Scheme", string(schema))
-	}
-	if err != nil {
-		return nil, apperror.NewInternalError(err)
-	}
-	t.transputMap.Store(schema, newTrans)
-	return newTrans, nil
-}
-
-func genFinishPath(path, scheme, url, mode string) string {
-	md5hash := md5.Sum([]byte(path + url))
-	md5hashStr := hex.EncodeToString(md5hash[:])
-	finishName := fmt.Sprintf(".%s-%s-%s.finish", mode, scheme, md5hashStr)
-	return filepath.Join(filepath.Dir(path), finishName)
-}
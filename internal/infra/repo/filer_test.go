@@ -0,0 +1,369 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
+)
+
+func TestFilerRepo_uploadMissingOutput(t *testing.T) {
+	tests := []struct {
+		name        string
+		optional    bool
+		expectErr   bool
+		expectSkips int
+	}{
+		{
+			name:        "skip missing optional output",
+			optional:    true,
+			expectErr:   false,
+			expectSkips: 1,
+		},
+		{
+			name:        "fail missing required output",
+			optional:    false,
+			expectErr:   true,
+			expectSkips: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			r := &filerRepo{logger: log.NewNopLogger()}
+			rep := &report{}
+			fileDir := &domain.FileDir{
+				Path:     filepath.Join(t.TempDir(), "missing"),
+				URL:      "s3://bucket/missing",
+				Typ:      consts.FileTypeFile,
+				Scheme:   consts.SchemeS3,
+				Optional: tc.optional,
+			}
+
+			err := r.uploadFileDir(withReport(context.Background(), rep), fileDir)
+			if tc.expectErr {
+				var appErr *apperror.Error
+				convey.So(errors.As(err, &appErr), convey.ShouldBeTrue)
+				convey.So(appErr.Code, convey.ShouldEqual, "1000005")
+				convey.So(apperror.ExitCode(err), convey.ShouldEqual, apperror.ExitRequiredOutputMissing)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+			}
+			convey.So(len(rep.skipped), convey.ShouldEqual, tc.expectSkips)
+		})
+	}
+}
+
+func TestFilerRepo_writeContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		attrs      *transput.LocalAttrs
+		expectMode os.FileMode
+	}{
+		{
+			name:       "executable by default",
+			attrs:      &transput.LocalAttrs{},
+			expectMode: 0755,
+		},
+		{
+			name:       "executable over the file mode of downloads",
+			attrs:      &transput.LocalAttrs{FileMode: 0640},
+			expectMode: 0755,
+		},
+		{
+			name:       "read-only",
+			attrs:      &transput.LocalAttrs{ReadOnly: true},
+			expectMode: 0555,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			r := &filerRepo{logger: log.NewNopLogger()}
+			content := "echo hello"
+			fileDir := &domain.FileDir{
+				Name:    "script",
+				Path:    filepath.Join(t.TempDir(), "sub", "script.sh"),
+				Typ:     consts.FileTypeFile,
+				Content: &content,
+			}
+			ctx := transput.WithLocalAttrs(context.Background(), tc.attrs)
+
+			convey.So(r.writeContent(ctx, fileDir), convey.ShouldBeNil)
+			data, err := os.ReadFile(fileDir.Path)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(data), convey.ShouldEqual, content)
+			info, err := os.Stat(fileDir.Path)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Mode().Perm(), convey.ShouldEqual, tc.expectMode)
+			_, err = os.Stat(transput.TempPath(fileDir.Path))
+			convey.So(os.IsNotExist(err), convey.ShouldBeTrue)
+		})
+	}
+}
+
+func TestFilerRepo_skipOptionalInput(t *testing.T) {
+	tests := []struct {
+		name        string
+		optional    bool
+		err         error
+		expectErr   bool
+		expectSkips int
+	}{
+		{
+			name:        "skip not exist optional input",
+			optional:    true,
+			err:         transput.NotExistError("s3://bucket/a", errors.New("NoSuchKey")),
+			expectErr:   false,
+			expectSkips: 1,
+		},
+		{
+			name:        "fail not exist required input",
+			optional:    false,
+			err:         transput.NotExistError("s3://bucket/a", errors.New("NoSuchKey")),
+			expectErr:   true,
+			expectSkips: 0,
+		},
+		{
+			name:        "fail other error of optional input",
+			optional:    true,
+			err:         errors.New("connection reset"),
+			expectErr:   true,
+			expectSkips: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			r := &filerRepo{logger: log.NewNopLogger()}
+			rep := &report{}
+			fileDir := &domain.FileDir{
+				Path:     "/inputs/a",
+				URL:      "s3://bucket/a",
+				Typ:      consts.FileTypeFile,
+				Scheme:   consts.SchemeS3,
+				Optional: tc.optional,
+			}
+
+			err := r.skipOptionalInput(withReport(context.Background(), rep), fileDir, tc.err)
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+			}
+			convey.So(len(rep.skipped), convey.ShouldEqual, tc.expectSkips)
+		})
+	}
+}
+
+func TestFilerRepo_forEachFileDir(t *testing.T) {
+	tests := []struct {
+		name            string
+		continueOnError bool
+		failed          map[string]bool
+		// interrupted FileDirs run until cancelled by the failed ones
+		interrupted    bool
+		expectErr      bool
+		expectAttempts int
+		expectFailures int
+	}{
+		{
+			name:            "all succeeded",
+			continueOnError: true,
+			failed:          map[string]bool{},
+			expectErr:       false,
+			expectAttempts:  4,
+			expectFailures:  0,
+		},
+		{
+			name:            "continue on error",
+			continueOnError: true,
+			failed:          map[string]bool{"a": true, "c": true},
+			expectErr:       true,
+			expectAttempts:  4,
+			expectFailures:  2,
+		},
+		{
+			name:            "stop at the first error",
+			continueOnError: false,
+			failed:          map[string]bool{"a": true},
+			expectErr:       true,
+			expectFailures:  1,
+		},
+		{
+			name:            "not report the FileDirs interrupted by the first error",
+			continueOnError: false,
+			failed:          map[string]bool{"a": true},
+			interrupted:     true,
+			expectErr:       true,
+			expectAttempts:  4,
+			expectFailures:  1,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			r := &filerRepo{
+				engine:          transput.NewEngine(1, nil),
+				logger:          log.NewNopLogger(),
+				continueOnError: tc.continueOnError,
+			}
+			rep := &report{}
+			fileDirList := []*domain.FileDir{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+
+			var lock sync.Mutex
+			attempts := 0
+			err := r.forEachFileDir(withReport(context.Background(), rep), consts.TransputModeOutputs, fileDirList, nil, func(ctx context.Context, fileDir *domain.FileDir) error {
+				lock.Lock()
+				attempts++
+				lock.Unlock()
+				if tc.failed[fileDir.Name] {
+					return apperror.NewInternalError(errors.New("upload error"))
+				}
+				if tc.interrupted {
+					<-ctx.Done()
+					return apperror.NewInternalError(transput.ClassifyError(ctx.Err()))
+				}
+				return nil
+			})
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+				var fileDirErr *domain.FileDirError
+				convey.So(errors.As(err, &fileDirErr), convey.ShouldBeTrue)
+				convey.So(tc.failed[fileDirErr.Name], convey.ShouldBeTrue)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+			}
+			if tc.continueOnError || tc.interrupted {
+				convey.So(attempts, convey.ShouldEqual, tc.expectAttempts)
+				convey.So(len(rep.failed), convey.ShouldEqual, tc.expectFailures)
+			} else {
+				convey.So(len(rep.failed), convey.ShouldBeGreaterThanOrEqualTo, tc.expectFailures)
+			}
+		})
+	}
+}
+
+func TestFilerRepo_expandWildcards(t *testing.T) {
+	tests := []struct {
+		name            string
+		continueOnError bool
+		expectOutputs   int
+		expectErrs      int
+	}{
+		{
+			name:            "continue expanding after an error",
+			continueOnError: true,
+			expectOutputs:   1,
+			expectErrs:      2,
+		},
+		{
+			name:            "stop expanding at the first error",
+			continueOnError: false,
+			expectOutputs:   0,
+			expectErrs:      1,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			dir := t.TempDir()
+			convey.So(os.WriteFile(filepath.Join(dir, "a.bam"), []byte("a"), 0644), convey.ShouldBeNil)
+			r := &filerRepo{
+				logger:            log.NewNopLogger(),
+				continueOnError:   tc.continueOnError,
+				globNoMatchPolicy: consts.GlobNoMatchError,
+			}
+			rep := &report{}
+			fileDirList := []*domain.FileDir{
+				{Name: "missing", Path: filepath.Join(dir, "*.cram"), URL: "s3://bucket/results", Typ: consts.FileTypeFile},
+				{Name: "bam", Path: filepath.Join(dir, "*.bam"), URL: "s3://bucket/results", Typ: consts.FileTypeFile},
+				{Name: "malformed", Path: filepath.Join(dir, "[a-"), URL: "s3://bucket/results", Typ: consts.FileTypeFile},
+			}
+
+			outputs, errs := r.expandWildcards(withReport(context.Background(), rep), fileDirList)
+			convey.So(len(outputs), convey.ShouldEqual, tc.expectOutputs)
+			convey.So(len(errs), convey.ShouldEqual, tc.expectErrs)
+			convey.So(len(rep.failed), convey.ShouldEqual, tc.expectErrs)
+			var fileDirErr *domain.FileDirError
+			convey.So(errors.As(errs[0], &fileDirErr), convey.ShouldBeTrue)
+			convey.So(fileDirErr.Name, convey.ShouldEqual, "missing")
+		})
+	}
+}
+
+func TestReport_writeResult(t *testing.T) {
+	convey.Convey("write skipped and transferred files", t, func() {
+		rep := &report{}
+		rep.skip(consts.TransputModeInputs, &domain.FileDir{Name: "a", Path: "/inputs/a", URL: "s3://bucket/a"}, "not exist")
+		rep.Record(&transput.Record{
+			Mode:        consts.TransputModeOutputs,
+			Source:      "/outputs/b",
+			Destination: "s3://bucket/b",
+			SizeBytes:   10,
+			Status:      consts.ResultStatusSucceeded,
+		})
+
+		resultPath := filepath.Join(t.TempDir(), "result", "result.json")
+		convey.So(rep.writeResult(resultPath), convey.ShouldBeNil)
+
+		content, err := os.ReadFile(resultPath)
+		convey.So(err, convey.ShouldBeNil)
+		result := &struct {
+			Files []*transput.Record `json:"files"`
+		}{}
+		convey.So(json.Unmarshal(content, result), convey.ShouldBeNil)
+		convey.So(len(result.Files), convey.ShouldEqual, 2)
+		convey.So(result.Files[0].Status, convey.ShouldEqual, consts.ResultStatusSkipped)
+		convey.So(result.Files[0].Source, convey.ShouldEqual, "s3://bucket/a")
+		convey.So(result.Files[1].SizeBytes, convey.ShouldEqual, 10)
+	})
+}
+
+func TestReport_fail(t *testing.T) {
+	tests := []struct {
+		name          string
+		fileDir       *domain.FileDir
+		expectRecords int
+	}{
+		{
+			name:          "record the FileDir failed without files recorded",
+			fileDir:       &domain.FileDir{Name: "c", Path: "/outputs/c", URL: "s3://bucket/c"},
+			expectRecords: 2,
+		},
+		{
+			name:          "not record the FileDir whose file is recorded",
+			fileDir:       &domain.FileDir{Name: "b", Path: "/outputs/b", URL: "s3://bucket/b"},
+			expectRecords: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			rep := &report{}
+			rep.Record(transput.NewRecord(consts.TransputModeOutputs, "/outputs/b/x", "s3://bucket/b/x", errors.New("upload error")))
+
+			err := apperror.NewPermissionDeniedError("Bucket", "bucket")
+			rep.fail(domain.NewFileDirError(consts.TransputModeOutputs, tc.fileDir, err))
+			convey.So(len(rep.failed), convey.ShouldEqual, 1)
+			convey.So(len(rep.records), convey.ShouldEqual, tc.expectRecords)
+			rec := rep.records[len(rep.records)-1]
+			convey.So(rec.Status, convey.ShouldEqual, consts.ResultStatusFailed)
+			if tc.expectRecords > 1 {
+				convey.So(rec.Source, convey.ShouldEqual, tc.fileDir.Path)
+				convey.So(rec.ErrorCode, convey.ShouldEqual, "1000004")
+			}
+		})
+	}
+}
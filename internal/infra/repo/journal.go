@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/log"
+)
+
+const journalFileName = "transput.journal"
+
+// journal implements transput.Journal by appending a json line per done file
+// transfer to a file in the state directory, it is loaded again when the
+// filer is restarted.
+type journal struct {
+	lock   sync.Mutex
+	file   *os.File
+	done   map[journalKey]journalState
+	logger log.Logger
+}
+
+type journalKey struct {
+	mode  consts.TransputMode
+	local string
+	// remote is the md5 of the url, which may contain credentials
+	remote string
+}
+
+// journalState is the local file right after the transfer, the transfer is
+// done again if the file is changed since then.
+type journalState struct {
+	size    int64
+	modTime int64
+}
+
+type journalEntry struct {
+	Mode    consts.TransputMode `json:"mode"`
+	Local   string              `json:"local"`
+	Remote  string              `json:"remote"`
+	Size    int64               `json:"size"`
+	ModTime int64               `json:"mod_time"`
+}
+
+// openJournal loads the journal in stateDir and opens it for appending.
+func openJournal(stateDir string, logger log.Logger) (*journal, error) {
+	if err := os.MkdirAll(stateDir, os.FileMode(consts.DefaultFileMode)); err != nil {
+		return nil, apperror.NewInternalError(err)
+	}
+	path := filepath.Join(stateDir, journalFileName)
+	j := &journal{done: make(map[journalKey]journalState), logger: logger}
+	if err := j.load(path); err != nil {
+		return nil, apperror.NewInternalError(err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, apperror.NewInternalError(err)
+	}
+	j.file = file
+	if len(j.done) > 0 {
+		logger.Infof("resume from journal %s with %d done files", path, len(j.done))
+	}
+	return j, nil
+}
+
+func (j *journal) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		// the last line is torn if the filer is killed while appending it
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			j.logger.Warnf("skip invalid line of journal %s: %v", path, err)
+			continue
+		}
+		j.done[journalKey{mode: entry.Mode, local: entry.Local, remote: entry.Remote}] = journalState{size: entry.Size, modTime: entry.ModTime}
+	}
+	return scanner.Err()
+}
+
+// Done implements transput.Journal.
+func (j *journal) Done(mode consts.TransputMode, local, remote string) bool {
+	j.lock.Lock()
+	state, ok := j.done[newJournalKey(mode, local, remote)]
+	j.lock.Unlock()
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		return false
+	}
+	return info.Size() == state.size && info.ModTime().UnixNano() == state.modTime
+}
+
+// Add implements transput.Journal. A failure to record is only logged, the
+// transfer is just done again after a restart.
+func (j *journal) Add(mode consts.TransputMode, local, remote string) {
+	info, err := os.Stat(local)
+	if err != nil {
+		j.logger.Warnf("unable to stat %s for journal: %v", local, err)
+		return
+	}
+	key := newJournalKey(mode, local, remote)
+	content, err := json.Marshal(&journalEntry{
+		Mode:    key.mode,
+		Local:   key.local,
+		Remote:  key.remote,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	})
+	if err != nil {
+		j.logger.Warnf("unable to marshal journal entry of %s: %v", local, err)
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.file.Write(append(content, '\n')); err != nil {
+		j.logger.Warnf("unable to write journal entry of %s: %v", local, err)
+		return
+	}
+	j.done[key] = journalState{size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+func (j *journal) close() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.file.Close(); err != nil {
+		j.logger.Warnf("unable to close journal: %v", err)
+	}
+}
+
+func newJournalKey(mode consts.TransputMode, local, remote string) journalKey {
+	md5hash := md5.Sum([]byte(remote))
+	return journalKey{mode: mode, local: local, remote: hex.EncodeToString(md5hash[:])}
+}
+
+// defaultStateDir returns the state dir in the deepest directory containing
+// all inputs and outputs, next to them on the working volume so that it
+// survives the pod as they do. It is never in an output directory, nor
+// matched by a wildcard output. It is empty if there is no FileDir.
+func defaultStateDir(fileDirs *domain.FileDirs) string {
+	var common string
+	for _, fileDir := range append(append([]*domain.FileDir{}, fileDirs.Inputs...), fileDirs.Outputs...) {
+		dir := filepath.Dir(fileDir.Path)
+		if fileDir.HasWildcard() {
+			for strings.ContainsAny(dir, "*?[") {
+				dir = filepath.Dir(dir)
+			}
+			// the files directly in it are matched
+			dir = filepath.Dir(dir)
+		}
+		if common == "" {
+			common = dir
+			continue
+		}
+		for !isUnder(dir, common) {
+			common = filepath.Dir(common)
+		}
+	}
+	if common == "" {
+		return ""
+	}
+	return filepath.Join(common, consts.DefaultStateDirName)
+}
+
+// isUnder reports whether path is dir or under it.
+func isUnder(path, dir string) bool {
+	relPath, err := filepath.Rel(dir, path)
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
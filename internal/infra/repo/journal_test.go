@@ -0,0 +1,127 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	"github.com/GBA-BI/tes-filer/pkg/log"
+)
+
+func TestJournal(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       consts.TransputMode
+		remote     string
+		change     bool
+		tornLine   bool
+		expectDone bool
+	}{
+		{
+			name:       "done after restart",
+			mode:       consts.TransputModeOutputs,
+			remote:     "s3://bucket/a",
+			expectDone: true,
+		},
+		{
+			name:       "done with a torn last line",
+			mode:       consts.TransputModeOutputs,
+			remote:     "s3://bucket/a",
+			tornLine:   true,
+			expectDone: true,
+		},
+		{
+			name:   "local file changed",
+			mode:   consts.TransputModeOutputs,
+			remote: "s3://bucket/a",
+			change: true,
+		},
+		{
+			name:   "other remote",
+			mode:   consts.TransputModeOutputs,
+			remote: "s3://bucket/b",
+		},
+		{
+			name:   "other mode",
+			mode:   consts.TransputModeInputs,
+			remote: "s3://bucket/a",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			stateDir := filepath.Join(t.TempDir(), "state")
+			local := filepath.Join(t.TempDir(), "a")
+			convey.So(os.WriteFile(local, []byte("content"), 0644), convey.ShouldBeNil)
+
+			j, err := openJournal(stateDir, log.NewNopLogger())
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(j.Done(consts.TransputModeOutputs, local, "s3://bucket/a"), convey.ShouldBeFalse)
+			j.Add(consts.TransputModeOutputs, local, "s3://bucket/a")
+			j.close()
+
+			if tc.tornLine {
+				file, err := os.OpenFile(filepath.Join(stateDir, journalFileName), os.O_APPEND|os.O_WRONLY, 0644)
+				convey.So(err, convey.ShouldBeNil)
+				_, err = file.WriteString(`{"mode":"OUTPUTS","lo`)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(file.Close(), convey.ShouldBeNil)
+			}
+			if tc.change {
+				convey.So(os.WriteFile(local, []byte("changed content"), 0644), convey.ShouldBeNil)
+			}
+
+			j, err = openJournal(stateDir, log.NewNopLogger())
+			convey.So(err, convey.ShouldBeNil)
+			defer j.close()
+			convey.So(j.Done(tc.mode, local, tc.remote), convey.ShouldEqual, tc.expectDone)
+		})
+	}
+}
+
+func TestDefaultStateDir(t *testing.T) {
+	tests := []struct {
+		name        string
+		inputPaths  []string
+		outputPaths []string
+		expect      string
+	}{
+		{
+			name: "no FileDir",
+		},
+		{
+			name:        "next to inputs and outputs",
+			inputPaths:  []string{"/data/inputs/a.txt", "/data/inputs/sub/b.txt"},
+			outputPaths: []string{"/data/outputs/result"},
+			expect:      "/data/.tes-filer-state",
+		},
+		{
+			name:        "not in an output directory",
+			inputPaths:  []string{"/data/out/in/a.txt"},
+			outputPaths: []string{"/data/out"},
+			expect:      "/data/.tes-filer-state",
+		},
+		{
+			name:        "not matched by a wildcard output",
+			outputPaths: []string{"/data/out/*"},
+			expect:      "/data/.tes-filer-state",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			fileDirs := &domain.FileDirs{}
+			for _, path := range tc.inputPaths {
+				fileDirs.Inputs = append(fileDirs.Inputs, &domain.FileDir{Path: path})
+			}
+			for _, path := range tc.outputPaths {
+				fileDirs.Outputs = append(fileDirs.Outputs, &domain.FileDir{Path: path})
+			}
+			convey.So(defaultStateDir(fileDirs), convey.ShouldEqual, tc.expect)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	// register the mysql driver for the sql offload type
+	_ "github.com/go-sql-driver/mysql"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	utilspath "github.com/GBA-BI/tes-filer/pkg/utils/path"
+)
+
+const sqlDriverName = "mysql"
+
+var sqlIdentifierReg = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// offloadReader resolves the content referenced by task-inputs-ref and
+// task-outputs-ref, which is offloaded when the annotation is too large.
+type offloadReader interface {
+	Read(ctx context.Context, ref string) (string, error)
+}
+
+func newOffloadReader(cfg *Config) (offloadReader, error) {
+	switch cfg.OffloadType {
+	case consts.OffloadTypePVC:
+		return &pvcOffloadReader{}, nil
+	case consts.OffloadTypeSQL:
+		db, err := sql.Open(sqlDriverName, cfg.OffloadSQLDSN)
+		if err != nil {
+			return nil, apperror.NewInternalError(err)
+		}
+		return newSQLOffloadReader(db, cfg.OffloadSQLTable, cfg.OffloadSQLRefColumn, cfg.OffloadSQLContentColumn), nil
+	default:
+		return nil, apperror.NewInvalidArgumentError("Config.OffloadType", cfg.OffloadType)
+	}
+}
+
+type pvcOffloadReader struct{}
+
+func (p *pvcOffloadReader) Read(_ context.Context, ref string) (string, error) {
+	exist, err := utilspath.FileExists(ref)
+	if err != nil {
+		return "{}", apperror.NewInternalError(err)
+	}
+	if !exist {
+		return "{}", nil
+	}
+
+	content, err := os.ReadFile(ref)
+	if err != nil {
+		return "", apperror.NewInternalError(err)
+	}
+
+	return string(content), nil
+}
+
+type sqlOffloadReader struct {
+	db    *sql.DB
+	query string
+}
+
+// newSQLOffloadReader expects the identifiers to be validated by Config.Validate,
+// they can not be passed as query arguments.
+func newSQLOffloadReader(db *sql.DB, table, refColumn, contentColumn string) *sqlOffloadReader {
+	return &sqlOffloadReader{
+		db:    db,
+		query: fmt.Sprintf("SELECT `%s` FROM `%s` WHERE `%s` = ?", contentColumn, table, refColumn),
+	}
+}
+
+func (s *sqlOffloadReader) Read(ctx context.Context, ref string) (string, error) {
+	var content string
+	if err := s.db.QueryRowContext(ctx, s.query, ref).Scan(&content); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", apperror.NewNotFoundError("OffloadRef", ref)
+		}
+		return "", apperror.NewInternalError(fmt.Errorf("failed to query offload ref %s: %w", ref, err))
+	}
+	return content, nil
+}
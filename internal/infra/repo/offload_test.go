@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestSQLOffloadReader_Read(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       string
+		rows      *sqlmock.Rows
+		queryErr  error
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:      "successfully read offloaded content",
+			ref:       "task-1-inputs",
+			rows:      sqlmock.NewRows([]string{"content"}).AddRow(`{"inputs":[]}`),
+			expected:  `{"inputs":[]}`,
+			expectErr: false,
+		},
+		{
+			name:      "ref not found",
+			ref:       "task-2-inputs",
+			rows:      sqlmock.NewRows([]string{"content"}),
+			expectErr: true,
+		},
+		{
+			name:      "failed to query",
+			ref:       "task-3-inputs",
+			queryErr:  errors.New("connection refused"),
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			db, mock, err := sqlmock.New()
+			convey.So(err, convey.ShouldBeNil)
+			defer db.Close()
+
+			query := mock.ExpectQuery(regexp.QuoteMeta("SELECT `content` FROM `task_offload` WHERE `ref` = ?")).WithArgs(tc.ref)
+			if tc.queryErr != nil {
+				query.WillReturnError(tc.queryErr)
+			} else {
+				query.WillReturnRows(tc.rows)
+			}
+
+			reader := newSQLOffloadReader(db, "task_offload", "ref", "content")
+			content, err := reader.Read(context.Background(), tc.ref)
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(content, convey.ShouldEqual, tc.expected)
+			}
+			convey.So(mock.ExpectationsWereMet(), convey.ShouldBeNil)
+		})
+	}
+}
+
+func TestFilerRepo_readFileWithSQLOffload(t *testing.T) {
+	convey.Convey("read refs from sql offload", t, func() {
+		db, mock, err := sqlmock.New()
+		convey.So(err, convey.ShouldBeNil)
+		defer db.Close()
+
+		selectQuery := regexp.QuoteMeta("SELECT `content` FROM `task_offload` WHERE `ref` = ?")
+		mock.ExpectQuery(selectQuery).WithArgs("task-1-inputs").
+			WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow(`{"inputs":[{"url":"s3://bucket/a"}]}`))
+		mock.ExpectQuery(selectQuery).WithArgs("task-1-outputs").
+			WillReturnRows(sqlmock.NewRows([]string{"content"}).AddRow(`{"outputs":[{"url":"s3://bucket/b"}]}`))
+
+		annotationsPath := filepath.Join(t.TempDir(), "annotations")
+		err = os.WriteFile(annotationsPath, []byte("task-inputs-ref=\"task-1-inputs\"\ntask-outputs-ref=\"task-1-outputs\"\n"), 0644)
+		convey.So(err, convey.ShouldBeNil)
+
+		r := &filerRepo{offload: newSQLOffloadReader(db, "task_offload", "ref", "content")}
+		inputsStr, outputsStr, err := r.readFile(context.Background(), annotationsPath)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(inputsStr, convey.ShouldEqual, `{"inputs":[{"url":"s3://bucket/a"}]}`)
+		convey.So(outputsStr, convey.ShouldEqual, `{"outputs":[{"url":"s3://bucket/b"}]}`)
+		convey.So(mock.ExpectationsWereMet(), convey.ShouldBeNil)
+	})
+}
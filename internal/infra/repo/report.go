@@ -0,0 +1,137 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/GBA-BI/tes-filer/internal/domain"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
+)
+
+type reportCtxKey struct{}
+
+// report collects what happened to the FileDirs during one Transput.
+type report struct {
+	lock    sync.Mutex
+	skipped []skippedFileDir
+	failed  []*domain.FileDirError
+	records []*transput.Record
+}
+
+type skippedFileDir struct {
+	mode    consts.TransputMode
+	fileDir *domain.FileDir
+	reason  string
+}
+
+func withReport(ctx context.Context, rep *report) context.Context {
+	return context.WithValue(ctx, reportCtxKey{}, rep)
+}
+
+// reportFrom returns nil if no report in ctx, the methods of report are nil safe.
+func reportFrom(ctx context.Context) *report {
+	rep, _ := ctx.Value(reportCtxKey{}).(*report)
+	return rep
+}
+
+func (r *report) skip(mode consts.TransputMode, fileDir *domain.FileDir, reason string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.skipped = append(r.skipped, skippedFileDir{mode: mode, fileDir: fileDir, reason: reason})
+	rec := transput.NewRecord(mode, fileDir.Path, fileDir.URL, nil)
+	rec.Status = consts.ResultStatusSkipped
+	r.records = append(r.records, rec)
+}
+
+// Record implements transput.Recorder.
+func (r *report) Record(rec *transput.Record) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, rec)
+}
+
+// writeResult writes the records of all files as json to path.
+func (r *report) writeResult(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	content, err := json.MarshalIndent(&struct {
+		Files []*transput.Record `json:"files"`
+	}{Files: r.records}, "", "  ")
+	if err != nil {
+		return apperror.NewInternalError(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(consts.DefaultFileMode)); err != nil {
+		return apperror.NewInternalError(err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return apperror.NewInternalError(err)
+	}
+	return nil
+}
+
+// fail keeps err of a failed FileDir. It is also recorded if none of its
+// files is, e.g. the transput of it failed to create or its directory failed
+// to list.
+func (r *report) fail(err *domain.FileDirError) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failed = append(r.failed, err)
+	if !r.recordedLocked(err.Mode, err.Path) {
+		r.records = append(r.records, transput.NewRecord(err.Mode, err.Path, err.URL, err.Err))
+	}
+}
+
+// recordedLocked reports whether a file of the local path of mode, or under
+// it, failed with a record, the lock must be held.
+func (r *report) recordedLocked(mode consts.TransputMode, local string) bool {
+	for _, rec := range r.records {
+		recLocal := rec.Destination
+		if mode == consts.TransputModeOutputs {
+			recLocal = rec.Source
+		}
+		if rec.Mode == mode && rec.Status == consts.ResultStatusFailed &&
+			(recLocal == local || strings.HasPrefix(recLocal, strings.TrimSuffix(local, "/")+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *report) log(logger log.Logger) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.skipped) > 0 {
+		items := make([]string, 0, len(r.skipped))
+		for _, item := range r.skipped {
+			items = append(items, fmt.Sprintf("%s %s (%s): %s", item.mode, item.fileDir.Name, item.fileDir.Path, item.reason))
+		}
+		logger.Warnf("skipped %d inputs/outputs: %s", len(r.skipped), strings.Join(items, "; "))
+	}
+	if len(r.failed) > 0 {
+		items := make([]string, 0, len(r.failed))
+		for _, err := range r.failed {
+			items = append(items, err.Error())
+		}
+		logger.Errorf("failed %d inputs/outputs:\n%s", len(r.failed), strings.Join(items, "\n"))
+	}
+}
@@ -20,17 +20,24 @@ type MD5Checker struct {
 }
 
 func (m *MD5Checker) Check(path string) (bool, error) {
+	md5sum, err := Sum(path)
+	if err != nil {
+		return false, err
+	}
+	return md5sum == m.checksum, nil
+}
+
+// Sum returns the hex md5 of the file.
+func Sum(path string) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return false, fmt.Errorf("failed to open file %s %w", path, err)
+		return "", fmt.Errorf("failed to open file %s %w", path, err)
 	}
 	defer file.Close()
 
 	hash := md5.New()
 	if _, err := io.Copy(hash, file); err != nil {
-		return false, fmt.Errorf("failed to build hash %w", err)
+		return "", fmt.Errorf("failed to build hash %w", err)
 	}
-
-	md5sum := fmt.Sprintf("%x", hash.Sum(nil))
-	return md5sum == m.checksum, nil
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
@@ -31,8 +31,51 @@ const (
 	OffloadTypeSQL string = "sql"
 )
 
+// policies when a wildcard output path matches nothing
+const (
+	GlobNoMatchWarn  string = "warn"
+	GlobNoMatchError string = "error"
+)
+
+// policies of the symlinks in uploaded directories
+const (
+	SymlinkPolicyFollow   string = "follow"
+	SymlinkPolicySkip     string = "skip"
+	SymlinkPolicyPreserve string = "preserve"
+	SymlinkPolicyFail     string = "fail"
+)
+
+// MetaSymlinkTarget is the metadata key of the object keeping a symlink.
+const MetaSymlinkTarget = "symlink-target"
+
+// metadata keys recording the mode and mtime of uploaded files, named as by
+// s3fs and goofys
+const (
+	MetaMode  = "mode"
+	MetaMtime = "mtime"
+)
+
+// status of the transferred files in the result file
+const (
+	ResultStatusSucceeded string = "succeeded"
+	ResultStatusFailed    string = "failed"
+	ResultStatusSkipped   string = "skipped"
+)
+
 const DefaultFileMode = 0777
 
+// DefaultContentFileMode is the mode of input files written from literal content,
+// they are often scripts to be executed.
+const DefaultContentFileMode = 0755
+
+// TempFileSuffix is the suffix of the temp files downloads are written to
+// before renamed into place.
+const TempFileSuffix = ".filer-tmp"
+
+// DefaultStateDirName is the hidden directory keeping the journal and the
+// checkpoints when no state dir is configured.
+const DefaultStateDirName = ".tes-filer-state"
+
 const S3Prefix = "s3://"
 
 const (
@@ -54,4 +97,12 @@ const (
 const (
 	DefaultRetryCount = 5
 	DefaultPartSize   = 64 * 1024 * 1024 // 64MiB
+	// DefaultTaskNum is the number of parts of a file transferred at the same time
+	DefaultTaskNum = 5
+)
+
+// the limits of a multipart upload, shared by s3 and tos
+const (
+	MaxPartNum  = 10000
+	MaxPartSize = 5 * 1024 * 1024 * 1024 // 5GiB
 )
@@ -3,6 +3,7 @@ package error
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 type Error struct {
@@ -22,6 +23,13 @@ func (e *Error) Is(target error) bool {
 	return errors.Is(e.Inner, target)
 }
 
+func (e *Error) Unwrap() error {
+	if e == nil {
+		return nil
+	}
+	return e.Inner
+}
+
 type ErrorCode int
 
 const (
@@ -29,9 +37,61 @@ const (
 	ErrInvalidArgument
 	ErrNotFound
 	ErrPermissionDenied
+	ErrRequiredOutputMissing
+	ErrRateLimited
+	ErrNetwork
+	ErrDiskFull
+	ErrCancelled
 	// Add more error codes here...
 )
 
+// exit codes of the filer process, see the table in README.md. The categories
+// start at 10, away from 2 of a Go panic and the other codes of the runtime.
+const (
+	ExitOK      = 0
+	ExitUnknown = 1
+)
+
+const (
+	ExitInvalidArgument = iota + 10
+	ExitNotFound
+	ExitPermissionDenied
+	ExitRateLimited
+	ExitNetwork
+	ExitDiskFull
+	ExitCancelled
+	// ExitRequiredOutputMissing is apart from ExitNotFound, so that a task
+	// producing no output is not taken for an input gone.
+	ExitRequiredOutputMissing
+)
+
+var exitCodes = map[ErrorCode]int{
+	ErrUnknown:               ExitUnknown,
+	ErrInvalidArgument:       ExitInvalidArgument,
+	ErrNotFound:              ExitNotFound,
+	ErrRequiredOutputMissing: ExitRequiredOutputMissing,
+	ErrPermissionDenied:      ExitPermissionDenied,
+	ErrRateLimited:           ExitRateLimited,
+	ErrNetwork:               ExitNetwork,
+	ErrDiskFull:              ExitDiskFull,
+	ErrCancelled:             ExitCancelled,
+}
+
+// ExitCode returns the exit code of the process failed by err.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var code ErrorCode
+	if _, scanErr := fmt.Sscanf(CodeOf(err), "%d", &code); scanErr != nil {
+		return ExitUnknown
+	}
+	if exitCode, ok := exitCodes[code]; ok {
+		return exitCode
+	}
+	return ExitUnknown
+}
+
 func wrapError(code ErrorCode, msg string, err error) *Error {
 	if err == nil {
 		return nil
@@ -43,6 +103,69 @@ func wrapError(code ErrorCode, msg string, err error) *Error {
 	}
 }
 
+// NewMultiError aggregates the errors of items which are all attempted, its
+// code is the one shared by all items, or ErrUnknown if they differ.
+func NewMultiError(errs []error) *Error {
+	if len(errs) == 0 {
+		return nil
+	}
+	code := CodeOf(errs[0])
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		if CodeOf(err) != code {
+			code = fmt.Sprintf("%d", ErrUnknown)
+		}
+		msgs = append(msgs, err.Error())
+	}
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf("%d errors occurred: %s", len(errs), strings.Join(msgs, "; ")),
+		Inner:   errors.Join(errs...),
+	}
+}
+
+// CodeOf returns the first code other than ErrUnknown in the chain of err,
+// so that an internal error wrapping a classified one keeps its code. The
+// errors aggregated by errors.Join are not looked into, NewMultiError has
+// already decided the code of them.
+func CodeOf(err error) string {
+	unknown := fmt.Sprintf("%d", ErrUnknown)
+	for err != nil {
+		if appErr, ok := err.(*Error); ok && appErr.Code != unknown {
+			return appErr.Code
+		}
+		err = errors.Unwrap(err)
+	}
+	return unknown
+}
+
+// HasCode reports whether err is classified, i.e. has a code other than ErrUnknown.
+func HasCode(err error) bool {
+	return CodeOf(err) != fmt.Sprintf("%d", ErrUnknown)
+}
+
+// Wrap classifies err with code, it returns nil if err is nil.
+func Wrap(code ErrorCode, err error) *Error {
+	switch code {
+	case ErrInvalidArgument:
+		return wrapError(code, "invalid argument", err)
+	case ErrNotFound:
+		return wrapError(code, "object not found", err)
+	case ErrPermissionDenied:
+		return wrapError(code, "no permission to do", err)
+	case ErrRateLimited:
+		return wrapError(code, "rate limited", err)
+	case ErrNetwork:
+		return wrapError(code, "network error", err)
+	case ErrDiskFull:
+		return wrapError(code, "no space left", err)
+	case ErrCancelled:
+		return wrapError(code, "cancelled", err)
+	default:
+		return wrapError(ErrUnknown, "server internal error", err)
+	}
+}
+
 // NewInvalidArgumentError ...
 func NewInvalidArgumentError(param, content string) *Error {
 	return wrapError(ErrInvalidArgument, "invalid argument", fmt.Errorf("%s %s is invalid", param, content))
@@ -58,6 +181,11 @@ func NewInternalError(err error) *Error {
 	return wrapError(ErrUnknown, "server internal error", err)
 }
 
+// NewRequiredOutputMissingError ...
+func NewRequiredOutputMissingError(path string) *Error {
+	return wrapError(ErrRequiredOutputMissing, "required output missing", fmt.Errorf("output %s not exist", path))
+}
+
 // NewPermissionDeniedError ...
 func NewPermissionDeniedError(param, content string) *Error {
 	return wrapError(ErrPermissionDenied, "no permission to do", fmt.Errorf("%s %s not permission", param, content))
@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff is the wait before retrying a throttled transfer, Base for the first
+// retry and doubled by each other one up to Max, so that a throttling server
+// is not hit again right away while the halved bandwidth settles.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// ThrottleBackoff returns the backoff of the transfers throttled by their
+// server, which waits at most the interval between two speed downs.
+func ThrottleBackoff() Backoff {
+	return Backoff{Base: time.Second, Max: speedDownInterval}
+}
+
+// Wait waits the backoff of the transfer retried retries times already, or
+// until ctx is done.
+func (b Backoff) Wait(ctx context.Context, retries int) error {
+	delay := b.Base
+	for i := 0; i < retries && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
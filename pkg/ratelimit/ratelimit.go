@@ -0,0 +1,272 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+const (
+	// throttles within the interval after a speed down are caused by the same
+	// bandwidth, so they do not speed down again
+	speedDownInterval = 10 * time.Second
+	// the bandwidth is doubled back after the interval without throttle
+	speedUpInterval = 5 * time.Minute
+)
+
+// Limiter limits the bandwidth of transfers in bytes per second. It backs off
+// as the rate limiter of tos does: the bandwidth is halved when the server
+// throttles, and doubled back up to the max after a stable period.
+//
+// The transfers through a limiter are limited by its parent as well, so that
+// many limiters share the budget of their parent. A Limiter is safe for
+// concurrent use, and all methods accept a nil Limiter, which does not limit.
+type Limiter struct {
+	parent *Limiter
+
+	// maxBandwidth and bandwidth are 0 if no limit
+	maxBandwidth int64
+	bandwidth    int64
+	limiter      *rate.Limiter
+
+	lastSpeedDownTime   time.Time
+	lastSpeedChangeTime time.Time
+	lock                sync.Mutex
+}
+
+// NewLimiter returns a limiter of maxBandwidth, 0 is no limit, within parent
+// if not nil.
+func NewLimiter(maxBandwidth int64, parent *Limiter) *Limiter {
+	if maxBandwidth < 0 {
+		maxBandwidth = 0
+	}
+	// full at the beginning
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if maxBandwidth > 0 {
+		limiter = rate.NewLimiter(rate.Limit(maxBandwidth), int(maxBandwidth))
+	}
+	return &Limiter{
+		parent:       parent,
+		maxBandwidth: maxBandwidth,
+		bandwidth:    maxBandwidth,
+		limiter:      limiter,
+	}
+}
+
+// Bandwidth returns the current bandwidth of l, 0 if no limit.
+func (l *Limiter) Bandwidth() int64 {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.bandwidth
+}
+
+// SpeedDown halves the bandwidth of l on the throttling of the server. It
+// reports whether the throttled transfer should be retried, which is not the
+// case if the bandwidth is already the minimum.
+func (l *Limiter) SpeedDown() bool {
+	if l == nil {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// consider as multi events at the same speed, so no speed down
+	if !l.lastSpeedDownTime.IsZero() && time.Since(l.lastSpeedDownTime) < speedDownInterval {
+		return true
+	}
+	bandwidth := l.bandwidth
+	if bandwidth == 0 {
+		bandwidth = consts.DefaultMaxBandwidth
+	}
+	if bandwidth <= consts.DefaultMinBandwidth {
+		return false
+	}
+	bandwidth /= 2
+	if bandwidth < consts.DefaultMinBandwidth {
+		bandwidth = consts.DefaultMinBandwidth
+	}
+	now := time.Now()
+	l.lastSpeedDownTime = now
+	l.lastSpeedChangeTime = now
+	l.setBandwidth(bandwidth)
+	return true
+}
+
+// speedUp doubles the bandwidth if there is no throttle for a while, up to the
+// max, or to no limit if there is no max.
+func (l *Limiter) speedUp() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.bandwidth == 0 || l.bandwidth == l.maxBandwidth || time.Since(l.lastSpeedChangeTime) < speedUpInterval {
+		return
+	}
+	bandwidth := 2 * l.bandwidth
+	if l.maxBandwidth == 0 && bandwidth > consts.DefaultMaxBandwidth {
+		bandwidth = 0
+	}
+	if l.maxBandwidth > 0 && bandwidth > l.maxBandwidth {
+		bandwidth = l.maxBandwidth
+	}
+	l.lastSpeedChangeTime = time.Now()
+	l.setBandwidth(bandwidth)
+}
+
+// setBandwidth sets the limit of the rate limiter, the burst is the bandwidth
+// of a second. It is called with the lock held.
+func (l *Limiter) setBandwidth(bandwidth int64) {
+	l.bandwidth = bandwidth
+	if bandwidth == 0 {
+		l.limiter.SetLimit(rate.Inf)
+		return
+	}
+	l.limiter.SetLimit(rate.Limit(bandwidth))
+	l.limiter.SetBurst(int(bandwidth))
+}
+
+// WaitN blocks until n bytes are allowed by l and its ancestors, or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	for cur := l; cur != nil; cur = cur.parent {
+		cur.speedUp()
+		if cur.Bandwidth() == 0 {
+			continue
+		}
+		for remaining := n; remaining > 0; {
+			// WaitN fails if more than the burst is asked for
+			chunk := remaining
+			if burst := cur.limiter.Burst(); chunk > burst {
+				chunk = burst
+			}
+			if err := cur.limiter.WaitN(ctx, chunk); err != nil {
+				// the burst may be shrunk by a speed down meanwhile
+				if ctx.Err() == nil && chunk > cur.limiter.Burst() {
+					continue
+				}
+				return err
+			}
+			remaining -= chunk
+		}
+	}
+	return nil
+}
+
+// Acquire implements the RateLimiter of the tos sdk, which sleeps timeToWait
+// and acquires again if not ok.
+func (l *Limiter) Acquire(want int64) (ok bool, timeToWait time.Duration) {
+	now := time.Now()
+	var reservations []*rate.Reservation
+	for cur := l; cur != nil; cur = cur.parent {
+		cur.speedUp()
+		if cur.Bandwidth() == 0 {
+			continue
+		}
+		n := want
+		if burst := int64(cur.limiter.Burst()); n > burst {
+			n = burst
+		}
+		r := cur.limiter.ReserveN(now, int(n))
+		reservations = append(reservations, r)
+		if delay := r.DelayFrom(now); delay > timeToWait {
+			timeToWait = delay
+		}
+	}
+	if timeToWait == 0 {
+		return true, 0
+	}
+	// nothing is taken if any ancestor is not ready
+	for _, r := range reservations {
+		r.CancelAt(now)
+	}
+	return false, timeToWait
+}
+
+// Reader returns a reader of r whose reads wait for the bandwidth of l.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, reader: r, limiter: l}
+}
+
+// ReadCloser is Reader closing rc.
+func (l *Limiter) ReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return &readCloser{Reader: l.Reader(ctx, rc), Closer: rc}
+}
+
+type reader struct {
+	// ctx of the transfer, waiting for the limiter stops once it is done
+	ctx     context.Context
+	reader  io.Reader
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil {
+			return 0, waitErr
+		}
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Limits are the upload and download budgets of transfers.
+type Limits struct {
+	upload   *Limiter
+	download *Limiter
+}
+
+// NewLimits returns the budgets limiting the uploads to upload, the downloads
+// to download and both of them together to total, 0 is no limit.
+func NewLimits(upload, download, total int64) *Limits {
+	var parent *Limiter
+	if total > 0 {
+		parent = NewLimiter(total, nil)
+	}
+	return &Limits{
+		upload:   NewLimiter(upload, parent),
+		download: NewLimiter(download, parent),
+	}
+}
+
+// Child returns the budgets of a transput within l, limited to maxBandwidth
+// in each direction, 0 is no limit. It backs off on its own, so that the
+// throttling of a server does not slow down the transfers of other servers.
+func (l *Limits) Child(maxBandwidth int64) *Limits {
+	return &Limits{
+		upload:   NewLimiter(maxBandwidth, l.Upload()),
+		download: NewLimiter(maxBandwidth, l.Download()),
+	}
+}
+
+// Upload returns the limiter of uploads, nil if l is nil.
+func (l *Limits) Upload() *Limiter {
+	if l == nil {
+		return nil
+	}
+	return l.upload
+}
+
+// Download returns the limiter of downloads, nil if l is nil.
+func (l *Limits) Download() *Limiter {
+	if l == nil {
+		return nil
+	}
+	return l.download
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+	"golang.org/x/time/rate"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+func TestLimiter_backoff(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxBandwidth int64
+		expected     []int64
+	}{
+		{
+			name:         "back to the max",
+			maxBandwidth: 8 * consts.DefaultMinBandwidth,
+			// down, up, up again at the max
+			expected: []int64{4 * consts.DefaultMinBandwidth, 8 * consts.DefaultMinBandwidth, 8 * consts.DefaultMinBandwidth},
+		},
+		{
+			name:         "back to no limit",
+			maxBandwidth: 0,
+			expected:     []int64{consts.DefaultMaxBandwidth / 2, consts.DefaultMaxBandwidth, 0},
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			l := NewLimiter(tc.maxBandwidth, nil)
+			convey.So(l.SpeedDown(), convey.ShouldBeTrue)
+			convey.So(l.Bandwidth(), convey.ShouldEqual, tc.expected[0])
+			convey.So(l.limiter.Limit(), convey.ShouldEqual, rate.Limit(tc.expected[0]))
+
+			// throttled again by the same bandwidth
+			convey.So(l.SpeedDown(), convey.ShouldBeTrue)
+			convey.So(l.Bandwidth(), convey.ShouldEqual, tc.expected[0])
+
+			// not stable for long enough
+			l.speedUp()
+			convey.So(l.Bandwidth(), convey.ShouldEqual, tc.expected[0])
+
+			for _, expected := range tc.expected[1:] {
+				l.lastSpeedChangeTime = time.Now().Add(-speedUpInterval)
+				l.speedUp()
+				convey.So(l.Bandwidth(), convey.ShouldEqual, expected)
+			}
+		})
+	}
+}
+
+func TestLimiter_SpeedDown_minimum(t *testing.T) {
+	convey.Convey("no retry at the minimum bandwidth", t, func() {
+		l := NewLimiter(consts.DefaultMinBandwidth, nil)
+		convey.So(l.SpeedDown(), convey.ShouldBeFalse)
+		convey.So(l.Bandwidth(), convey.ShouldEqual, consts.DefaultMinBandwidth)
+	})
+}
+
+func TestLimits_shared(t *testing.T) {
+	convey.Convey("the children share the total budget", t, func() {
+		limits := NewLimits(0, 0, 1000)
+		first := limits.Child(0)
+		second := limits.Child(0)
+
+		ok, _ := first.Upload().Acquire(600)
+		convey.So(ok, convey.ShouldBeTrue)
+		ok, wait := second.Download().Acquire(600)
+		convey.So(ok, convey.ShouldBeFalse)
+		convey.So(wait, convey.ShouldBeGreaterThan, 0)
+
+		// the budget of a child does not slow down the others
+		convey.So(first.Upload().SpeedDown(), convey.ShouldBeTrue)
+		convey.So(first.Upload().Bandwidth(), convey.ShouldEqual, consts.DefaultMaxBandwidth/2)
+		convey.So(second.Upload().Bandwidth(), convey.ShouldEqual, 0)
+		convey.So(limits.Upload().Bandwidth(), convey.ShouldEqual, 0)
+	})
+}
+
+func TestLimiter_Reader(t *testing.T) {
+	convey.Convey("read within the bandwidth", t, func() {
+		l := NewLimits(1000, 0, 0).Upload()
+		content, err := io.ReadAll(l.Reader(context.Background(), strings.NewReader("hello")))
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(string(content), convey.ShouldEqual, "hello")
+	})
+
+	convey.Convey("stop waiting once ctx is cancelled", t, func() {
+		l := NewLimiter(1, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := io.ReadAll(l.Reader(ctx, strings.NewReader("hello")))
+		convey.So(errors.Is(err, context.Canceled), convey.ShouldBeTrue)
+	})
+
+	convey.Convey("nil limiter does not limit", t, func() {
+		var limits *Limits
+		r := strings.NewReader("hello")
+		convey.So(limits.Download().Reader(context.Background(), r), convey.ShouldEqual, r)
+		ok, wait := limits.Upload().Acquire(1 << 40)
+		convey.So(ok, convey.ShouldBeTrue)
+		convey.So(wait, convey.ShouldEqual, 0)
+		convey.So(limits.Upload().SpeedDown(), convey.ShouldBeFalse)
+	})
+}
@@ -0,0 +1,132 @@
+package transput
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/GBA-BI/tes-filer/pkg/checker"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+// TempPath returns the sibling temp file a download of local is written to,
+// it is hidden and stays on the same filesystem so the rename is atomic.
+func TempPath(local string) string {
+	return filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+consts.TempFileSuffix)
+}
+
+// AtomicFile is a download in progress, the content is written to the temp
+// file of the final path and only renamed into place by Commit.
+type AtomicFile struct {
+	*os.File
+
+	local string
+	attrs *LocalAttrs
+	meta  map[string]string
+	// mode replaces the one recorded in meta and the file mode of attrs if not 0
+	mode os.FileMode
+	done bool
+}
+
+// CreateAtomic creates the temp file of local, truncating the leftover of a
+// previous failed attempt. The attrs of ctx are applied by Commit.
+func CreateAtomic(ctx context.Context, local string) (*AtomicFile, error) {
+	if err := MkdirAll(ctx, filepath.Dir(local)); err != nil {
+		return nil, fmt.Errorf("failed to mkdir: %w", err)
+	}
+	file, err := os.OpenFile(TempPath(local), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+	return &AtomicFile{File: file, local: local, attrs: localAttrsFrom(ctx)}, nil
+}
+
+// OpenAtomic opens the temp file of local keeping the content written by a
+// previous attempt, for the downloads resuming their parts. The temp file is
+// created if missing.
+func OpenAtomic(ctx context.Context, local string) (*AtomicFile, error) {
+	if err := MkdirAll(ctx, filepath.Dir(local)); err != nil {
+		return nil, fmt.Errorf("failed to mkdir: %w", err)
+	}
+	file, err := os.OpenFile(TempPath(local), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return &AtomicFile{File: file, local: local, attrs: localAttrsFrom(ctx)}, nil
+}
+
+// SetMeta keeps the object metadata of the download, the mode and mtime
+// recorded in it are restored by Commit.
+func (f *AtomicFile) SetMeta(meta map[string]string) {
+	f.meta = meta
+}
+
+// SetMode sets the mode of the file restored by Commit, in place of the one
+// recorded in the metadata or the file mode of ctx, e.g. for the inputs of
+// literal content.
+func (f *AtomicFile) SetMode(mode os.FileMode) {
+	f.mode = mode
+}
+
+// Commit verifies the size of the temp file if expectedSize is not negative and
+// its checksum if checker is not nil, then syncs, sets its attrs and renames it
+// to the final path.
+// The temp file is removed if anything fails.
+func (f *AtomicFile) Commit(expectedSize int64, checker checker.Checker) error {
+	if err := f.commit(expectedSize, checker); err != nil {
+		f.Abort()
+		return err
+	}
+	return nil
+}
+
+func (f *AtomicFile) commit(expectedSize int64, checker checker.Checker) error {
+	if expectedSize >= 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat download file: %w", err)
+		}
+		if info.Size() != expectedSize {
+			return fmt.Errorf("file size not match, expected %d, got %d", expectedSize, info.Size())
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync download file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close download file: %w", err)
+	}
+	if checker != nil {
+		check, err := checker.Check(f.Name())
+		if err != nil {
+			return fmt.Errorf("checker error: %w", err)
+		}
+		if !check {
+			return fmt.Errorf("checksum not match")
+		}
+	}
+	if f.mode != 0 {
+		if err := f.attrs.setMode(f.Name(), f.mode); err != nil {
+			return err
+		}
+	} else if err := setLocalAttrs(f.attrs, f.Name(), f.meta); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), f.local); err != nil {
+		return fmt.Errorf("failed to rename download file: %w", err)
+	}
+	f.done = true
+	return nil
+}
+
+// Abort closes and removes the temp file, it is a no-op after a successful Commit
+// so it can be deferred.
+func (f *AtomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
@@ -0,0 +1,86 @@
+package transput
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/checker"
+	"github.com/GBA-BI/tes-filer/pkg/checker/md5"
+)
+
+func TestAtomicFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		expectedSize int64
+		withChecker  bool
+		expectErr    bool
+	}{
+		{
+			name:         "size and checksum match",
+			content:      "Hello, world!",
+			expectedSize: 13,
+			withChecker:  true,
+		},
+		{
+			name:         "size not checked",
+			content:      "Hello, world!",
+			expectedSize: -1,
+		},
+		{
+			name:         "short file",
+			content:      "Hello",
+			expectedSize: 13,
+			expectErr:    true,
+		},
+		{
+			name:         "checksum not match",
+			content:      "Hello, World!",
+			expectedSize: 13,
+			withChecker:  true,
+			expectErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			local := filepath.Join(t.TempDir(), "sub", "local")
+			// stale content of a previous download
+			convey.So(os.MkdirAll(filepath.Dir(local), 0755), convey.ShouldBeNil)
+			convey.So(os.WriteFile(local, []byte("stale content of a previous download"), 0644), convey.ShouldBeNil)
+			convey.So(os.WriteFile(TempPath(local), []byte("leftover of a failed attempt"), 0644), convey.ShouldBeNil)
+
+			file, err := CreateAtomic(context.Background(), local)
+			convey.So(err, convey.ShouldBeNil)
+			defer file.Abort()
+			_, err = file.WriteString(tc.content)
+			convey.So(err, convey.ShouldBeNil)
+
+			var c checker.Checker
+			if tc.withChecker {
+				c = md5.NewMD5Checker("6cd3556deb0da54bca060b4c39479839")
+			}
+			err = file.Commit(tc.expectedSize, c)
+
+			content, readErr := os.ReadFile(local)
+			convey.So(readErr, convey.ShouldBeNil)
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(string(content), convey.ShouldEqual, "stale content of a previous download")
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(string(content), convey.ShouldEqual, tc.content)
+				// like os.Create, the downloads are not executable without a recorded mode
+				info, err := os.Stat(local)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(info.Mode().Perm()&0111, convey.ShouldEqual, 0)
+			}
+			_, statErr := os.Stat(TempPath(local))
+			convey.So(os.IsNotExist(statErr), convey.ShouldBeTrue)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package transput
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+// modeTypeRegular is the S_IFREG type bits recorded with the permission, as
+// s3fs and goofys do, so that the objects keep their mode through the mounts.
+const modeTypeRegular = 0100000
+
+// LocalAttrs are the attributes of the local files and directories created by
+// the downloads. The zero modes keep the default ones masked by umask.
+type LocalAttrs struct {
+	// FileMode is the permission of the downloaded files whose remote records
+	// no mode.
+	FileMode os.FileMode
+	// DirMode is the permission of the created directories.
+	DirMode os.FileMode
+	// Owner is the owner of the created files and directories, nil keeps the
+	// user running the filer.
+	Owner *Owner
+	// ReadOnly clears the write bits of the downloaded files, the directories
+	// stay writable.
+	ReadOnly bool
+}
+
+// Owner is the uid and gid to chown to, negative ones are not changed.
+type Owner struct {
+	UID int
+	GID int
+}
+
+type localAttrsCtxKey struct{}
+
+// WithLocalAttrs returns a copy of ctx in which the downloads create local
+// files and directories with attrs.
+func WithLocalAttrs(ctx context.Context, attrs *LocalAttrs) context.Context {
+	return context.WithValue(ctx, localAttrsCtxKey{}, attrs)
+}
+
+func localAttrsFrom(ctx context.Context) *LocalAttrs {
+	attrs, _ := ctx.Value(localAttrsCtxKey{}).(*LocalAttrs)
+	if attrs == nil {
+		return &LocalAttrs{}
+	}
+	return attrs
+}
+
+// MkdirAll creates dir and its missing parents, the created ones get the
+// directory mode and owner of ctx.
+func MkdirAll(ctx context.Context, dir string) error {
+	attrs := localAttrsFrom(ctx)
+	var created []string
+	if attrs.DirMode != 0 || attrs.Owner != nil {
+		for missing := filepath.Clean(dir); ; missing = filepath.Dir(missing) {
+			if _, err := os.Lstat(missing); !errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			created = append(created, missing)
+			if missing == filepath.Dir(missing) {
+				break
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, os.FileMode(consts.DefaultFileMode)); err != nil {
+		return err
+	}
+	// chmod since the mode of mkdir is masked by umask
+	for _, d := range created {
+		if attrs.DirMode != 0 {
+			if err := os.Chmod(d, attrs.DirMode); err != nil {
+				return err
+			}
+		}
+		if err := attrs.chown(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileMeta returns the object metadata recording the mode and mtime of the
+// local file of info, the mode in decimal with its type bits and the mtime in
+// unix seconds like s3fs.
+func FileMeta(info os.FileInfo) map[string]string {
+	return map[string]string{
+		consts.MetaMode:  strconv.FormatUint(uint64(modeTypeRegular|info.Mode().Perm()), 10),
+		consts.MetaMtime: strconv.FormatInt(info.ModTime().Unix(), 10),
+	}
+}
+
+// parseFileMeta returns the permission and mtime recorded in the object
+// metadata, zero if absent or invalid. The keys are case-insensitive as the
+// SDKs canonicalize them differently.
+func parseFileMeta(meta map[string]string) (os.FileMode, time.Time) {
+	var mode os.FileMode
+	var mtime time.Time
+	for key, value := range meta {
+		switch strings.ToLower(key) {
+		case consts.MetaMode:
+			if num, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32); err == nil {
+				// setuid and the like are never restored
+				mode = os.FileMode(num).Perm()
+			}
+		case consts.MetaMtime:
+			// some tools record the fraction of seconds
+			if sec, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && sec > 0 {
+				whole, frac := math.Modf(sec)
+				mtime = time.Unix(int64(whole), int64(frac*1e9))
+			}
+		}
+	}
+	return mode, mtime
+}
+
+// SetLocalAttrs sets the mode and mtime of the downloaded file of path to the
+// ones recorded in meta, or its mode to the file mode of ctx if meta has none,
+// and its owner to the one of ctx.
+func SetLocalAttrs(ctx context.Context, path string, meta map[string]string) error {
+	return setLocalAttrs(localAttrsFrom(ctx), path, meta)
+}
+
+func setLocalAttrs(attrs *LocalAttrs, path string, meta map[string]string) error {
+	mode, mtime := parseFileMeta(meta)
+	if mode == 0 {
+		mode = attrs.FileMode
+	}
+	if err := attrs.setMode(path, mode); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return fmt.Errorf("failed to set mtime of download file: %w", err)
+		}
+	}
+	return nil
+}
+
+// setMode sets the mode of the file of path, 0 keeps the current one, then
+// applies ReadOnly and Owner.
+func (a *LocalAttrs) setMode(path string, mode os.FileMode) error {
+	if a.ReadOnly {
+		if mode == 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("failed to stat download file: %w", err)
+			}
+			mode = info.Mode().Perm()
+		}
+		mode &^= 0222
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed to chmod download file: %w", err)
+		}
+	}
+	return a.chown(path)
+}
+
+// chown changes the owner of path, not following the symlink.
+func (a *LocalAttrs) chown(path string) error {
+	if a.Owner == nil {
+		return nil
+	}
+	if err := os.Lchown(path, a.Owner.UID, a.Owner.GID); err != nil {
+		return fmt.Errorf("failed to chown: %w", err)
+	}
+	return nil
+}
+
+// Lchown changes the owner of the symlink of path created by the filer to the
+// one of ctx.
+func Lchown(ctx context.Context, path string) error {
+	return localAttrsFrom(ctx).chown(path)
+}
@@ -0,0 +1,128 @@
+package transput
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+func TestFileMeta(t *testing.T) {
+	convey.Convey("round trip", t, func() {
+		local := filepath.Join(t.TempDir(), "script.sh")
+		convey.So(os.WriteFile(local, []byte("#!/bin/sh"), 0644), convey.ShouldBeNil)
+		convey.So(os.Chmod(local, 0750), convey.ShouldBeNil)
+		mtime := time.Unix(1700000000, 0)
+		convey.So(os.Chtimes(local, mtime, mtime), convey.ShouldBeNil)
+		info, err := os.Stat(local)
+		convey.So(err, convey.ShouldBeNil)
+
+		meta := FileMeta(info)
+		convey.So(meta, convey.ShouldResemble, map[string]string{
+			consts.MetaMode:  "33256",
+			consts.MetaMtime: "1700000000",
+		})
+		mode, parsed := parseFileMeta(map[string]string{"Mode": meta[consts.MetaMode], "Mtime": meta[consts.MetaMtime]})
+		convey.So(mode, convey.ShouldEqual, os.FileMode(0750))
+		convey.So(parsed.Equal(mtime), convey.ShouldBeTrue)
+	})
+}
+
+func TestSetLocalAttrs(t *testing.T) {
+	tests := []struct {
+		name        string
+		attrs       *LocalAttrs
+		meta        map[string]string
+		expectMode  os.FileMode
+		expectMtime time.Time
+	}{
+		{
+			name:       "recorded mode wins over the default",
+			attrs:      &LocalAttrs{FileMode: 0600},
+			meta:       map[string]string{"mode": "33261", "mtime": "1700000000.5"},
+			expectMode: 0755,
+			// the fraction of seconds recorded by other tools
+			expectMtime: time.Unix(1700000000, 5e8),
+		},
+		{
+			name:       "setuid is never restored",
+			meta:       map[string]string{"mode": "35309"},
+			expectMode: 0755,
+		},
+		{
+			name:       "default mode",
+			attrs:      &LocalAttrs{FileMode: 0640},
+			meta:       map[string]string{"mode": "invalid"},
+			expectMode: 0640,
+		},
+		{
+			name:       "read-only with the recorded mode",
+			attrs:      &LocalAttrs{ReadOnly: true},
+			meta:       map[string]string{"mode": "33261"},
+			expectMode: 0555,
+		},
+		{
+			name:       "read-only keeping the mode",
+			attrs:      &LocalAttrs{ReadOnly: true},
+			expectMode: 0404,
+		},
+		{
+			name:       "chown",
+			attrs:      &LocalAttrs{Owner: &Owner{UID: os.Getuid(), GID: -1}},
+			expectMode: 0604,
+		},
+		{
+			name:       "unchanged",
+			expectMode: 0604,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			local := filepath.Join(t.TempDir(), "local")
+			convey.So(os.WriteFile(local, nil, 0644), convey.ShouldBeNil)
+			convey.So(os.Chmod(local, 0604), convey.ShouldBeNil)
+			ctx := context.Background()
+			if tc.attrs != nil {
+				ctx = WithLocalAttrs(ctx, tc.attrs)
+			}
+			convey.So(SetLocalAttrs(ctx, local, tc.meta), convey.ShouldBeNil)
+			info, err := os.Stat(local)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Mode().Perm(), convey.ShouldEqual, tc.expectMode)
+			convey.So(int(info.Sys().(*syscall.Stat_t).Uid), convey.ShouldEqual, os.Getuid())
+			if !tc.expectMtime.IsZero() {
+				convey.So(info.ModTime().Equal(tc.expectMtime), convey.ShouldBeTrue)
+			}
+		})
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	convey.Convey("only the created directories get the mode", t, func() {
+		oldMask := syscall.Umask(022)
+		defer syscall.Umask(oldMask)
+		base := t.TempDir()
+		convey.So(os.Chmod(base, 0700), convey.ShouldBeNil)
+		owner := &Owner{UID: os.Getuid(), GID: os.Getgid()}
+		ctx := WithLocalAttrs(context.Background(), &LocalAttrs{DirMode: 0775, Owner: owner})
+		convey.So(MkdirAll(ctx, filepath.Join(base, "a", "b")), convey.ShouldBeNil)
+
+		for path, mode := range map[string]os.FileMode{
+			base:                          0700,
+			filepath.Join(base, "a"):      0775,
+			filepath.Join(base, "a", "b"): 0775,
+		} {
+			info, err := os.Stat(path)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(info.Mode().Perm(), convey.ShouldEqual, mode)
+			convey.So(int(info.Sys().(*syscall.Stat_t).Gid), convey.ShouldEqual, owner.GID)
+		}
+	})
+}
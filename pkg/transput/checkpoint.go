@@ -0,0 +1,30 @@
+package transput
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+type checkpointDirCtxKey struct{}
+
+// WithCheckpointDir returns a copy of ctx in which the multipart transfers of
+// the object storages keep their checkpoints in dir, so that a restarted filer
+// resumes the parts already transferred.
+func WithCheckpointDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, checkpointDirCtxKey{}, dir)
+}
+
+// CheckpointDirFrom returns the checkpoint directory of ctx, created if
+// missing. It is empty if the parts are not resumed.
+func CheckpointDirFrom(ctx context.Context) (string, error) {
+	dir, _ := ctx.Value(checkpointDirCtxKey{}).(string)
+	if dir == "" {
+		return "", nil
+	}
+	// not MkdirAll of ctx, the checkpoints are not inputs
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to mkdir checkpoint dir: %w", err)
+	}
+	return dir, nil
+}
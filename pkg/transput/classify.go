@@ -0,0 +1,55 @@
+package transput
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+)
+
+// ClassifyError wraps err into the error category deciding the exit code,
+// it is the fallback of the classification done by each transput. Errors
+// already classified or unknown are returned as is.
+func ClassifyError(err error) error {
+	if err == nil || apperror.HasCode(err) {
+		return err
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return apperror.Wrap(apperror.ErrCancelled, err)
+	case errors.Is(err, ErrNotExist):
+		return apperror.Wrap(apperror.ErrNotFound, err)
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return apperror.Wrap(apperror.ErrDiskFull, err)
+	case errors.Is(err, os.ErrPermission):
+		return apperror.Wrap(apperror.ErrPermissionDenied, err)
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EPIPE):
+		return apperror.Wrap(apperror.ErrNetwork, err)
+	}
+	return err
+}
+
+// ClassifyStatus classifies err by the http status code of the failed request.
+func ClassifyStatus(statusCode int, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusForbidden:
+		return apperror.Wrap(apperror.ErrPermissionDenied, err)
+	case statusCode == http.StatusNotFound:
+		return apperror.Wrap(apperror.ErrNotFound, err)
+	case statusCode == http.StatusTooManyRequests:
+		return apperror.Wrap(apperror.ErrRateLimited, err)
+	case statusCode == http.StatusRequestTimeout, statusCode >= http.StatusInternalServerError:
+		return apperror.Wrap(apperror.ErrNetwork, err)
+	}
+	return ClassifyError(err)
+}
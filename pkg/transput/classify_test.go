@@ -0,0 +1,91 @@
+package transput
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectExitCode int
+	}{
+		{
+			name:           "remote not exist",
+			err:            NotExistError("s3://bucket/a", errors.New("NoSuchKey")),
+			expectExitCode: apperror.ExitNotFound,
+		},
+		{
+			name:           "disk full",
+			err:            fmt.Errorf("failed to write file: %w", syscall.ENOSPC),
+			expectExitCode: apperror.ExitDiskFull,
+		},
+		{
+			name:           "connection reset",
+			err:            fmt.Errorf("failed to read: %w", syscall.ECONNRESET),
+			expectExitCode: apperror.ExitNetwork,
+		},
+		{
+			name:           "unexpected eof",
+			err:            fmt.Errorf("failed to copy: %w", io.ErrUnexpectedEOF),
+			expectExitCode: apperror.ExitNetwork,
+		},
+		{
+			name:           "already classified",
+			err:            apperror.NewInvalidArgumentError("FileDir.URL", "s3://"),
+			expectExitCode: apperror.ExitInvalidArgument,
+		},
+		{
+			name:           "internal error wrapping a classified one",
+			err:            apperror.NewInternalError(apperror.Wrap(apperror.ErrRateLimited, errors.New("SlowDown"))),
+			expectExitCode: apperror.ExitRateLimited,
+		},
+		{
+			name:           "cancelled",
+			err:            fmt.Errorf("failed to upload: %w", context.Canceled),
+			expectExitCode: apperror.ExitCancelled,
+		},
+		{
+			name:           "unknown error",
+			err:            errors.New("unknown"),
+			expectExitCode: apperror.ExitUnknown,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			convey.So(apperror.ExitCode(ClassifyError(tc.err)), convey.ShouldEqual, tc.expectExitCode)
+		})
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		name           string
+		statusCode     int
+		expectExitCode int
+	}{
+		{name: "forbidden", statusCode: http.StatusForbidden, expectExitCode: apperror.ExitPermissionDenied},
+		{name: "not found", statusCode: http.StatusNotFound, expectExitCode: apperror.ExitNotFound},
+		{name: "too many requests", statusCode: http.StatusTooManyRequests, expectExitCode: apperror.ExitRateLimited},
+		{name: "bad gateway", statusCode: http.StatusBadGateway, expectExitCode: apperror.ExitNetwork},
+		{name: "bad request", statusCode: http.StatusBadRequest, expectExitCode: apperror.ExitUnknown},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			err := ClassifyStatus(tc.statusCode, fmt.Errorf("got status code: %d", tc.statusCode))
+			convey.So(apperror.ExitCode(err), convey.ShouldEqual, tc.expectExitCode)
+		})
+	}
+}
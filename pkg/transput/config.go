@@ -9,6 +9,9 @@ type S3SDKConfig struct {
 	EnableCRC     bool   `json:"enable_crc" mapstructure:"enable_crc"`
 	MaxBandwidth  int64  `json:"max_band_width" mapstructure:"max_band_width"`
 	MaxRetryCount int64  `json:"max_retry_count" mapstructure:"max_retry_count"`
+	// ForcePathStyle puts the bucket in the path instead of the host, required
+	// by most s3 compatible storages, e.g. minio and ceph.
+	ForcePathStyle bool `json:"force_path_style" mapstructure:"force_path_style"`
 }
 
 type S3SecretConfig struct {
@@ -0,0 +1,25 @@
+package transput
+
+import (
+	"context"
+)
+
+// DirMarkerUploader is implemented by the transputs able to keep an empty
+// directory, as a zero-byte object whose key ends with slash on object storages.
+type DirMarkerUploader interface {
+	UploadDirMarker(ctx context.Context, remote string) error
+}
+
+type dirMarkersCtxKey struct{}
+
+// WithDirMarkers returns a copy of ctx in which the directory uploads keep the
+// empty directories as markers, and the directory downloads recreate them.
+func WithDirMarkers(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, dirMarkersCtxKey{}, enabled)
+}
+
+// DirMarkersFrom reports whether the empty directories are kept in ctx.
+func DirMarkersFrom(ctx context.Context) bool {
+	enabled, _ := ctx.Value(dirMarkersCtxKey{}).(bool)
+	return enabled
+}
@@ -0,0 +1,75 @@
+package transput
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+type fakeMarkerUploader struct {
+	fakeUploader
+
+	lock    sync.Mutex
+	markers []string
+}
+
+func (f *fakeMarkerUploader) UploadDirMarker(_ context.Context, remote string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.markers = append(f.markers, remote)
+	return nil
+}
+
+func TestCommonUploadDir_dirMarkers(t *testing.T) {
+	tests := []struct {
+		name          string
+		dirs          []string
+		files         []string
+		markers       bool
+		expectMarkers []string
+	}{
+		{
+			name:          "empty directories",
+			dirs:          []string{"empty", "sub/nested"},
+			files:         []string{"a", "sub/b"},
+			markers:       true,
+			expectMarkers: []string{"remote/empty/", "remote/sub/nested/"},
+		},
+		{
+			name:          "empty root",
+			markers:       true,
+			expectMarkers: []string{"remote/"},
+		},
+		{
+			name:  "disabled",
+			dirs:  []string{"empty"},
+			files: []string{"a"},
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			local := t.TempDir()
+			for _, dir := range tc.dirs {
+				convey.So(os.MkdirAll(filepath.Join(local, dir), 0755), convey.ShouldBeNil)
+			}
+			for _, file := range tc.files {
+				convey.So(os.MkdirAll(filepath.Dir(filepath.Join(local, file)), 0755), convey.ShouldBeNil)
+				convey.So(os.WriteFile(filepath.Join(local, file), []byte(file), 0644), convey.ShouldBeNil)
+			}
+
+			uploader := &fakeMarkerUploader{}
+			ctx := WithDirMarkers(context.Background(), tc.markers)
+			err := CommonUploadDir(ctx, local, "remote", uploader)
+			convey.So(err, convey.ShouldBeNil)
+			sort.Strings(uploader.markers)
+			convey.So(uploader.markers, convey.ShouldResemble, tc.expectMarkers)
+			convey.So(uploader.uploaded, convey.ShouldHaveLength, len(tc.files))
+		})
+	}
+}
@@ -14,7 +14,9 @@ import (
 	"github.com/GBA-BI/tes-filer/pkg/checker"
 	md5checker "github.com/GBA-BI/tes-filer/pkg/checker/md5"
 	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
 	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
 	transputhttp "github.com/GBA-BI/tes-filer/pkg/transput/http"
 )
@@ -28,14 +30,18 @@ type drsTransput struct {
 	aaiPassport       string
 
 	client *http.Client
+	// limits of the transputs of the access methods
+	limits *ratelimit.Limits
 	logger log.Logger
 }
 
-func NewDRSTransput(cfg *Config, logger log.Logger) (transput.Transput, error) {
+// NewDRSTransput returns the drs transput whose downloads are limited by limits.
+func NewDRSTransput(cfg *Config, limits *ratelimit.Limits, logger log.Logger) (transput.Transput, error) {
 	drs := &drsTransput{
 		client:            &http.Client{},
 		insecureDirDomain: cfg.InsecureDirDomain,
 		aaiPassport:       cfg.AAIPassport,
+		limits:            limits,
 		logger:            logger,
 	}
 
@@ -49,11 +55,11 @@ func (d *drsTransput) DownloadFile(ctx context.Context, local, remote string) er
 	}
 	objectID := filepath.Base(remote)
 	if !drsObjectReg.MatchString(objectID) {
-		return fmt.Errorf("invalid object id %q", objectID)
+		return apperror.NewInvalidArgumentError("DRS object id", objectID)
 	}
 	hostName := parsedURL.Hostname()
 	if strings.Contains(hostName, ":") {
-		return fmt.Errorf("Compact Identifier-based DRS URI not implemented")
+		return apperror.NewInvalidArgumentError("DRS URI", "Compact Identifier-based "+remote)
 	}
 	requestURI := fmt.Sprintf("https://%s/ga4gh/drs/v1/objects/%s", hostName, objectID)
 	if d.insecureDirDomain == hostName {
@@ -61,13 +67,13 @@ func (d *drsTransput) DownloadFile(ctx context.Context, local, remote string) er
 	}
 	var req *http.Request
 	if len(d.aaiPassport) != 0 {
-		req, err = http.NewRequest(http.MethodPost, requestURI, nil)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, requestURI, nil)
 		if err != nil {
 			return err
 		}
 		req.Header.Set("passports", d.aaiPassport)
 	} else {
-		req, err = http.NewRequest(http.MethodGet, requestURI, nil)
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, requestURI, nil)
 		if err != nil {
 			return err
 		}
@@ -75,12 +81,15 @@ func (d *drsTransput) DownloadFile(ctx context.Context, local, remote string) er
 
 	resp, err := d.client.Do(req)
 	if err != nil {
-		return err
+		return transput.ClassifyError(err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return transput.ClassifyError(transput.NotExistError(remote, fmt.Errorf("DRS GetObject got status code: %d", resp.StatusCode)))
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("DRS GetObject got status code: %d", resp.StatusCode)
+		return transput.ClassifyStatus(resp.StatusCode, fmt.Errorf("DRS GetObject got status code: %d", resp.StatusCode))
 	}
 
 	var drsResp GetObjectResponse
@@ -89,13 +98,23 @@ func (d *drsTransput) DownloadFile(ctx context.Context, local, remote string) er
 		return err
 	}
 
-	if err := d.pickAvailableTransputAndDownload(ctx, drsResp.AccessMethods, hostName, objectID, local); err != nil {
+	// download to the temp path and rename into place after verified, the
+	// transput of the access method already writes atomically to it
+	tempPath := transput.TempPath(local)
+	if err := d.pickAvailableTransputAndDownload(ctx, drsResp.AccessMethods, hostName, objectID, tempPath); err != nil {
 		return err
 	}
+	if err := d.verify(tempPath, &drsResp); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	return transput.ClassifyError(os.Rename(tempPath, local))
+}
 
-	stat, err := os.Stat(local)
+func (d *drsTransput) verify(path string, drsResp *GetObjectResponse) error {
+	stat, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("failed to stat download file of path %s: %w", local, err)
+		return fmt.Errorf("failed to stat download file of path %s: %w", path, err)
 	}
 
 	if uint64(stat.Size()) != uint64(drsResp.Size) {
@@ -108,7 +127,7 @@ func (d *drsTransput) DownloadFile(ctx context.Context, local, remote string) er
 		return nil
 	}
 
-	check, err := checker.Check(local)
+	check, err := checker.Check(path)
 	if err != nil {
 		return fmt.Errorf("checker error:%w", err)
 	}
@@ -127,7 +146,7 @@ func (d *drsTransput) pickAvailableTransputAndDownload(ctx context.Context, acce
 	for _, accessMethod := range accessMethods {
 		accessType := accessMethod.Type
 		if accessType == "https" {
-			accessURL, err := d.getAccessURL(accessMethod, hostName, objectID)
+			accessURL, err := d.getAccessURL(ctx, accessMethod, hostName, objectID)
 			if err != nil {
 				d.logger.Warnf("No available access url of http access_method")
 				continue
@@ -136,6 +155,7 @@ func (d *drsTransput) pickAvailableTransputAndDownload(ctx context.Context, acce
 				&transputhttp.Config{
 					Headers: accessURL.Headers,
 				},
+				d.limits,
 			)
 			if err != nil {
 				return err
@@ -162,7 +182,7 @@ func (d *drsTransput) pickAvailableChecker(checksums []Checksum) checker.Checker
 	return nil
 }
 
-func (d *drsTransput) getAccessURL(am AccessMethod, hostName, objectID string) (AccessURL, error) {
+func (d *drsTransput) getAccessURL(ctx context.Context, am AccessMethod, hostName, objectID string) (AccessURL, error) {
 	if am.AccessURL.URL != "" {
 		return am.AccessURL, nil
 	}
@@ -174,7 +194,11 @@ func (d *drsTransput) getAccessURL(am AccessMethod, hostName, objectID string) (
 		requestURI = fmt.Sprintf("http://%s/ga4gh/drs/v1/objects/%s/access/%s", hostName, objectID, accessID)
 	}
 
-	resp, err := http.Get(requestURI)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURI, nil)
+	if err != nil {
+		return AccessURL{}, err
+	}
+	resp, err := d.client.Do(req)
 	if err != nil {
 		d.logger.Errorf("DRS GetAccess error: %v", err)
 		return AccessURL{}, err
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -17,6 +18,7 @@ import (
 	"github.com/GBA-BI/tes-filer/pkg/checker"
 	"github.com/GBA-BI/tes-filer/pkg/log"
 	"github.com/GBA-BI/tes-filer/pkg/mock"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
 	transputhttp "github.com/GBA-BI/tes-filer/pkg/transput/http"
 )
@@ -56,10 +58,11 @@ func TestDrsTransput_getAccessURL(t *testing.T) {
 			drsTrans := &drsTransput{
 				insecureDirDomain: "insecureDirDomain",
 				aaiPassport:       "aaiPassport",
+				client:            &http.Client{},
 				logger:            log.NewNopLogger(),
 			}
 
-			patch := gomonkey.ApplyFunc(http.Get, func(string) (*http.Response, error) {
+			patch := gomonkey.ApplyMethod(reflect.TypeOf(drsTrans.client), "Do", func(_ *http.Client, _ *http.Request) (*http.Response, error) {
 				if tc.expectErr {
 					return nil, fmt.Errorf("failed to get")
 				}
@@ -70,7 +73,7 @@ func TestDrsTransput_getAccessURL(t *testing.T) {
 			})
 			defer patch.Reset()
 
-			_, err := drsTrans.getAccessURL(tc.accessMethod, tc.hostName, tc.objectID)
+			_, err := drsTrans.getAccessURL(context.Background(), tc.accessMethod, tc.hostName, tc.objectID)
 			if tc.expectErr {
 				convey.So(err, convey.ShouldNotBeNil)
 			} else {
@@ -141,7 +144,7 @@ func TestDrsTransput_pickAvailableTransputAndDownload(t *testing.T) {
 			})
 
 			defer patch2.Reset()
-			patch3 := gomonkey.ApplyFunc(transputhttp.NewHTTPTransput, func(_ *transputhttp.Config) (transput.Transput, error) {
+			patch3 := gomonkey.ApplyFunc(transputhttp.NewHTTPTransput, func(_ *transputhttp.Config, _ *ratelimit.Limits) (transput.Transput, error) {
 				if tc.expectErr {
 					return nil, fmt.Errorf("failed to new http transput")
 				}
@@ -176,13 +179,13 @@ func TestDrsTransput_DownloadFile(t *testing.T) {
 	}{
 		{
 			name:      "successfully download file",
-			local:     "/path/to/local",
+			local:     "local",
 			remote:    "http://remote.com/objectID1",
 			expectErr: false,
 		},
 		{
 			name:      "failed to download file",
-			local:     "/path/to/local",
+			local:     "local",
 			remote:    "http://remote.com/objectID2",
 			expectErr: true,
 		},
@@ -223,11 +226,12 @@ func TestDrsTransput_DownloadFile(t *testing.T) {
 			})
 			defer patch3.Reset()
 
-			patch4 := gomonkey.ApplyPrivateMethod(reflect.TypeOf(drsTrans), "pickAvailableTransputAndDownload", func(_ *drsTransput, _ context.Context, _ []AccessMethod, _ string, _ string, _ string) error {
+			local := filepath.Join(t.TempDir(), tc.local)
+			patch4 := gomonkey.ApplyPrivateMethod(reflect.TypeOf(drsTrans), "pickAvailableTransputAndDownload", func(_ *drsTransput, _ context.Context, _ []AccessMethod, _ string, _ string, path string) error {
 				if tc.expectErr {
 					return fmt.Errorf("failed to pick available transput and download")
 				}
-				return nil
+				return os.WriteFile(path, []byte("content"), 0644)
 			})
 			defer patch4.Reset()
 
@@ -239,11 +243,14 @@ func TestDrsTransput_DownloadFile(t *testing.T) {
 			})
 			defer patch5.Reset()
 
-			err := drsTrans.DownloadFile(context.Background(), tc.local, tc.remote)
+			err := drsTrans.DownloadFile(context.Background(), local, tc.remote)
 			if tc.expectErr {
 				convey.So(err, convey.ShouldNotBeNil)
 			} else {
 				convey.So(err, convey.ShouldBeNil)
+				content, readErr := os.ReadFile(local)
+				convey.So(readErr, convey.ShouldBeNil)
+				convey.So(string(content), convey.ShouldEqual, "content")
 			}
 		})
 	}
@@ -0,0 +1,144 @@
+package transput
+
+import (
+	"context"
+	"sync"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+// Engine bounds the number of single file transfers running at the same time,
+// both for the whole process and for each scheme.
+type Engine struct {
+	global  chan struct{}
+	schemes map[consts.Scheme]chan struct{}
+}
+
+func NewEngine(concurrency int, schemeConcurrency map[consts.Scheme]int) *Engine {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	engine := &Engine{
+		global:  make(chan struct{}, concurrency),
+		schemes: make(map[consts.Scheme]chan struct{}),
+	}
+	for scheme, num := range schemeConcurrency {
+		if num > 0 {
+			engine.schemes[scheme] = make(chan struct{}, num)
+		}
+	}
+	return engine
+}
+
+type engineCtxKey struct{}
+
+type schedule struct {
+	engine *Engine
+	scheme consts.Scheme
+}
+
+// WithEngine returns a copy of ctx in which the file transfers started by a
+// Group are scheduled by the engine under the given scheme.
+func WithEngine(ctx context.Context, engine *Engine, scheme consts.Scheme) context.Context {
+	return context.WithValue(ctx, engineCtxKey{}, &schedule{engine: engine, scheme: scheme})
+}
+
+func scheduleFrom(ctx context.Context) *schedule {
+	sched, _ := ctx.Value(engineCtxKey{}).(*schedule)
+	if sched == nil || sched.engine == nil {
+		return nil
+	}
+	return sched
+}
+
+func (s *schedule) acquire(ctx context.Context) error {
+	// take the scheme slot first, so that waiting for a busy scheme does not
+	// hold global slots which other schemes could use
+	sem, limited := s.engine.schemes[s.scheme]
+	if limited {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case s.engine.global <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if limited {
+			<-sem
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *schedule) release() {
+	<-s.engine.global
+	if sem, ok := s.engine.schemes[s.scheme]; ok {
+		<-sem
+	}
+}
+
+// Group runs the single file transfers of a file or directory. The first
+// failure cancels the transfers which are still running or waiting.
+// Without an engine in the context, the transfers run one by one in the caller.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	sched  *schedule
+
+	wg   sync.WaitGroup
+	once sync.Once
+	err  error
+}
+
+func NewGroup(ctx context.Context) *Group {
+	groupCtx, cancel := context.WithCancel(ctx)
+	return &Group{
+		ctx:    groupCtx,
+		cancel: cancel,
+		sched:  scheduleFrom(ctx),
+	}
+}
+
+// Go schedules a single file transfer. It blocks until the engine has a free
+// slot, so a directory walk can not run too far ahead of the transfers.
+func (g *Group) Go(fn func(ctx context.Context) error) {
+	if err := g.ctx.Err(); err != nil {
+		g.setErr(err)
+		return
+	}
+	if g.sched == nil {
+		g.setErr(fn(g.ctx))
+		return
+	}
+
+	if err := g.sched.acquire(g.ctx); err != nil {
+		g.setErr(err)
+		return
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.sched.release()
+		g.setErr(fn(g.ctx))
+	}()
+}
+
+// Wait blocks until all scheduled transfers are finished and returns the first error.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+func (g *Group) setErr(err error) {
+	if err == nil {
+		return
+	}
+	g.once.Do(func() {
+		g.err = err
+		g.cancel()
+	})
+}
@@ -0,0 +1,114 @@
+package transput
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		name              string
+		engine            *Engine
+		scheme            consts.Scheme
+		jobs              int
+		failAt            int
+		expectErr         bool
+		expectMaxParallel int64
+	}{
+		{
+			name:              "run one by one without engine",
+			engine:            nil,
+			scheme:            consts.SchemeS3,
+			jobs:              10,
+			failAt:            -1,
+			expectErr:         false,
+			expectMaxParallel: 1,
+		},
+		{
+			name:              "stop at the first error without engine",
+			engine:            nil,
+			scheme:            consts.SchemeS3,
+			jobs:              10,
+			failAt:            3,
+			expectErr:         true,
+			expectMaxParallel: 1,
+		},
+		{
+			name:              "bounded by global concurrency",
+			engine:            NewEngine(4, nil),
+			scheme:            consts.SchemeS3,
+			jobs:              20,
+			failAt:            -1,
+			expectErr:         false,
+			expectMaxParallel: 4,
+		},
+		{
+			name:              "bounded by scheme concurrency",
+			engine:            NewEngine(4, map[consts.Scheme]int{consts.SchemeFTP: 2}),
+			scheme:            consts.SchemeFTP,
+			jobs:              20,
+			failAt:            -1,
+			expectErr:         false,
+			expectMaxParallel: 2,
+		},
+		{
+			name:              "failed with engine",
+			engine:            NewEngine(4, nil),
+			scheme:            consts.SchemeS3,
+			jobs:              20,
+			failAt:            5,
+			expectErr:         true,
+			expectMaxParallel: 4,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			ctx := context.Background()
+			if tc.engine != nil {
+				ctx = WithEngine(ctx, tc.engine, tc.scheme)
+			}
+
+			var running, maxRunning, finished int64
+			g := NewGroup(ctx)
+			for i := 0; i < tc.jobs; i++ {
+				index := i
+				g.Go(func(ctx context.Context) error {
+					cur := atomic.AddInt64(&running, 1)
+					defer atomic.AddInt64(&running, -1)
+					for {
+						old := atomic.LoadInt64(&maxRunning)
+						if cur <= old || atomic.CompareAndSwapInt64(&maxRunning, old, cur) {
+							break
+						}
+					}
+					time.Sleep(5 * time.Millisecond)
+					if index == tc.failAt {
+						return errors.New("transfer error")
+					}
+					atomic.AddInt64(&finished, 1)
+					return nil
+				})
+			}
+			err := g.Wait()
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(finished, convey.ShouldBeLessThan, tc.jobs)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(finished, convey.ShouldEqual, tc.jobs)
+			}
+			convey.So(maxRunning, convey.ShouldBeLessThanOrEqualTo, tc.expectMaxParallel)
+			if tc.engine != nil && !tc.expectErr {
+				convey.So(maxRunning, convey.ShouldBeGreaterThan, 1)
+			}
+		})
+	}
+}
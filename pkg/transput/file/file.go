@@ -6,13 +6,15 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
-	"github.com/GBA-BI/tes-filer/pkg/consts"
 	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
 	utilspath "github.com/GBA-BI/tes-filer/pkg/utils/path"
+	utilsstrings "github.com/GBA-BI/tes-filer/pkg/utils/strings"
 )
 
 type fileTransput struct {
@@ -20,16 +22,20 @@ type fileTransput struct {
 
 	hostBasePath      string
 	containerBasePath string
-	logger            log.Logger
+	// downloads are symlinks, only the copies of uploads are limited
+	uploadLimiter *ratelimit.Limiter
+	logger        log.Logger
 }
 
-func NewFileTransput(cfg *Config, logger log.Logger) (transput.Transput, error) {
+// NewFileTransput returns the file transput limited by limits.
+func NewFileTransput(cfg *Config, limits *ratelimit.Limits, logger log.Logger) (transput.Transput, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("nil config of file transput")
 	}
 	return &fileTransput{
 		hostBasePath:      cfg.HostBasePath,
 		containerBasePath: cfg.ContainerBasePath,
+		uploadLimiter:     limits.Upload(),
 		logger:            logger,
 	}, nil
 }
@@ -40,7 +46,7 @@ func (ft *fileTransput) DownloadFile(ctx context.Context, local, remote string)
 		return err
 	}
 	ft.logger.Infof("Symlink %s to %s", urlContainerPath, local)
-	return symlink(urlContainerPath, local)
+	return symlink(ctx, urlContainerPath, local)
 }
 
 func (ft *fileTransput) DownloadDir(ctx context.Context, local, remote string) error {
@@ -48,8 +54,13 @@ func (ft *fileTransput) DownloadDir(ctx context.Context, local, remote string) e
 	if err != nil {
 		return err
 	}
-	ft.logger.Infof("Symlink %s to %s", urlContainerPath, local)
-	return symlink(urlContainerPath, local)
+	if filter := transput.FilterFrom(ctx); !filter.IsEmpty() {
+		// the directory can not be linked as a whole, only the selected files are
+		ft.logger.Infof("Symlink files of %s to %s", urlContainerPath, local)
+		return ft.symlinkFiles(ctx, urlContainerPath, local, remote, filter)
+	}
+	// a single tracked transfer, so that it is journaled as the files are
+	return transput.RunDownload(ctx, ft, local, remote)
 }
 
 func (ft *fileTransput) UploadFile(ctx context.Context, local, remote string) error {
@@ -58,7 +69,7 @@ func (ft *fileTransput) UploadFile(ctx context.Context, local, remote string) er
 		return err
 	}
 	ft.logger.Infof("Copying %s to %s", local, urlContainerPath)
-	return copyFile(local, urlContainerPath)
+	return ft.copyFile(ctx, local, urlContainerPath)
 }
 
 func (ft *fileTransput) UploadDir(ctx context.Context, local, remote string) error {
@@ -67,7 +78,7 @@ func (ft *fileTransput) UploadDir(ctx context.Context, local, remote string) err
 		return err
 	}
 	ft.logger.Infof("Copying %s to %s", local, urlContainerPath)
-	return copyDir(local, urlContainerPath)
+	return ft.copyDir(ctx, local, urlContainerPath, remote)
 }
 
 func (ft *fileTransput) getContainerPathFromURL(urlStr string) (string, error) {
@@ -89,7 +100,10 @@ func (ft *fileTransput) getContainerPathFromURL(urlStr string) (string, error) {
 	return filepath.Join(ft.containerBasePath, relPath), nil
 }
 
-func copyContent(src, dst string) error {
+// copyContent schedules copying the content of src whose path relative to
+// the copied directory is relDir, remote is the url of dst.
+func (ft *fileTransput) copyContent(ctx context.Context, g *transput.Group, src, dst, remote, relDir string) error {
+	filter := transput.FilterFrom(ctx)
 	entries, err := os.ReadDir(src)
 	if err != nil {
 		return err
@@ -98,6 +112,8 @@ func copyContent(src, dst string) error {
 	for _, entry := range entries {
 		srcPath := filepath.Join(src, entry.Name())
 		dstPath := filepath.Join(dst, entry.Name())
+		remotePath := utilsstrings.CheckDir(remote) + entry.Name()
+		relPath := path.Join(relDir, entry.Name())
 
 		fileInfo, err := os.Stat(srcPath)
 		if err != nil {
@@ -105,15 +121,22 @@ func copyContent(src, dst string) error {
 		}
 
 		if fileInfo.IsDir() {
-			err = copyContent(srcPath, dstPath)
-			if err != nil {
-				return err
+			if filter.SkipDir(relPath) {
+				continue
+			}
+			if transput.DirMarkersFrom(ctx) {
+				// keep the directory even if empty
+				if err := transput.MkdirAll(ctx, dstPath); err != nil {
+					return err
+				}
 			}
-		} else {
-			err = copyFile(srcPath, dstPath)
+			err = ft.copyContent(ctx, g, srcPath, dstPath, remotePath, relPath)
 			if err != nil {
 				return err
 			}
+		} else if filter.Match(relPath) {
+			// copied by UploadFile as a tracked transfer
+			g.Upload(ft, srcPath, remotePath)
 		}
 
 	}
@@ -121,18 +144,25 @@ func copyContent(src, dst string) error {
 	return nil
 }
 
-func copyDir(src, dst string) error {
+func (ft *fileTransput) copyDir(ctx context.Context, src, dst, remote string) error {
 	exist, err := utilspath.FileExists(dst)
 	if err != nil {
 		return err
 	}
 	if !exist {
-		os.MkdirAll(dst, consts.DefaultFileMode)
+		if err := transput.MkdirAll(ctx, dst); err != nil {
+			return err
+		}
+	}
+	g := transput.NewGroup(ctx)
+	walkErr := ft.copyContent(ctx, g, src, dst, remote, "")
+	if err := g.Wait(); err != nil {
+		return err
 	}
-	return copyContent(src, dst)
+	return walkErr
 }
 
-func copyFile(src, dst string) error {
+func (ft *fileTransput) copyFile(ctx context.Context, src, dst string) error {
 	srcInfo, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -145,9 +175,8 @@ func copyFile(src, dst string) error {
 		}
 	}
 
-	dstDir := filepath.Dir(dst)
-	if _, err := os.Stat(dstDir); os.IsNotExist(err) {
-		os.MkdirAll(dstDir, consts.DefaultFileMode)
+	if err := transput.MkdirAll(ctx, filepath.Dir(dst)); err != nil {
+		return err
 	}
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -161,7 +190,7 @@ func copyFile(src, dst string) error {
 	}
 	defer dstFile.Close()
 
-	_, err = io.Copy(dstFile, srcFile)
+	_, err = io.Copy(dstFile, ft.uploadLimiter.Reader(ctx, transput.NewContextReader(ctx, srcFile)))
 	if err != nil {
 		return err
 	}
@@ -171,18 +200,83 @@ func copyFile(src, dst string) error {
 		return err
 	}
 
-	return nil
+	// keep the mode and mtime as the object storages do in metadata
+	if err := os.Chmod(dst, srcInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, srcInfo.ModTime(), srcInfo.ModTime())
 }
 
-func symlink(src, dst string) error {
+func symlink(ctx context.Context, src, dst string) error {
 	// check src exist
 	if _, err := os.Stat(src); err != nil {
+		if os.IsNotExist(err) {
+			return transput.NotExistError(src, err)
+		}
+		return err
+	}
+
+	if err := transput.MkdirAll(ctx, filepath.Dir(dst)); err != nil {
+		return err
+	}
+	// link at the temp path and rename into place, which replaces the link
+	// left by a previous attempt
+	tempPath := transput.TempPath(dst)
+	_ = os.Remove(tempPath)
+	if err := os.Symlink(src, tempPath); err != nil {
+		return err
+	}
+	if err := transput.Lchown(ctx, tempPath); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		_ = os.Remove(tempPath)
 		return err
 	}
+	return nil
+}
 
-	dstDir := filepath.Dir(dst)
-	if _, err := os.Stat(dstDir); os.IsNotExist(err) {
-		os.MkdirAll(dstDir, consts.DefaultFileMode)
+// symlinkFiles links the files of src selected by filter into dst, remote is
+// the url of src.
+func (ft *fileTransput) symlinkFiles(ctx context.Context, src, dst, remote string, filter *transput.Filter) error {
+	if _, err := os.Stat(src); err != nil {
+		if os.IsNotExist(err) {
+			return transput.NotExistError(src, err)
+		}
+		return err
+	}
+	g := transput.NewGroup(ctx)
+	walkErr := filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if filter.SkipDir(filepath.ToSlash(relPath)) {
+				return filepath.SkipDir
+			}
+			if transput.DirMarkersFrom(ctx) {
+				// keep the directory even if empty
+				return transput.MkdirAll(ctx, filepath.Join(dst, relPath))
+			}
+			return nil
+		}
+		if !filter.Match(filepath.ToSlash(relPath)) {
+			return nil
+		}
+		// linked by DownloadFile as a tracked transfer
+		g.Download(ft, filepath.Join(dst, relPath), utilsstrings.CheckDir(remote)+filepath.ToSlash(relPath))
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return err
 	}
-	return os.Symlink(src, dst)
+	return walkErr
 }
@@ -2,16 +2,21 @@ package file
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
-	"reflect"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/smartystreets/goconvey/convey"
 
+	"github.com/GBA-BI/tes-filer/pkg/consts"
 	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
 )
 
 func TestFileTransput_DownloadFile(t *testing.T) {
@@ -43,7 +48,7 @@ func TestFileTransput_DownloadFile(t *testing.T) {
 				logger:            log.NewNopLogger(),
 			}
 
-			patch1 := gomonkey.ApplyFunc(symlink, func(src, dst string) error {
+			patch1 := gomonkey.ApplyFunc(symlink, func(_ context.Context, src, dst string) error {
 				if tc.expectErr {
 					return fmt.Errorf("failed to symlink")
 				}
@@ -90,7 +95,7 @@ func TestFileTransput_DownloadDir(t *testing.T) {
 				logger:            log.NewNopLogger(),
 			}
 
-			patch1 := gomonkey.ApplyFunc(symlink, func(src, dst string) error {
+			patch1 := gomonkey.ApplyFunc(symlink, func(_ context.Context, src, dst string) error {
 				if tc.expectErr {
 					return fmt.Errorf("failed to symlink")
 				}
@@ -111,19 +116,16 @@ func TestFileTransput_DownloadDir(t *testing.T) {
 func TestFileTransput_UploadFile(t *testing.T) {
 	tests := []struct {
 		name      string
-		local     string
 		remote    string
 		expectErr bool
 	}{
 		{
 			name:      "successfully upload file",
-			local:     "/tmp/test",
-			remote:    "file://remote/tmp/test",
+			remote:    "file://remote/{base}/out/test",
 			expectErr: false,
 		},
 		{
 			name:      "failed to upload file",
-			local:     "/tmp/test",
 			remote:    "invalid url",
 			expectErr: true,
 		},
@@ -131,61 +133,174 @@ func TestFileTransput_UploadFile(t *testing.T) {
 
 	for _, tc := range tests {
 		convey.Convey(tc.name, t, func() {
+			base := t.TempDir()
 			fileTrans := &fileTransput{
-				hostBasePath:      "/tmp",
-				containerBasePath: "/tmp",
+				hostBasePath:      base,
+				containerBasePath: base,
 				logger:            log.NewNopLogger(),
 			}
+			local := filepath.Join(base, "test")
+			convey.So(os.WriteFile(local, []byte("#!/bin/sh"), 0644), convey.ShouldBeNil)
+			convey.So(os.Chmod(local, 0750), convey.ShouldBeNil)
+			mtime := time.Unix(1700000000, 0)
+			convey.So(os.Chtimes(local, mtime, mtime), convey.ShouldBeNil)
 
-			patch1 := gomonkey.ApplyFunc(os.Stat, func(string) (os.FileInfo, error) {
-				if tc.expectErr {
-					return nil, fmt.Errorf("failed to stat")
-				}
-				return nil, nil
-			})
-			defer patch1.Reset()
+			err := fileTrans.UploadFile(context.Background(), local, strings.ReplaceAll(tc.remote, "{base}", base))
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				// the mode and mtime are kept
+				info, statErr := os.Stat(filepath.Join(base, "out", "test"))
+				convey.So(statErr, convey.ShouldBeNil)
+				convey.So(info.Mode().Perm(), convey.ShouldEqual, os.FileMode(0750))
+				convey.So(info.ModTime().Equal(mtime), convey.ShouldBeTrue)
+			}
+		})
+	}
+}
 
-			tempFile := &os.File{}
-			patch5 := gomonkey.ApplyMethod(reflect.TypeOf(tempFile), "Close", func(_ *os.File) error {
-				return nil
-			})
-			defer patch5.Reset()
+type fakeJournal struct {
+	lock sync.Mutex
+	done map[string]bool
+}
 
-			patch6 := gomonkey.ApplyMethod(reflect.TypeOf(tempFile), "Sync", func(_ *os.File) error {
-				return nil
-			})
-			defer patch6.Reset()
+func (f *fakeJournal) Done(_ consts.TransputMode, local, _ string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.done[local]
+}
 
-			patch2 := gomonkey.ApplyFunc(os.Open, func(string) (*os.File, error) {
-				if tc.expectErr {
-					return nil, fmt.Errorf("failed to open")
-				}
-				return tempFile, nil
-			})
-			defer patch2.Reset()
+func (f *fakeJournal) Add(_ consts.TransputMode, local, _ string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.done[local] = true
+}
 
-			patch3 := gomonkey.ApplyFunc(os.Create, func(string) (*os.File, error) {
-				if tc.expectErr {
-					return nil, fmt.Errorf("failed to create")
-				}
-				return tempFile, nil
-			})
-			defer patch3.Reset()
+func TestFileTransput_journal(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter *transput.Filter
+		// upload the directory, otherwise download it
+		upload bool
+		// done are the files done by the previous run
+		done         []string
+		expectFiles  []string
+		expectLocals []string
+	}{
+		{
+			name:         "journal the copied files",
+			upload:       true,
+			expectFiles:  []string{"a", "sub/b"},
+			expectLocals: []string{"a", "sub/b"},
+		},
+		{
+			name:         "skip the copied files done",
+			upload:       true,
+			done:         []string{"a"},
+			expectFiles:  []string{"sub/b"},
+			expectLocals: []string{"a", "sub/b"},
+		},
+		{
+			name:         "journal the linked directory",
+			expectFiles:  []string{"a", "sub/b"},
+			expectLocals: []string{""},
+		},
+		{
+			name:         "journal the linked files",
+			filter:       transput.NewFilter([]string{"sub/*"}, nil),
+			expectFiles:  []string{"sub/b"},
+			expectLocals: []string{"sub/b"},
+		},
+	}
 
-			patch4 := gomonkey.ApplyFunc(io.Copy, func(dst io.Writer, src io.Reader) (written int64, err error) {
-				if tc.expectErr {
-					return 0, fmt.Errorf("failed to copy")
-				}
-				return 0, nil
-			})
-			defer patch4.Reset()
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			base := t.TempDir()
+			fileTrans := &fileTransput{
+				hostBasePath:      base,
+				containerBasePath: base,
+				logger:            log.NewNopLogger(),
+			}
+			src := filepath.Join(base, "src")
+			convey.So(os.MkdirAll(filepath.Join(src, "sub"), 0755), convey.ShouldBeNil)
+			convey.So(os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0644), convey.ShouldBeNil)
+			convey.So(os.WriteFile(filepath.Join(src, "sub", "b"), []byte("b"), 0644), convey.ShouldBeNil)
+			dst := filepath.Join(base, "dst")
 
-			err := fileTrans.UploadFile(context.Background(), tc.local, tc.remote)
-			if tc.expectErr {
-				convey.So(err, convey.ShouldNotBeNil)
+			journal := &fakeJournal{done: make(map[string]bool)}
+			local, remote := dst, "file://"+src
+			if tc.upload {
+				local, remote = src, "file://"+dst
+			}
+			for _, done := range tc.done {
+				journal.done[filepath.Join(local, done)] = true
+			}
+			ctx := transput.WithJournal(context.Background(), journal)
+			if tc.filter != nil {
+				ctx = transput.WithFilter(ctx, tc.filter)
+			}
+
+			var err error
+			if tc.upload {
+				err = fileTrans.UploadDir(ctx, local, remote)
 			} else {
+				err = fileTrans.DownloadDir(ctx, local, remote)
+			}
+			convey.So(err, convey.ShouldBeNil)
+			for _, file := range tc.expectFiles {
+				_, err := os.Stat(filepath.Join(dst, file))
 				convey.So(err, convey.ShouldBeNil)
 			}
+			for _, done := range tc.done {
+				_, err := os.Stat(filepath.Join(dst, done))
+				convey.So(os.IsNotExist(err), convey.ShouldBeTrue)
+			}
+			for _, file := range tc.expectLocals {
+				convey.So(journal.done[filepath.Join(local, file)], convey.ShouldBeTrue)
+			}
+		})
+	}
+}
+
+func TestFileTransput_mkdirError(t *testing.T) {
+	tests := []struct {
+		name   string
+		upload bool
+	}{
+		{
+			name: "symlink under a file",
+		},
+		{
+			name:   "copy under a file",
+			upload: true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			base := t.TempDir()
+			fileTrans := &fileTransput{
+				hostBasePath:      base,
+				containerBasePath: base,
+				logger:            log.NewNopLogger(),
+			}
+			src := filepath.Join(base, "src")
+			convey.So(os.WriteFile(src, []byte("src"), 0644), convey.ShouldBeNil)
+			blocker := filepath.Join(base, "blocker")
+			convey.So(os.WriteFile(blocker, []byte("blocker"), 0644), convey.ShouldBeNil)
+			dst := filepath.Join(blocker, "sub", "dst")
+
+			var err error
+			if tc.upload {
+				err = fileTrans.UploadFile(context.Background(), src, "file://"+dst)
+			} else {
+				err = fileTrans.DownloadFile(context.Background(), dst, "file://"+src)
+			}
+			// the mkdir error, not the one of the following open or symlink
+			var pathErr *os.PathError
+			convey.So(errors.As(err, &pathErr), convey.ShouldBeTrue)
+			convey.So(pathErr.Op, convey.ShouldEqual, "mkdir")
 		})
 	}
 }
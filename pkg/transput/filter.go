@@ -0,0 +1,109 @@
+package transput
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// Filter selects the files of a directory transfer by glob patterns matched
+// against their slash separated paths relative to the directory:
+//   - a pattern without slash matches any path element, e.g. "*.tmp";
+//   - a pattern ending with slash only matches directories, e.g. ".snakemake/";
+//   - other patterns match the leading elements, e.g. "logs/*.log".
+//
+// A file is selected if it matches no exclude pattern and, when there are
+// include patterns, at least one of them. The zero value and nil select all.
+type Filter struct {
+	include []string
+	exclude []string
+}
+
+// NewFilter returns the filter of the patterns, nil if there is none.
+func NewFilter(include, exclude []string) *Filter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	return &Filter{include: include, exclude: exclude}
+}
+
+type filterCtxKey struct{}
+
+// WithFilter returns a copy of ctx in which the directory transfers only
+// transfer the files selected by filter.
+func WithFilter(ctx context.Context, filter *Filter) context.Context {
+	return context.WithValue(ctx, filterCtxKey{}, filter)
+}
+
+// FilterFrom returns the filter of ctx, nil if none.
+func FilterFrom(ctx context.Context) *Filter {
+	filter, _ := ctx.Value(filterCtxKey{}).(*Filter)
+	return filter
+}
+
+// IsEmpty reports whether the filter selects all files.
+func (f *Filter) IsEmpty() bool {
+	return f == nil || (len(f.include) == 0 && len(f.exclude) == 0)
+}
+
+// Match reports whether the file of relPath is selected.
+func (f *Filter) Match(relPath string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	relPath = strings.Trim(path.Clean("/"+relPath), "/")
+	for _, pattern := range f.exclude {
+		if matchPattern(pattern, relPath, false) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pattern := range f.include {
+		if matchPattern(pattern, relPath, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// SkipDir reports whether the whole directory of relDir is excluded, so that
+// it is not walked or listed at all.
+func (f *Filter) SkipDir(relDir string) bool {
+	if f.IsEmpty() {
+		return false
+	}
+	relDir = strings.Trim(path.Clean("/"+relDir), "/")
+	if relDir == "" {
+		return false
+	}
+	for _, pattern := range f.exclude {
+		if matchPattern(pattern, relDir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches pattern against the elements of relPath, the last
+// element is a file unless isDir.
+func matchPattern(pattern, relPath string, isDir bool) bool {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.Trim(pattern, "/")
+	elems := strings.Split(relPath, "/")
+	if dirOnly && !isDir {
+		elems = elems[:len(elems)-1]
+	}
+	anchored := strings.Contains(pattern, "/")
+	for i := range elems {
+		name := elems[i]
+		if anchored {
+			name = strings.Join(elems[:i+1], "/")
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package transput
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+)
+
+func TestFilter_Match(t *testing.T) {
+	tests := []struct {
+		name        string
+		include     []string
+		exclude     []string
+		relPath     string
+		expectMatch bool
+	}{
+		{
+			name:        "no patterns",
+			relPath:     "a/b.tmp",
+			expectMatch: true,
+		},
+		{
+			name:        "excluded by name at any depth",
+			exclude:     []string{"*.tmp"},
+			relPath:     "a/b.tmp",
+			expectMatch: false,
+		},
+		{
+			name:        "excluded directory",
+			exclude:     []string{".snakemake/"},
+			relPath:     "run/.snakemake/log/x.log",
+			expectMatch: false,
+		},
+		{
+			name:        "directory pattern does not match files",
+			exclude:     []string{".snakemake/"},
+			relPath:     "run/.snakemake",
+			expectMatch: true,
+		},
+		{
+			name:        "excluded finish marker",
+			exclude:     []string{".*.finish"},
+			relPath:     ".INPUTS-S3-0123.finish",
+			expectMatch: false,
+		},
+		{
+			name:        "included",
+			include:     []string{"*.cram", "*.crai"},
+			relPath:     "sample/a.crai",
+			expectMatch: true,
+		},
+		{
+			name:        "not included",
+			include:     []string{"*.cram", "*.crai"},
+			relPath:     "sample/a.bam",
+			expectMatch: false,
+		},
+		{
+			name:        "exclude wins over include",
+			include:     []string{"*.cram"},
+			exclude:     []string{"tmp/"},
+			relPath:     "tmp/a.cram",
+			expectMatch: false,
+		},
+		{
+			name:        "anchored pattern",
+			include:     []string{"logs/*.log"},
+			relPath:     "logs/a.log",
+			expectMatch: true,
+		},
+		{
+			name:        "anchored pattern at other depth",
+			include:     []string{"logs/*.log"},
+			relPath:     "run/logs/a.log",
+			expectMatch: false,
+		},
+		{
+			name:        "leading slash of key",
+			include:     []string{"logs/*.log"},
+			relPath:     "/logs/a.log",
+			expectMatch: true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			filter := NewFilter(tc.include, tc.exclude)
+			convey.So(filter.Match(tc.relPath), convey.ShouldEqual, tc.expectMatch)
+		})
+	}
+}
+
+func TestFilter_SkipDir(t *testing.T) {
+	tests := []struct {
+		name       string
+		exclude    []string
+		relDir     string
+		expectSkip bool
+	}{
+		{
+			name:       "excluded directory",
+			exclude:    []string{".snakemake/"},
+			relDir:     "run/.snakemake",
+			expectSkip: true,
+		},
+		{
+			name:       "root is never skipped",
+			exclude:    []string{"*"},
+			relDir:     ".",
+			expectSkip: false,
+		},
+		{
+			name:       "other directory",
+			exclude:    []string{".snakemake/"},
+			relDir:     "run/logs",
+			expectSkip: false,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			filter := NewFilter(nil, tc.exclude)
+			convey.So(filter.SkipDir(tc.relDir), convey.ShouldEqual, tc.expectSkip)
+		})
+	}
+}
@@ -2,48 +2,223 @@ package ftp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jlaffaye/ftp"
 
-	"github.com/GBA-BI/tes-filer/pkg/consts"
 	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
 )
 
-func NewFTPTransput(cfg *Config) (transput.Transput, error) {
+// NewFTPTransput returns the ftp transput limited by limits.
+func NewFTPTransput(cfg *Config, userInfo *url.Userinfo, limits *ratelimit.Limits) (transput.Transput, error) {
 	if cfg == nil {
 		return nil, apperror.NewInvalidArgumentError("FTPTransput", "Config")
 	}
 
-	conn, err := ftp.Dial(cfg.URL)
-	if err != nil {
-		return nil, err
+	username, password := cfg.AccessKey, cfg.SecretKey
+	if userInfo != nil {
+		username = userInfo.Username()
+		// a url with only the username keeps the configured password
+		if userPassword, ok := userInfo.Password(); ok {
+			password = userPassword
+		}
 	}
 
-	err = conn.Login(cfg.AccessKey, cfg.SecretKey)
+	conn, nc, err := dial(context.Background(), cfg.URL, username, password)
 	if err != nil {
 		return nil, err
 	}
 
 	return &ftpTransput{
 		url:      cfg.URL,
-		username: cfg.AccessKey,
-		password: cfg.SecretKey,
-		conn:     conn,
+		username: username,
+		password: password,
+		conns:    []*ftp.ServerConn{conn},
+		netConns: map[*ftp.ServerConn]*netConns{conn: nc},
+
+		uploadLimiter:   limits.Upload(),
+		downloadLimiter: limits.Download(),
 	}, nil
 }
 
+func dial(ctx context.Context, url, username, password string) (*ftp.ServerConn, *netConns, error) {
+	nc := &netConns{}
+	conn, err := ftp.Dial(url, ftp.DialWithDialFunc(nc.dialFunc(ctx)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := conn.Login(username, password); err != nil {
+		_ = conn.Quit()
+		return nil, nil, err
+	}
+	return conn, nc, nil
+}
+
+// netConns are the network connections of an ftp connection, the control one
+// and the data one of its latest transfer. Their deadlines interrupt a
+// transfer stalled on the server, which the reads of ctx never notice.
+type netConns struct {
+	lock    sync.Mutex
+	dialed  bool
+	control net.Conn
+	data    net.Conn
+}
+
+// dialFunc dials the control connection with ctx and then the data ones.
+func (n *netConns) dialFunc(ctx context.Context) func(network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	return func(network, address string) (net.Conn, error) {
+		n.lock.Lock()
+		control := !n.dialed
+		n.dialed = true
+		n.lock.Unlock()
+
+		dialCtx := ctx
+		if !control {
+			// the data connections outlive the ctx of the dial
+			dialCtx = context.Background()
+		}
+		if _, ok := dialCtx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(dialCtx, ftp.DefaultDialTimeout)
+			defer cancel()
+		}
+		conn, err := dialer.DialContext(dialCtx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if control {
+			n.control = conn
+		} else {
+			n.data = conn
+		}
+		return conn, nil
+	}
+}
+
+// interrupt fails the pending and future reads and writes of the connections.
+func (n *netConns) interrupt() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, conn := range []net.Conn{n.control, n.data} {
+		if conn != nil {
+			_ = conn.SetDeadline(time.Now())
+		}
+	}
+}
+
 type ftpTransput struct {
 	transput.DefaultTransput
 
 	url      string
 	username string
 	password string
-	conn     *ftp.ServerConn
+
+	// idle connections, a connection serves only one transfer at a time
+	lock  sync.Mutex
+	conns []*ftp.ServerConn
+	// netConns of all connections, idle or not
+	netConns map[*ftp.ServerConn]*netConns
+
+	uploadLimiter   *ratelimit.Limiter
+	downloadLimiter *ratelimit.Limiter
+}
+
+func (t *ftpTransput) getConn(ctx context.Context) (*ftp.ServerConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	if num := len(t.conns); num > 0 {
+		conn := t.conns[num-1]
+		t.conns = t.conns[:num-1]
+		t.lock.Unlock()
+		return conn, nil
+	}
+	t.lock.Unlock()
+
+	conn, nc, err := dial(ctx, t.url, t.username, t.password)
+	if err != nil {
+		return nil, err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.netConns == nil {
+		t.netConns = make(map[*ftp.ServerConn]*netConns)
+	}
+	t.netConns[conn] = nc
+	return conn, nil
+}
+
+// putConn gives the connection back for reuse, unless the error shows that
+// the connection itself is broken.
+func (t *ftpTransput) putConn(conn *ftp.ServerConn, err error) {
+	var protoErr *textproto.Error
+	if err != nil && !errors.As(err, &protoErr) {
+		_ = conn.Quit()
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.netConns, conn)
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.conns = append(t.conns, conn)
+}
+
+// interruptOnDone interrupts the transfer by conn once ctx is done, closing
+// the transfer stalled on its data connection. stop must be called once the
+// transfer returns, it returns the error of ctx if the transfer was
+// interrupted, after which conn is broken.
+func (t *ftpTransput) interruptOnDone(ctx context.Context, conn *ftp.ServerConn) (stop func() error) {
+	t.lock.Lock()
+	nc := t.netConns[conn]
+	t.lock.Unlock()
+	if nc == nil {
+		return func() error { return nil }
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.interrupt()
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-interrupted
+	}
+}
+
+// serverPath returns the path on the server of remote, which is either an ftp url or a path.
+func serverPath(remote string) string {
+	parsedURL, err := url.Parse(remote)
+	if err != nil || !strings.EqualFold(parsedURL.Scheme, "ftp") {
+		return remote
+	}
+	return parsedURL.Path
 }
 
 func (t *ftpTransput) UploadDir(ctx context.Context, local, remote string) error {
@@ -51,36 +226,107 @@ func (t *ftpTransput) UploadDir(ctx context.Context, local, remote string) error
 }
 
 func (t *ftpTransput) DownloadDir(ctx context.Context, local, remote string) error {
-	entries, err := t.conn.List(remote)
+	return t.downloadDir(ctx, local, serverPath(remote), "")
+}
+
+// downloadDir downloads remote whose path relative to the downloaded directory
+// is relDir.
+func (t *ftpTransput) downloadDir(ctx context.Context, local, remote, relDir string) error {
+	filter := transput.FilterFrom(ctx)
+	if transput.DirMarkersFrom(ctx) {
+		// the sub directories are always created, only the root may be empty
+		if err := transput.MkdirAll(ctx, local); err != nil {
+			return err
+		}
+	}
+	conn, err := t.getConn(ctx)
 	if err != nil {
-		return err
+		return classifyError(err)
+	}
+	entries, err := conn.List(remote)
+	t.putConn(conn, err)
+	if err != nil {
+		if isNotFoundError(err) {
+			return transput.ClassifyError(transput.NotExistError(remote, err))
+		}
+		return classifyError(err)
 	}
 
+	g := transput.NewGroup(ctx)
 	for _, entry := range entries {
-		srcPath := filepath.Join(local, entry.Name)
+		if entry.Name == "." || entry.Name == ".." {
+			// listed by some servers
+			continue
+		}
+		srcPath, err := transput.JoinLocal(local, entry.Name, path.Join(remote, entry.Name))
+		if err != nil {
+			_ = g.Wait()
+			return err
+		}
 		dstPath := filepath.Join(remote, entry.Name)
 
+		relPath := path.Join(relDir, entry.Name)
+
 		if entry.Type == ftp.EntryTypeFolder {
-			err = os.MkdirAll(srcPath, os.ModePerm)
-			if err != nil {
-				return err
+			if filter.SkipDir(relPath) {
+				continue
 			}
-
-			err = t.DownloadDir(ctx, srcPath, dstPath)
+			err = transput.MkdirAll(ctx, srcPath)
 			if err != nil {
+				_ = g.Wait()
 				return err
 			}
-		} else if entry.Type == ftp.EntryTypeFile {
-			err = t.DownloadFile(ctx, srcPath, dstPath)
+
+			err = t.downloadDir(ctx, srcPath, dstPath, relPath)
 			if err != nil {
+				_ = g.Wait()
 				return err
 			}
+		} else if entry.Type == ftp.EntryTypeFile && filter.Match(relPath) {
+			g.Download(t, srcPath, dstPath)
 		}
 	}
 
+	return g.Wait()
+}
+
+// UploadDirMarker implements transput.DirMarkerUploader, the directory and
+// its parents are created on the server.
+func (t *ftpTransput) UploadDirMarker(ctx context.Context, remote string) error {
+	conn, err := t.getConn(ctx)
+	if err != nil {
+		return classifyError(err)
+	}
+	err = makeDirAll(conn, strings.TrimSuffix(serverPath(remote), "/"))
+	t.putConn(conn, err)
+	return classifyError(err)
+}
+
+// makeDirAll creates dir and its parents, the errors of existing directories
+// are ignored.
+func makeDirAll(conn *ftp.ServerConn, dir string) error {
+	elems := strings.Split(strings.Trim(dir, "/"), "/")
+	var err error
+	for i := range elems {
+		current := strings.Join(elems[:i+1], "/")
+		if strings.HasPrefix(dir, "/") {
+			current = "/" + current
+		}
+		err = conn.MakeDir(current)
+	}
+	if err != nil && !isNotFoundError(err) && !isExistError(err) {
+		return err
+	}
 	return nil
 }
 
+// isExistError reports whether err is the reply of creating an existing
+// directory, most servers reply 550 instead of 521.
+func isExistError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code == 521
+}
+
 func (t *ftpTransput) UploadFile(ctx context.Context, local, remote string) error {
 	file, err := os.Open(local)
 	if err != nil {
@@ -88,36 +334,96 @@ func (t *ftpTransput) UploadFile(ctx context.Context, local, remote string) erro
 	}
 	defer file.Close()
 
-	err = t.conn.Stor(remote, file)
+	conn, err := t.getConn(ctx)
 	if err != nil {
-		return err
+		return classifyError(err)
+	}
+	// the connection is dropped by putConn if the upload is cancelled
+	stop := t.interruptOnDone(ctx, conn)
+	err = conn.Stor(serverPath(remote), t.uploadLimiter.Reader(ctx, transput.NewContextReader(ctx, file)))
+	err = interruptedError(stop(), err)
+	t.putConn(conn, err)
+	if err != nil {
+		return classifyError(err)
 	}
 
 	return nil
 }
 
+// interruptedError returns the error of a transfer by its interrupt error,
+// which breaks the connection even if the transfer succeeded meanwhile.
+func interruptedError(interruptErr, err error) error {
+	if interruptErr == nil {
+		return err
+	}
+	if err == nil {
+		return interruptErr
+	}
+	return fmt.Errorf("%w: %v", interruptErr, err)
+}
+
 func (t *ftpTransput) DownloadFile(ctx context.Context, local, remote string) error {
-	basedir := filepath.Dir(local)
-	if err := os.MkdirAll(basedir, os.FileMode(consts.DefaultFileMode)); err != nil {
-		return fmt.Errorf("failed to mkdir: %w", err)
+	conn, err := t.getConn(ctx)
+	if err != nil {
+		return classifyError(fmt.Errorf("connect error: %w", err))
+	}
+	stop := t.interruptOnDone(ctx, conn)
+	err = t.retrieve(ctx, conn, local, serverPath(remote))
+	err = interruptedError(stop(), err)
+	t.putConn(conn, err)
+	return classifyError(err)
+}
+
+func (t *ftpTransput) retrieve(ctx context.Context, conn *ftp.ServerConn, local, remote string) error {
+	// the size is not checked if the server does not support SIZE
+	size, err := conn.FileSize(remote)
+	if err != nil {
+		size = -1
 	}
 
-	resp, err := t.conn.Retr(remote)
+	resp, err := conn.Retr(remote)
 	if err != nil {
+		if isNotFoundError(err) {
+			return transput.NotExistError(remote, err)
+		}
 		return fmt.Errorf("connect error: %w", err)
 	}
 	defer resp.Close()
 
-	out, err := os.Create(local)
+	out, err := transput.CreateAtomic(ctx, local)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer out.Abort()
 
-	_, err = io.Copy(out, resp)
+	_, err = io.Copy(out, t.downloadLimiter.Reader(ctx, transput.NewContextReader(ctx, resp)))
 	if err != nil {
 		return fmt.Errorf("copy error:%w", err)
 	}
 
-	return nil
+	return out.Commit(size, nil)
+}
+
+func isNotFoundError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code == ftp.StatusFileUnavailable
+}
+
+// classifyError wraps the errors of ftp into the categories of apperror by
+// their reply codes.
+func classifyError(err error) error {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return transput.ClassifyError(err)
+	}
+	switch protoErr.Code {
+	case ftp.StatusNotLoggedIn, ftp.StatusInvalidCredentials, ftp.StatusStorNeedAccount:
+		return apperror.Wrap(apperror.ErrPermissionDenied, err)
+	case ftp.StatusNotAvailable, ftp.StatusCanNotOpenDataConnection, ftp.StatusTransfertAborted,
+		ftp.StatusHostUnavailable, ftp.StatusFileActionIgnored, ftp.StatusActionAborted:
+		return apperror.Wrap(apperror.ErrNetwork, err)
+	case ftp.Status452, ftp.StatusExceededStorage:
+		return apperror.Wrap(apperror.ErrDiskFull, err)
+	}
+	return transput.ClassifyError(err)
 }
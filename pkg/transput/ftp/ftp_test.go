@@ -4,15 +4,62 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/jlaffaye/ftp"
 	"github.com/smartystreets/goconvey/convey"
 )
 
+func TestNewFTPTransput_userInfo(t *testing.T) {
+	tests := []struct {
+		name           string
+		userInfo       *url.Userinfo
+		expectUsername string
+		expectPassword string
+	}{
+		{
+			name:           "configured credentials",
+			expectUsername: "ak",
+			expectPassword: "sk",
+		},
+		{
+			name:           "url credentials",
+			userInfo:       url.UserPassword("user", "secret"),
+			expectUsername: "user",
+			expectPassword: "secret",
+		},
+		{
+			name:           "url username only",
+			userInfo:       url.User("user"),
+			expectUsername: "user",
+			expectPassword: "sk",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			var username, password string
+			patches := gomonkey.ApplyFunc(dial, func(_ context.Context, _, u, p string) (*ftp.ServerConn, *netConns, error) {
+				username, password = u, p
+				return &ftp.ServerConn{}, &netConns{}, nil
+			})
+			defer patches.Reset()
+
+			_, err := NewFTPTransput(&Config{URL: "localhost:21", AccessKey: "ak", SecretKey: "sk"}, tc.userInfo, nil)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(username, convey.ShouldEqual, tc.expectUsername)
+			convey.So(password, convey.ShouldEqual, tc.expectPassword)
+		})
+	}
+}
+
 func TestFtpTransput_UploadFile(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -56,10 +103,15 @@ func TestFtpTransput_UploadFile(t *testing.T) {
 			patch1 := gomonkey.ApplyFuncSeq(os.Open, outputs)
 			defer patch1.Reset()
 
+			conn := &ftp.ServerConn{}
 			ftpTrans := &ftpTransput{
-				conn: &ftp.ServerConn{},
+				conns: []*ftp.ServerConn{conn},
 			}
-			patch2 := gomonkey.ApplyMethod(reflect.TypeOf(ftpTrans.conn), "Stor", func(_ *ftp.ServerConn, _ string, _ io.Reader) error {
+			patchQuit := gomonkey.ApplyMethod(reflect.TypeOf(conn), "Quit", func(_ *ftp.ServerConn) error {
+				return nil
+			})
+			defer patchQuit.Reset()
+			patch2 := gomonkey.ApplyMethod(reflect.TypeOf(conn), "Stor", func(_ *ftp.ServerConn, _ string, _ io.Reader) error {
 				return tc.storErr
 			})
 			defer patch2.Reset()
@@ -77,56 +129,54 @@ func TestFtpTransput_UploadFile(t *testing.T) {
 func TestFtpTransput_DownloadFile(t *testing.T) {
 
 	tests := []struct {
-		name      string
-		local     string
-		remote    string
-		mkdirErr  error
-		retrErr   error
-		createErr error
-		copyErr   error
-		expectErr bool
+		name       string
+		local      string
+		remote     string
+		mkdirErr   error
+		retrErr    error
+		missingDir bool
+		copyErr    error
+		expectErr  bool
 	}{
 		{
 			name:      "failed to mkdir",
-			local:     "/invalid/path/to/localfile",
+			local:     "localfile",
 			remote:    "/path/to/remotefile",
 			mkdirErr:  errors.New("failed to mkdir"),
 			expectErr: true,
 		},
 		{
 			name:      "connect error",
-			local:     "/path/to/localfile",
+			local:     "localfile",
 			remote:    "/path/to/remotefile",
 			mkdirErr:  nil,
 			retrErr:   errors.New("connect error"),
 			expectErr: true,
 		},
 		{
-			name:      "create file error",
-			local:     "/path/to/localfile",
-			remote:    "/path/to/remotefile",
-			mkdirErr:  nil,
-			retrErr:   nil,
-			createErr: errors.New("create file error"),
-			expectErr: true,
+			name:       "create file error",
+			local:      "localfile",
+			remote:     "/path/to/remotefile",
+			mkdirErr:   nil,
+			retrErr:    nil,
+			missingDir: true,
+			expectErr:  true,
 		},
 		{
 			name:      "copy error",
-			local:     "/path/to/localfile",
+			local:     "localfile",
 			remote:    "/path/to/remotefile",
 			mkdirErr:  nil,
 			retrErr:   nil,
-			createErr: nil,
 			copyErr:   errors.New("copy error"),
 			expectErr: true,
 		},
 		{
 			name:      "successful download",
-			local:     "/path/to/localfile",
+			local:     "localfile",
 			remote:    "/path/to/remotefile",
 			mkdirErr:  nil,
 			retrErr:   nil,
-			createErr: nil,
 			copyErr:   nil,
 			expectErr: false,
 		},
@@ -134,9 +184,19 @@ func TestFtpTransput_DownloadFile(t *testing.T) {
 
 	for _, tc := range tests {
 		convey.Convey(tc.name, t, func() {
+			conn := &ftp.ServerConn{}
 			ftpTrans := &ftpTransput{
-				conn: &ftp.ServerConn{},
+				conns: []*ftp.ServerConn{conn},
 			}
+			// os.MkdirAll is patched, the temp file can not be created in a missing dir
+			local := filepath.Join(t.TempDir(), tc.local)
+			if tc.missingDir {
+				local = filepath.Join(t.TempDir(), "missing", tc.local)
+			}
+			patchQuit := gomonkey.ApplyMethod(reflect.TypeOf(conn), "Quit", func(_ *ftp.ServerConn) error {
+				return nil
+			})
+			defer patchQuit.Reset()
 
 			patch1 := gomonkey.ApplyFunc(os.MkdirAll, func(path string, perm os.FileMode) error {
 				return tc.mkdirErr
@@ -150,34 +210,29 @@ func TestFtpTransput_DownloadFile(t *testing.T) {
 			})
 			defer patch6.Reset()
 
-			patch2 := gomonkey.ApplyMethod(reflect.TypeOf(ftpTrans.conn), "Retr", func(_ *ftp.ServerConn, path string) (*ftp.Response, error) {
-				return tempResp, tc.retrErr
+			patchSize := gomonkey.ApplyMethod(reflect.TypeOf(conn), "FileSize", func(_ *ftp.ServerConn, path string) (int64, error) {
+				return 0, nil
 			})
-			defer patch2.Reset()
+			defer patchSize.Reset()
 
-			tempFile := &os.File{}
-
-			patch5 := gomonkey.ApplyMethod(reflect.TypeOf(tempFile), "Close", func(_ *os.File) error {
-				return nil
-			})
-			defer patch5.Reset()
-
-			patch3 := gomonkey.ApplyFunc(os.Create, func(name string) (*os.File, error) {
-				return tempFile, tc.createErr
+			patch2 := gomonkey.ApplyMethod(reflect.TypeOf(conn), "Retr", func(_ *ftp.ServerConn, path string) (*ftp.Response, error) {
+				return tempResp, tc.retrErr
 			})
-			defer patch3.Reset()
+			defer patch2.Reset()
 
 			patch4 := gomonkey.ApplyFunc(io.Copy, func(dst io.Writer, src io.Reader) (int64, error) {
 				return 0, tc.copyErr
 			})
 			defer patch4.Reset()
 
-			err := ftpTrans.DownloadFile(context.Background(), tc.local, tc.remote)
+			err := ftpTrans.DownloadFile(context.Background(), local, tc.remote)
 
 			if tc.expectErr {
 				convey.So(err, convey.ShouldNotBeNil)
 			} else {
 				convey.So(err, convey.ShouldBeNil)
+				_, statErr := os.Stat(local)
+				convey.So(statErr, convey.ShouldBeNil)
 			}
 		})
 	}
@@ -206,11 +261,16 @@ func TestFtpTransput_DownloadDir(t *testing.T) {
 
 	for _, tc := range tests {
 		convey.Convey(tc.name, t, func() {
+			conn := &ftp.ServerConn{}
 			ftpTrans := &ftpTransput{
-				conn: &ftp.ServerConn{},
+				conns: []*ftp.ServerConn{conn},
 			}
+			patchQuit := gomonkey.ApplyMethod(reflect.TypeOf(conn), "Quit", func(_ *ftp.ServerConn) error {
+				return nil
+			})
+			defer patchQuit.Reset()
 
-			patch1 := gomonkey.ApplyMethod(reflect.TypeOf(ftpTrans.conn), "List", func(_ *ftp.ServerConn, _ string) ([]*ftp.Entry, error) {
+			patch1 := gomonkey.ApplyMethod(reflect.TypeOf(conn), "List", func(_ *ftp.ServerConn, _ string) ([]*ftp.Entry, error) {
 				return []*ftp.Entry{
 					{Type: ftp.EntryTypeFile, Name: "file1"},
 				}, nil
@@ -234,3 +294,60 @@ func TestFtpTransput_DownloadDir(t *testing.T) {
 		})
 	}
 }
+
+func TestFtpTransput_interruptOnDone(t *testing.T) {
+	tests := []struct {
+		name string
+		// stalled transfers only return once interrupted
+		stalled         bool
+		expectInterrupt bool
+	}{
+		{
+			name:            "interrupt the stalled transfer",
+			stalled:         true,
+			expectInterrupt: true,
+		},
+		{
+			name: "keep the connection of the finished transfer",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			control, server := net.Pipe()
+			defer server.Close()
+			data, dataServer := net.Pipe()
+			defer dataServer.Close()
+			conn := &ftp.ServerConn{}
+			ftpTrans := &ftpTransput{
+				netConns: map[*ftp.ServerConn]*netConns{conn: {control: control, data: data}},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			stop := ftpTrans.interruptOnDone(ctx, conn)
+			var err error
+			if tc.stalled {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					cancel()
+				}()
+				// the server never sends the content
+				_, err = data.Read(make([]byte, 1))
+			}
+			interruptErr := stop()
+			if tc.expectInterrupt {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(errors.Is(interruptErr, context.Canceled), convey.ShouldBeTrue)
+			} else {
+				convey.So(interruptErr, convey.ShouldBeNil)
+				cancel()
+				go func() {
+					_, _ = server.Write([]byte("220"))
+				}()
+				_, err = control.Read(make([]byte, 3))
+				convey.So(err, convey.ShouldBeNil)
+			}
+		})
+	}
+}
@@ -7,19 +7,21 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"path/filepath"
 
-	"github.com/GBA-BI/tes-filer/pkg/consts"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
 )
 
-func NewHTTPTransput(cfg *Config) (transput.Transput, error) {
+// NewHTTPTransput returns the http transput limited by limits.
+func NewHTTPTransput(cfg *Config, limits *ratelimit.Limits) (transput.Transput, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("nil config of http transput")
 	}
 	return &httpTransput{
-		client:  &http.Client{},
-		headers: cfg.Headers,
+		client:          &http.Client{},
+		headers:         cfg.Headers,
+		uploadLimiter:   limits.Upload(),
+		downloadLimiter: limits.Download(),
 	}, nil
 }
 
@@ -28,7 +30,9 @@ type httpTransput struct {
 
 	headers map[string]string
 
-	client *http.Client
+	client          *http.Client
+	uploadLimiter   *ratelimit.Limiter
+	downloadLimiter *ratelimit.Limiter
 }
 
 func (h *httpTransput) UploadDir(ctx context.Context, local, remote string) error {
@@ -41,10 +45,12 @@ func (h *httpTransput) UploadFile(ctx context.Context, local, remote string) err
 		return err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, remote, bytes.NewReader(fileData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, remote, h.uploadLimiter.Reader(ctx, bytes.NewReader(fileData)))
 	if err != nil {
 		return err
 	}
+	// unknown for the limited reader
+	req.ContentLength = int64(len(fileData))
 
 	for k, v := range h.headers {
 		req.Header.Set(k, v)
@@ -52,23 +58,18 @@ func (h *httpTransput) UploadFile(ctx context.Context, local, remote string) err
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return err
+		return transput.ClassifyError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("upload file error with status code：%d", resp.StatusCode)
+		return transput.ClassifyStatus(resp.StatusCode, fmt.Errorf("upload file error with status code：%d", resp.StatusCode))
 	}
 
 	return nil
 }
 
 func (h *httpTransput) DownloadFile(ctx context.Context, local, remote string) error {
-	basedir := filepath.Dir(local)
-	if err := os.MkdirAll(basedir, os.FileMode(consts.DefaultFileMode)); err != nil {
-		return fmt.Errorf("failed to mkdir: %w", err)
-	}
-
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote, nil)
 	if err != nil {
 		return err
@@ -80,23 +81,28 @@ func (h *httpTransput) DownloadFile(ctx context.Context, local, remote string) e
 
 	resp, err := h.client.Do(req)
 	if err != nil {
-		return err
+		return transput.ClassifyError(err)
 	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return transput.ClassifyError(transput.NotExistError(remote, fmt.Errorf("download file error with status code: %d", resp.StatusCode)))
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download file error with status code: %d", resp.StatusCode)
+		return transput.ClassifyStatus(resp.StatusCode, fmt.Errorf("download file error with status code: %d", resp.StatusCode))
 	}
 
-	out, err := os.OpenFile(local, os.O_CREATE|os.O_WRONLY, os.FileMode(consts.DefaultFileMode))
+	out, err := transput.CreateAtomic(ctx, local)
 	if err != nil {
-		return err
+		return transput.ClassifyError(err)
 	}
-	defer out.Close()
+	defer out.Abort()
 
-	_, err = io.Copy(out, resp.Body)
+	_, err = io.Copy(out, h.downloadLimiter.Reader(ctx, resp.Body))
 	if err != nil {
-		return err
+		return transput.ClassifyError(err)
 	}
 
-	return nil
+	// ContentLength is -1 if unknown, the size is not checked then
+	return transput.ClassifyError(out.Commit(resp.ContentLength, nil))
 }
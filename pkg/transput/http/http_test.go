@@ -3,6 +3,7 @@ package http
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"os"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/transput"
 )
 
 func TestHttpTransput_UploadFile(t *testing.T) {
@@ -72,11 +75,12 @@ func TestHttpTransput_UploadFile(t *testing.T) {
 func TestHttpTransput_DownloadFile(t *testing.T) {
 	localFileName := "http-transput-temp"
 	tests := []struct {
-		name      string
-		local     string
-		remote    string
-		status    int
-		expectErr bool
+		name           string
+		local          string
+		remote         string
+		status         int
+		expectErr      bool
+		expectNotExist bool
 	}{
 		{
 			name:      "successfully download file",
@@ -92,6 +96,14 @@ func TestHttpTransput_DownloadFile(t *testing.T) {
 			status:    http.StatusBadRequest,
 			expectErr: true,
 		},
+		{
+			name:           "remote file not exist",
+			local:          localFileName,
+			remote:         "http://remote.com",
+			status:         http.StatusNotFound,
+			expectErr:      true,
+			expectNotExist: true,
+		},
 	}
 
 	for _, tc := range tests {
@@ -114,6 +126,7 @@ func TestHttpTransput_DownloadFile(t *testing.T) {
 			err := httpTrans.DownloadFile(context.Background(), tc.local, tc.remote)
 			if tc.expectErr {
 				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(errors.Is(err, transput.ErrNotExist), convey.ShouldEqual, tc.expectNotExist)
 			} else {
 				convey.So(err, convey.ShouldBeNil)
 			}
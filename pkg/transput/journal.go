@@ -0,0 +1,43 @@
+package transput
+
+import (
+	"context"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+// Journal remembers the single file transfers already done, so that a
+// restarted filer resumes from where it stopped. It must be safe for
+// concurrent use.
+type Journal interface {
+	// Done reports whether the transfer between local and remote is done and
+	// the local file is unchanged since then.
+	Done(mode consts.TransputMode, local, remote string) bool
+	// Add records the transfer between local and remote as done.
+	Add(mode consts.TransputMode, local, remote string)
+}
+
+type journalCtxKey struct{}
+
+// WithJournal returns a copy of ctx in which the tracked file transfers are
+// skipped if done in journal, and added to it once done.
+func WithJournal(ctx context.Context, journal Journal) context.Context {
+	return context.WithValue(ctx, journalCtxKey{}, journal)
+}
+
+// resume runs fn transferring a single file unless it is done in the journal
+// of ctx, and adds it to the journal on success.
+func resume(ctx context.Context, mode consts.TransputMode, local, remote string, fn func(ctx context.Context) error) error {
+	journal, _ := ctx.Value(journalCtxKey{}).(Journal)
+	if journal == nil {
+		return fn(ctx)
+	}
+	if journal.Done(mode, local, remote) {
+		return nil
+	}
+	if err := fn(ctx); err != nil {
+		return err
+	}
+	journal.Add(mode, local, remote)
+	return nil
+}
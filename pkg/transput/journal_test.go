@@ -0,0 +1,68 @@
+package transput
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+type fakeJournal struct {
+	lock sync.Mutex
+	done map[string]bool
+}
+
+func (f *fakeJournal) Done(_ consts.TransputMode, local, _ string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.done[local]
+}
+
+func (f *fakeJournal) Add(_ consts.TransputMode, local, _ string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.done[local] = true
+}
+
+func TestResumeUploadDir(t *testing.T) {
+	convey.Convey("resume uploading a directory after a failure", t, func() {
+		local := t.TempDir()
+		for _, name := range []string{"a", "b", "c", "d"} {
+			convey.So(os.WriteFile(filepath.Join(local, name), []byte(name), 0644), convey.ShouldBeNil)
+		}
+		transput := &DefaultTransput{}
+		journal := &fakeJournal{done: make(map[string]bool)}
+		ctx := WithJournal(context.Background(), journal)
+
+		var uploaded int64
+		failed := filepath.Join(local, "c")
+		patch := gomonkey.ApplyMethod(reflect.TypeOf(transput), "UploadFile", func(_ *DefaultTransput, _ context.Context, path string, _ string) error {
+			if path == failed {
+				return errors.New("upload error")
+			}
+			atomic.AddInt64(&uploaded, 1)
+			return nil
+		})
+		defer patch.Reset()
+
+		// files are uploaded one by one without engine, it stops at c
+		err := CommonUploadDir(ctx, local, "remote", transput)
+		convey.So(err, convey.ShouldNotBeNil)
+		convey.So(atomic.LoadInt64(&uploaded), convey.ShouldEqual, 2)
+
+		failed = ""
+		err = CommonUploadDir(ctx, local, "remote", transput)
+		convey.So(err, convey.ShouldBeNil)
+		// only c and d are uploaded again
+		convey.So(atomic.LoadInt64(&uploaded), convey.ShouldEqual, 4)
+	})
+}
@@ -0,0 +1,34 @@
+package transput
+
+import (
+	"fmt"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+// UploadPartSize returns the part size of the multipart upload of fileSize,
+// partSize doubled until the parts are within consts.MaxPartNum, so that s3
+// and tos split a huge file the same way. The default part size is used if
+// partSize is not positive, and consts.MaxPartSize if it is larger.
+func UploadPartSize(fileSize, partSize int64) (int64, error) {
+	if partSize <= 0 {
+		partSize = consts.DefaultPartSize
+	}
+	if partSize > consts.MaxPartSize {
+		partSize = consts.MaxPartSize
+	}
+	// ceil divide
+	minimumPartSize := (fileSize-1)/consts.MaxPartNum + 1
+	if minimumPartSize > consts.MaxPartSize {
+		return 0, fmt.Errorf("fileSize too large, fileSize: %d, maximumPartSize: %d, maximumPartNum: %d", fileSize, consts.MaxPartSize, consts.MaxPartNum)
+	}
+	for {
+		if minimumPartSize <= partSize {
+			return partSize, nil
+		}
+		partSize *= 2
+		if partSize > consts.MaxPartSize {
+			return consts.MaxPartSize, nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package transput
+
+import (
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+func TestUploadPartSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileSize int64
+		partSize int64
+		want     int64
+		wantErr  bool
+	}{
+		{
+			name:     "too large",
+			fileSize: consts.MaxPartSize*consts.MaxPartNum + 1,
+			want:     0,
+			wantErr:  true,
+		},
+		{
+			name:     "largest",
+			fileSize: consts.MaxPartSize * consts.MaxPartNum,
+			want:     consts.MaxPartSize,
+			wantErr:  false,
+		},
+		{
+			name:     "larger than default, divide exactly",
+			fileSize: 1024 * 1024 * 1024 * consts.MaxPartNum,
+			want:     1024 * 1024 * 1024,
+			wantErr:  false,
+		},
+		{
+			name:     "larger than default",
+			fileSize: 1025 * 1024 * 1024 * consts.MaxPartNum,
+			want:     2048 * 1024 * 1024,
+			wantErr:  false,
+		},
+		{
+			name:     "default, divide exactly",
+			fileSize: consts.DefaultPartSize * consts.MaxPartNum,
+			want:     consts.DefaultPartSize,
+			wantErr:  false,
+		},
+		{
+			name:     "default part size of zero",
+			fileSize: 300 * 1024 * 1024, // 300MiB
+			partSize: -1,
+			want:     consts.DefaultPartSize,
+			wantErr:  false,
+		},
+		{
+			name:     "default",
+			fileSize: 300 * 1024 * 1024, // 300MiB
+			want:     consts.DefaultPartSize,
+			wantErr:  false,
+		},
+		{
+			name:     "configured part size larger than maximum",
+			fileSize: 300 * 1024 * 1024, // 300MiB
+			partSize: 2 * consts.MaxPartSize,
+			want:     consts.MaxPartSize,
+			wantErr:  false,
+		},
+		{
+			name:     "configured part size larger than maximum, too large",
+			fileSize: consts.MaxPartSize*consts.MaxPartNum + 1,
+			partSize: 2 * consts.MaxPartSize,
+			want:     0,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			defaultPartSize := int64(consts.DefaultPartSize)
+			if tc.partSize != 0 {
+				defaultPartSize = tc.partSize
+			}
+			partSize, err := UploadPartSize(tc.fileSize, defaultPartSize)
+			convey.So(err != nil, convey.ShouldEqual, tc.wantErr)
+			convey.So(partSize, convey.ShouldEqual, tc.want)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package transput
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"time"
+
+	md5checker "github.com/GBA-BI/tes-filer/pkg/checker/md5"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+)
+
+// Record is the result of transferring a single file.
+type Record struct {
+	Mode        consts.TransputMode `json:"mode"`
+	Source      string              `json:"source"`
+	Destination string              `json:"destination"`
+	SizeBytes   int64               `json:"size_bytes"`
+	// Checksum is the hex md5 of the local file, see WithRecordChecksum
+	Checksum        string  `json:"checksum,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Status          string  `json:"status"`
+	ErrorCode       string  `json:"error_code,omitempty"`
+}
+
+// Recorder receives the records of file transfers, it must be safe for
+// concurrent use.
+type Recorder interface {
+	Record(rec *Record)
+}
+
+type recorderCtxKey struct{}
+
+// WithRecorder returns a copy of ctx in which the tracked file transfers are
+// recorded by recorder.
+func WithRecorder(ctx context.Context, recorder Recorder) context.Context {
+	return context.WithValue(ctx, recorderCtxKey{}, recorder)
+}
+
+type recordChecksumCtxKey struct{}
+
+// WithRecordChecksum returns a copy of ctx in which the records of the
+// tracked file transfers carry the md5 of their local files if enabled. Each
+// file is read again after its transfer, holding its slot of the engine.
+func WithRecordChecksum(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, recordChecksumCtxKey{}, enabled)
+}
+
+func recordChecksumFrom(ctx context.Context) bool {
+	enabled, _ := ctx.Value(recordChecksumCtxKey{}).(bool)
+	return enabled
+}
+
+// Report sends rec to the recorder of ctx if any.
+func Report(ctx context.Context, rec *Record) {
+	if recorder, ok := ctx.Value(recorderCtxKey{}).(Recorder); ok && recorder != nil {
+		recorder.Record(rec)
+	}
+}
+
+// NewRecord builds the record of a file transfer between local and remote,
+// the remote is redacted and err decides the status.
+func NewRecord(mode consts.TransputMode, local, remote string, err error) *Record {
+	rec := &Record{
+		Mode:        mode,
+		Source:      redactURL(remote),
+		Destination: local,
+		Status:      consts.ResultStatusSucceeded,
+	}
+	if mode == consts.TransputModeOutputs {
+		rec.Source, rec.Destination = local, redactURL(remote)
+	}
+	if err != nil {
+		rec.Status = consts.ResultStatusFailed
+		rec.ErrorCode = apperror.CodeOf(err)
+	}
+	return rec
+}
+
+// Track runs fn transferring a single file between local and remote, and
+// records its result if ctx has a recorder.
+func Track(ctx context.Context, mode consts.TransputMode, local, remote string, fn func(ctx context.Context) error) error {
+	recorder, _ := ctx.Value(recorderCtxKey{}).(Recorder)
+	if recorder == nil {
+		return fn(ctx)
+	}
+
+	start := time.Now()
+	err := fn(ctx)
+	rec := NewRecord(mode, local, remote, err)
+	rec.DurationSeconds = time.Since(start).Seconds()
+	if err == nil {
+		if info, statErr := os.Stat(local); statErr == nil {
+			rec.SizeBytes = info.Size()
+		}
+		if recordChecksumFrom(ctx) {
+			if sum, sumErr := md5checker.Sum(local); sumErr == nil {
+				rec.Checksum = sum
+			}
+		}
+	}
+	recorder.Record(rec)
+	return err
+}
+
+// RunUpload uploads local to remote by t as a tracked file transfer under
+// the engine of ctx.
+func RunUpload(ctx context.Context, t Transput, local, remote string) error {
+	g := NewGroup(ctx)
+	g.Upload(t, local, remote)
+	return g.Wait()
+}
+
+// RunDownload downloads remote to local by t as a tracked file transfer under
+// the engine of ctx.
+func RunDownload(ctx context.Context, t Transput, local, remote string) error {
+	g := NewGroup(ctx)
+	g.Download(t, local, remote)
+	return g.Wait()
+}
+
+// Upload schedules uploading local to remote by t as a tracked file transfer,
+// which is skipped if done in the journal of ctx.
+func (g *Group) Upload(t Transput, local, remote string) {
+	g.Go(func(ctx context.Context) error {
+		return Track(ctx, consts.TransputModeOutputs, local, remote, func(ctx context.Context) error {
+			return resume(ctx, consts.TransputModeOutputs, local, remote, func(ctx context.Context) error {
+				return t.UploadFile(ctx, local, remote)
+			})
+		})
+	})
+}
+
+// Download schedules downloading remote to local by t as a tracked file transfer,
+// which is skipped if done in the journal of ctx.
+func (g *Group) Download(t Transput, local, remote string) {
+	g.Go(func(ctx context.Context) error {
+		return Track(ctx, consts.TransputModeInputs, local, remote, func(ctx context.Context) error {
+			return resume(ctx, consts.TransputModeInputs, local, remote, func(ctx context.Context) error {
+				return t.DownloadFile(ctx, local, remote)
+			})
+		})
+	})
+}
+
+func redactURL(remote string) string {
+	parsedURL, err := url.Parse(remote)
+	if err != nil || parsedURL.User == nil {
+		return remote
+	}
+	parsedURL.User = nil
+	return parsedURL.String()
+}
@@ -0,0 +1,114 @@
+package transput
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+)
+
+type fakeRecorder struct {
+	lock    sync.Mutex
+	records []*Record
+}
+
+func (f *fakeRecorder) Record(rec *Record) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.records = append(f.records, rec)
+}
+
+func TestTrack(t *testing.T) {
+	tests := []struct {
+		name              string
+		mode              consts.TransputMode
+		remote            string
+		checksum          bool
+		err               error
+		expectSource      string
+		expectDestination string
+		expectStatus      string
+		expectCode        string
+		expectSize        int64
+		expectChecksum    string
+	}{
+		{
+			name:              "download succeeded",
+			mode:              consts.TransputModeInputs,
+			remote:            "s3://ak:sk@bucket/a",
+			checksum:          true,
+			expectSource:      "s3://bucket/a",
+			expectDestination: "local",
+			expectStatus:      consts.ResultStatusSucceeded,
+			expectSize:        13,
+			expectChecksum:    "6cd3556deb0da54bca060b4c39479839",
+		},
+		{
+			name:              "download succeeded without checksum",
+			mode:              consts.TransputModeInputs,
+			remote:            "s3://bucket/a",
+			expectSource:      "s3://bucket/a",
+			expectDestination: "local",
+			expectStatus:      consts.ResultStatusSucceeded,
+			expectSize:        13,
+		},
+		{
+			name:              "upload failed",
+			mode:              consts.TransputModeOutputs,
+			remote:            "s3://bucket/a",
+			err:               apperror.NewPermissionDeniedError("Bucket", "bucket"),
+			expectSource:      "local",
+			expectDestination: "s3://bucket/a",
+			expectStatus:      consts.ResultStatusFailed,
+			expectCode:        "1000004",
+		},
+		{
+			name:              "upload failed without code",
+			mode:              consts.TransputModeOutputs,
+			remote:            "s3://bucket/a",
+			err:               errors.New("connection reset"),
+			expectSource:      "local",
+			expectDestination: "s3://bucket/a",
+			expectStatus:      consts.ResultStatusFailed,
+			expectCode:        "1000001",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			local := filepath.Join(t.TempDir(), "local")
+			convey.So(os.WriteFile(local, []byte("Hello, world!"), 0644), convey.ShouldBeNil)
+			recorder := &fakeRecorder{}
+			ctx := WithRecorder(context.Background(), recorder)
+			ctx = WithRecordChecksum(ctx, tc.checksum)
+
+			err := Track(ctx, tc.mode, local, tc.remote, func(ctx context.Context) error {
+				return tc.err
+			})
+			convey.So(err, convey.ShouldEqual, tc.err)
+			convey.So(len(recorder.records), convey.ShouldEqual, 1)
+
+			rec := recorder.records[0]
+			source, destination := rec.Source, rec.Destination
+			if source == local {
+				source = "local"
+			}
+			if destination == local {
+				destination = "local"
+			}
+			convey.So(source, convey.ShouldEqual, tc.expectSource)
+			convey.So(destination, convey.ShouldEqual, tc.expectDestination)
+			convey.So(rec.Status, convey.ShouldEqual, tc.expectStatus)
+			convey.So(rec.ErrorCode, convey.ShouldEqual, tc.expectCode)
+			convey.So(rec.SizeBytes, convey.ShouldEqual, tc.expectSize)
+			convey.So(rec.Checksum, convey.ShouldEqual, tc.expectChecksum)
+		})
+	}
+}
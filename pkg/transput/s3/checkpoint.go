@@ -0,0 +1,379 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/sync/errgroup"
+
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
+)
+
+// checkpointExpiration is the age after which a checkpoint is not resumed, the
+// upload it records is aborted as abandoned.
+const checkpointExpiration = 7 * 24 * time.Hour
+
+// uploadCheckpoint records a multipart upload in progress, the parts already
+// uploaded are listed from the server when resuming.
+type uploadCheckpoint struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	// Size, ModTime and PartSize must be the same to resume, the local file is
+	// changed otherwise.
+	Size      int64     `json:"size"`
+	ModTime   int64     `json:"mod_time"`
+	PartSize  int64     `json:"part_size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c *uploadCheckpoint) matches(bucket, key string, info os.FileInfo, partSize int64) bool {
+	return c.Bucket == bucket && c.Key == key && c.UploadID != "" &&
+		c.Size == info.Size() && c.ModTime == info.ModTime().UnixNano() && c.PartSize == partSize &&
+		time.Since(c.CreatedAt) < checkpointExpiration
+}
+
+// downloadCheckpoint records the parts already written to the temp file of a
+// ranged download.
+type downloadCheckpoint struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	// ETag, Size and PartSize must be the same to resume, the object is
+	// overwritten otherwise.
+	ETag      string    `json:"etag"`
+	Size      int64     `json:"size"`
+	PartSize  int64     `json:"part_size"`
+	Done      []bool    `json:"done"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c *downloadCheckpoint) matches(bucket, key, etag string, size, partSize int64) bool {
+	return c.Bucket == bucket && c.Key == key && c.ETag == etag &&
+		c.Size == size && c.PartSize == partSize && len(c.Done) == partCount(size, partSize) &&
+		time.Since(c.CreatedAt) < checkpointExpiration
+}
+
+// checkpointPath returns the checkpoint in dir of the transfer between local
+// and the object, kind is upload or download.
+func checkpointPath(dir, kind, bucket, key, local string) string {
+	if abs, err := filepath.Abs(local); err == nil {
+		local = abs
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{bucket, key, local}, "\n")))
+	return filepath.Join(dir, fmt.Sprintf("%s.%s.json", hex.EncodeToString(sum[:16]), kind))
+}
+
+// loadCheckpoint reports whether the checkpoint of path is read into cp, a
+// missing or corrupted one is not resumed.
+func loadCheckpoint(path string, cp interface{}) bool {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(content, cp) == nil
+}
+
+// saveCheckpoint writes cp to path by renaming, so that a crash never leaves a
+// partial checkpoint.
+func saveCheckpoint(path string, cp interface{}) error {
+	content, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, content, 0600); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return fmt.Errorf("failed to rename checkpoint: %w", err)
+	}
+	return nil
+}
+
+// resumable reports whether the transfer failed by err is kept for the next
+// attempt, the other failures would fail again.
+func resumable(err error) bool {
+	switch apperror.CodeOf(classifyError(err)) {
+	case fmt.Sprintf("%d", apperror.ErrCancelled), fmt.Sprintf("%d", apperror.ErrNetwork),
+		fmt.Sprintf("%d", apperror.ErrRateLimited), fmt.Sprintf("%d", apperror.ErrDiskFull):
+		return true
+	}
+	return false
+}
+
+func partCount(size, partSize int64) int {
+	return int((size + partSize - 1) / partSize)
+}
+
+// partRange returns the offset and length of the part of index, from 0.
+func partRange(index int, size, partSize int64) (int64, int64) {
+	offset := int64(index) * partSize
+	length := partSize
+	if offset+length > size {
+		length = size - offset
+	}
+	return offset, length
+}
+
+// uploadResumable uploads file in parts of partSize, the upload is recorded by the
+// checkpoint in dir so that the parts already on the server are not uploaded
+// again by the next attempt, even of a restarted filer. The upload is aborted
+// if it fails for good.
+func (t *s3Transput) uploadResumable(ctx context.Context, dir string, file *os.File, info os.FileInfo, bucket, key string, partSize int64) error {
+	cpPath := checkpointPath(dir, "upload", bucket, key, file.Name())
+	cp := &uploadCheckpoint{}
+	uploaded := make(map[int64]*s3.Part)
+	if loadCheckpoint(cpPath, cp) {
+		if !cp.matches(bucket, key, info, partSize) {
+			// abandoned, the file is changed or the checkpoint expired
+			t.abortMultipartUpload(cp.Bucket, cp.Key, cp.UploadID)
+			cp.UploadID = ""
+		} else {
+			parts, err := t.listParts(ctx, cp)
+			switch {
+			case err == nil:
+				uploaded = parts
+			case isNoSuchUploadError(err):
+				// aborted by the lifecycle of the bucket
+				cp.UploadID = ""
+			default:
+				return err
+			}
+		}
+	}
+	if cp.UploadID == "" {
+		output, err := t.client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			Metadata: aws.StringMap(transput.FileMeta(info)),
+		})
+		if err != nil {
+			return err
+		}
+		cp = &uploadCheckpoint{
+			Bucket:    bucket,
+			Key:       key,
+			UploadID:  aws.StringValue(output.UploadId),
+			Size:      info.Size(),
+			ModTime:   info.ModTime().UnixNano(),
+			PartSize:  partSize,
+			CreatedAt: time.Now(),
+		}
+		if err := saveCheckpoint(cpPath, cp); err != nil {
+			t.abortMultipartUpload(bucket, key, aws.StringValue(output.UploadId))
+			return err
+		}
+	}
+
+	err := t.uploadParts(ctx, file, cp, uploaded)
+	if err == nil {
+		_ = os.Remove(cpPath)
+		return nil
+	}
+	if !resumable(err) {
+		t.abortMultipartUpload(bucket, key, cp.UploadID)
+		_ = os.Remove(cpPath)
+	}
+	return err
+}
+
+// listParts returns the parts of the upload of cp by part number.
+func (t *s3Transput) listParts(ctx context.Context, cp *uploadCheckpoint) (map[int64]*s3.Part, error) {
+	res := make(map[int64]*s3.Part)
+	err := t.client.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String(cp.Bucket),
+		Key:      aws.String(cp.Key),
+		UploadId: aws.String(cp.UploadID),
+	}, func(output *s3.ListPartsOutput, _ bool) bool {
+		for _, part := range output.Parts {
+			if part != nil {
+				res[aws.Int64Value(part.PartNumber)] = part
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// uploadParts uploads the parts of file missing in uploaded and completes the
+// upload of cp.
+func (t *s3Transput) uploadParts(ctx context.Context, file *os.File, cp *uploadCheckpoint, uploaded map[int64]*s3.Part) error {
+	completed := make([]*s3.CompletedPart, partCount(cp.Size, cp.PartSize))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(t.taskNum)
+	for i := range completed {
+		i := i
+		offset, length := partRange(i, cp.Size, cp.PartSize)
+		partNumber := int64(i + 1)
+		// the parts of other sizes are uploaded again
+		if part, ok := uploaded[partNumber]; ok && aws.Int64Value(part.Size) == length {
+			completed[i] = &s3.CompletedPart{ETag: part.ETag, PartNumber: aws.Int64(partNumber)}
+			continue
+		}
+		g.Go(func() error {
+			output, err := t.client.UploadPartWithContext(gctx, &s3.UploadPartInput{
+				Bucket:        aws.String(cp.Bucket),
+				Key:           aws.String(cp.Key),
+				UploadId:      aws.String(cp.UploadID),
+				PartNumber:    aws.Int64(partNumber),
+				Body:          io.NewSectionReader(file, offset, length),
+				ContentLength: aws.Int64(length),
+			})
+			if err != nil {
+				return err
+			}
+			completed[i] = &s3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(partNumber)}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	_, err := t.client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(cp.Bucket),
+		Key:             aws.String(cp.Key),
+		UploadId:        aws.String(cp.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+// downloadResumable downloads the object of head by ranged parts into the temp
+// file of local, the parts written are recorded by the checkpoint in dir so
+// that the next attempt, even of a restarted filer, only downloads the others.
+// The temp file is removed if the download fails for good.
+func (t *s3Transput) downloadResumable(ctx context.Context, dir, local, bucket, key string, head *s3.HeadObjectOutput) error {
+	size := aws.Int64Value(head.ContentLength)
+	etag := aws.StringValue(head.ETag)
+	cpPath := checkpointPath(dir, "download", bucket, key, local)
+	cp := &downloadCheckpoint{}
+	resume := loadCheckpoint(cpPath, cp) && cp.matches(bucket, key, etag, size, t.partSize)
+
+	file, err := transput.OpenAtomic(ctx, local)
+	if err != nil {
+		return err
+	}
+	if resume {
+		// the temp file is removed by others, e.g. a failed download without checkpoint
+		if info, err := file.Stat(); err != nil || info.Size() != size {
+			resume = false
+		}
+	}
+	if !resume {
+		cp = &downloadCheckpoint{
+			Bucket:    bucket,
+			Key:       key,
+			ETag:      etag,
+			Size:      size,
+			PartSize:  t.partSize,
+			Done:      make([]bool, partCount(size, t.partSize)),
+			CreatedAt: time.Now(),
+		}
+		if err := resetFile(file.File, size); err != nil {
+			file.Abort()
+			return err
+		}
+		// saved after the reset, so that the done parts are always in the temp file
+		if err := saveCheckpoint(cpPath, cp); err != nil {
+			file.Abort()
+			return err
+		}
+	}
+	file.SetMeta(aws.StringValueMap(head.Metadata))
+
+	if err := t.downloadParts(ctx, file.File, cp, cpPath); err != nil {
+		if resumable(err) {
+			_ = file.Close()
+		} else {
+			file.Abort()
+			_ = os.Remove(cpPath)
+		}
+		return err
+	}
+	_ = os.Remove(cpPath)
+	return file.Commit(size, etagChecker(head))
+}
+
+// resetFile empties file and extends it to size, so that the parts are written at their offsets.
+func resetFile(file *os.File, size int64) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate download file: %w", err)
+	}
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate download file: %w", err)
+	}
+	return nil
+}
+
+// downloadParts downloads the parts of cp not done into file, the checkpoint
+// of cpPath is saved once a part is synced.
+func (t *s3Transput) downloadParts(ctx context.Context, file *os.File, cp *downloadCheckpoint, cpPath string) error {
+	var lock sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(t.taskNum)
+	for i, done := range cp.Done {
+		if done {
+			continue
+		}
+		i := i
+		offset, length := partRange(i, cp.Size, cp.PartSize)
+		g.Go(func() error {
+			if err := t.downloadPart(gctx, file, cp, offset, length); err != nil {
+				return err
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			cp.Done[i] = true
+			return saveCheckpoint(cpPath, cp)
+		})
+	}
+	return g.Wait()
+}
+
+// downloadPart downloads the range of offset and length into file and syncs it.
+func (t *s3Transput) downloadPart(ctx context.Context, file *os.File, cp *downloadCheckpoint, offset, length int64) error {
+	output, err := t.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(cp.Bucket),
+		Key:    aws.String(cp.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+		// fails if the object is overwritten meanwhile
+		IfMatch: aws.String(cp.ETag),
+	})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+	written, err := io.Copy(io.NewOffsetWriter(file, offset), output.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download part at %d: %w", offset, err)
+	}
+	if written != length {
+		return fmt.Errorf("part at %d has %d bytes, expected %d: %w", offset, written, length, io.ErrUnexpectedEOF)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync download file: %w", err)
+	}
+	return nil
+}
+
+func isNoSuchUploadError(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchUpload
+}
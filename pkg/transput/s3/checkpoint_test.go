@@ -0,0 +1,278 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/smartystreets/goconvey/convey"
+
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
+)
+
+func TestS3Transput_UploadFile_resume(t *testing.T) {
+	tests := []struct {
+		name string
+		// uploadedParts are uploaded by the previous attempt recorded in the checkpoint
+		uploadedParts []int64
+		// changed modifies the file after the previous attempt
+		changed bool
+		// corrupt garbles the parts done of the previous attempt
+		corrupt         bool
+		status          int
+		code            string
+		expectCode      string
+		expectParts     []string
+		expectAborted   bool
+		expectPending   int
+		expectRemaining bool
+	}{
+		{
+			name:        "no checkpoint",
+			expectParts: []string{"PUT /bucket/uploaded part 1", "PUT /bucket/uploaded part 2", "PUT /bucket/uploaded part 3"},
+		},
+		{
+			name:          "resume the listed parts",
+			uploadedParts: []int64{1, 2},
+			expectParts:   []string{"PUT /bucket/uploaded part 3"},
+		},
+		{
+			name:          "abort the upload of a changed file",
+			uploadedParts: []int64{1, 2},
+			changed:       true,
+			expectParts:   []string{"PUT /bucket/uploaded part 1", "PUT /bucket/uploaded part 2", "PUT /bucket/uploaded part 3"},
+			expectAborted: true,
+		},
+		{
+			name:            "keep the upload failed by the network",
+			status:          http.StatusInternalServerError,
+			code:            "InternalError",
+			expectCode:      "1000007",
+			expectPending:   1,
+			expectRemaining: true,
+		},
+		{
+			name:          "abort the upload failed for good",
+			status:        http.StatusForbidden,
+			code:          "AccessDenied",
+			expectCode:    "1000004",
+			expectAborted: true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			content := []byte("hello world!")
+			fake := &fakeS3{objects: make(map[string][]byte)}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			trans, err := newFakeS3Transput(t, server.URL, 0)
+			convey.So(err, convey.ShouldBeNil)
+			trans.partSize = 4
+
+			dir := t.TempDir()
+			checkpointDir := filepath.Join(dir, "checkpoints")
+			local := filepath.Join(dir, "local")
+			convey.So(os.WriteFile(local, content, 0644), convey.ShouldBeNil)
+			cpPath := checkpointPath(checkpointDir, "upload", "bucket", "uploaded", local)
+			if tc.uploadedParts != nil {
+				output, err := trans.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+					Bucket: aws.String("bucket"),
+					Key:    aws.String("uploaded"),
+				})
+				convey.So(err, convey.ShouldBeNil)
+				for _, partNumber := range tc.uploadedParts {
+					offset, length := partRange(int(partNumber-1), int64(len(content)), trans.partSize)
+					_, err = trans.client.UploadPart(&s3.UploadPartInput{
+						Bucket:     aws.String("bucket"),
+						Key:        aws.String("uploaded"),
+						UploadId:   output.UploadId,
+						PartNumber: aws.Int64(partNumber),
+						Body:       bytes.NewReader(content[offset : offset+length]),
+					})
+					convey.So(err, convey.ShouldBeNil)
+				}
+				info, err := os.Stat(local)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(os.MkdirAll(checkpointDir, 0700), convey.ShouldBeNil)
+				convey.So(saveCheckpoint(cpPath, &uploadCheckpoint{
+					Bucket:    "bucket",
+					Key:       "uploaded",
+					UploadID:  aws.StringValue(output.UploadId),
+					Size:      info.Size(),
+					ModTime:   info.ModTime().UnixNano(),
+					PartSize:  trans.partSize,
+					CreatedAt: time.Now(),
+				}), convey.ShouldBeNil)
+			}
+			if tc.changed {
+				content = []byte("HELLO WORLD!")
+				convey.So(os.WriteFile(local, content, 0644), convey.ShouldBeNil)
+				convey.So(os.Chtimes(local, time.Now(), time.Now().Add(time.Hour)), convey.ShouldBeNil)
+			}
+			if tc.status != 0 {
+				fake.lock.Lock()
+				fake.methods = []string{http.MethodPut}
+				fake.throttled = 100
+				fake.status = tc.status
+				fake.code = tc.code
+				fake.lock.Unlock()
+			}
+			servedParts := len(fake.servedOf("PUT"))
+
+			ctx := transput.WithCheckpointDir(context.Background(), checkpointDir)
+			err = trans.UploadFile(ctx, local, "s3://bucket/uploaded")
+			if tc.expectCode != "" {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(apperror.CodeOf(err), convey.ShouldEqual, tc.expectCode)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(fake.object("/bucket/uploaded"), convey.ShouldResemble, content)
+				parts := fake.servedOf("PUT")[servedParts:]
+				sort.Strings(parts)
+				convey.So(parts, convey.ShouldResemble, tc.expectParts)
+			}
+			convey.So(len(fake.servedOf("DELETE")) > 0, convey.ShouldEqual, tc.expectAborted)
+			convey.So(fake.pendingUploads(), convey.ShouldEqual, tc.expectPending)
+			_, err = os.Stat(cpPath)
+			convey.So(err == nil, convey.ShouldEqual, tc.expectRemaining)
+		})
+	}
+}
+
+func TestS3Transput_DownloadFile_resume(t *testing.T) {
+	tests := []struct {
+		name string
+		// done are the parts written by the previous attempt recorded in the checkpoint
+		done []bool
+		// changed overwrites the object after the previous attempt
+		changed bool
+		// corrupt garbles the parts done by the previous attempt
+		corrupt         bool
+		status          int
+		code            string
+		expectCode      string
+		expectRanges    []string
+		expectRemaining bool
+	}{
+		{
+			name:         "no checkpoint",
+			expectRanges: []string{"GET /bucket/remote bytes=0-3", "GET /bucket/remote bytes=4-7", "GET /bucket/remote bytes=8-11"},
+		},
+		{
+			name:         "resume the parts not done",
+			done:         []bool{true, true, false},
+			expectRanges: []string{"GET /bucket/remote bytes=8-11"},
+		},
+		{
+			name:         "restart the download of a changed object",
+			done:         []bool{true, true, false},
+			changed:      true,
+			expectRanges: []string{"GET /bucket/remote bytes=0-3", "GET /bucket/remote bytes=4-7", "GET /bucket/remote bytes=8-11"},
+		},
+		{
+			name:       "verify the resumed parts against the etag",
+			done:       []bool{true, true, false},
+			corrupt:    true,
+			expectCode: "1000001",
+		},
+		{
+			name:            "keep the parts failed by the network",
+			done:            []bool{true, false, false},
+			status:          http.StatusInternalServerError,
+			code:            "InternalError",
+			expectCode:      "1000007",
+			expectRemaining: true,
+		},
+		{
+			name:       "remove the parts failed for good",
+			done:       []bool{true, false, false},
+			status:     http.StatusForbidden,
+			code:       "AccessDenied",
+			expectCode: "1000004",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			content := []byte("hello world!")
+			fake := &fakeS3{objects: map[string][]byte{"/bucket/remote": content}}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			trans, err := newFakeS3Transput(t, server.URL, 0)
+			convey.So(err, convey.ShouldBeNil)
+			trans.partSize = 4
+
+			dir := t.TempDir()
+			checkpointDir := filepath.Join(dir, "checkpoints")
+			local := filepath.Join(dir, "local")
+			cpPath := checkpointPath(checkpointDir, "download", "bucket", "remote", local)
+			if tc.done != nil {
+				// the parts done are in the temp file, the others are not written yet
+				partial := make([]byte, len(content))
+				for i, done := range tc.done {
+					if done {
+						offset, length := partRange(i, int64(len(content)), trans.partSize)
+						copy(partial[offset:offset+length], content[offset:offset+length])
+						if tc.corrupt {
+							partial[offset] ^= 0xff
+						}
+					}
+				}
+				convey.So(os.WriteFile(transput.TempPath(local), partial, 0644), convey.ShouldBeNil)
+				convey.So(os.MkdirAll(checkpointDir, 0700), convey.ShouldBeNil)
+				convey.So(saveCheckpoint(cpPath, &downloadCheckpoint{
+					Bucket:    "bucket",
+					Key:       "remote",
+					ETag:      etagOf(content),
+					Size:      int64(len(content)),
+					PartSize:  trans.partSize,
+					Done:      tc.done,
+					CreatedAt: time.Now(),
+				}), convey.ShouldBeNil)
+			}
+			if tc.changed {
+				content = []byte("HELLO WORLD!")
+				fake.lock.Lock()
+				fake.objects["/bucket/remote"] = content
+				fake.lock.Unlock()
+			}
+			if tc.status != 0 {
+				fake.lock.Lock()
+				fake.methods = []string{http.MethodGet}
+				fake.throttled = 100
+				fake.status = tc.status
+				fake.code = tc.code
+				fake.lock.Unlock()
+			}
+
+			ctx := transput.WithCheckpointDir(context.Background(), checkpointDir)
+			err = trans.DownloadFile(ctx, local, "s3://bucket/remote")
+			if tc.expectCode != "" {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(apperror.CodeOf(err), convey.ShouldEqual, tc.expectCode)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				res, err := os.ReadFile(local)
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(res, convey.ShouldResemble, content)
+				ranges := fake.servedOf("GET")
+				sort.Strings(ranges)
+				convey.So(ranges, convey.ShouldResemble, tc.expectRanges)
+			}
+			_, err = os.Stat(cpPath)
+			convey.So(err == nil, convey.ShouldEqual, tc.expectRemaining)
+			_, err = os.Stat(transput.TempPath(local))
+			convey.So(err == nil, convey.ShouldEqual, tc.expectRemaining)
+		})
+	}
+}
@@ -1,26 +1,27 @@
 package s3
 
 import (
-	"context"
-	"io"
+	"errors"
 	"net/http"
-	"sync"
 
-	"golang.org/x/time/rate"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
+	utilsstrings "github.com/GBA-BI/tes-filer/pkg/utils/strings"
 )
 
+// rateLimitingTransport limits the bodies of the requests by the upload
+// limiter and the bodies of the responses by the download limiter.
 type rateLimitingTransport struct {
-	upLimiter   *rate.Limiter
-	downLimiter *rate.Limiter
+	upLimiter   *ratelimit.Limiter
+	downLimiter *ratelimit.Limiter
 	transport   http.RoundTripper
 }
 
 func (t *rateLimitingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if req.Body != nil {
-		req.Body = &readLimiter{
-			reader:  req.Body,
-			limiter: t.upLimiter,
-		}
+		req.Body = t.upLimiter.ReadCloser(req.Context(), req.Body)
 	}
 
 	resp, err := t.transport.RoundTrip(req)
@@ -28,42 +29,36 @@ func (t *rateLimitingTransport) RoundTrip(req *http.Request) (*http.Response, er
 		return nil, err
 	}
 
-	resp.Body = &readLimiter{
-		reader:  resp.Body,
-		limiter: t.downLimiter,
-	}
-
+	resp.Body = t.downLimiter.ReadCloser(req.Context(), resp.Body)
 	return resp, nil
 }
 
-type readLimiter struct {
-	reader  io.ReadCloser
-	limiter *rate.Limiter
-	mu      sync.RWMutex
+// throttleErrCodes are the codes of the throttling errors of aws s3 and the
+// compatible storages, e.g. minio and ceph.
+var throttleErrCodes = []string{
+	"SlowDown", "Throttling", "ThrottlingException", "ThrottledException", "RequestThrottled",
+	"RequestLimitExceeded", "TooManyRequests", "TooManyRequestsException", "ServiceUnavailable",
 }
 
-func (r *readLimiter) Read(p []byte) (int, error) {
-	n, err := r.reader.Read(p)
-	if err != nil {
-		return n, err
+// isThrottleError reports whether err is the throttling of the server, by the
+// code or the 429/503 status of the aws error or of its cause, e.g. the failed
+// part of a multipart upload.
+func isThrottleError(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
 	}
-
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	if err := r.limiter.WaitN(context.TODO(), n); err != nil {
-		return 0, err
+	for awsErr != nil {
+		if utilsstrings.Contains(consts.ErrCodeRateLimitList, awsErr.Code()) || utilsstrings.Contains(throttleErrCodes, awsErr.Code()) {
+			return true
+		}
+		if reqErr, ok := awsErr.(awserr.RequestFailure); ok {
+			switch reqErr.StatusCode() {
+			case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				return true
+			}
+		}
+		awsErr, _ = awsErr.OrigErr().(awserr.Error)
 	}
-
-	return n, nil
-}
-
-func (r *readLimiter) Close() error {
-	return r.reader.Close()
-}
-
-func (r *readLimiter) UpdateRateLimit(newRate int64) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.limiter.SetLimit(rate.Limit(newRate))
+	return false
 }
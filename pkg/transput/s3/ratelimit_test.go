@@ -0,0 +1,480 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
+)
+
+// fakeS3 is a local s3 endpoint keeping the objects and multipart uploads in
+// memory, the first throttled requests of methods to each object are answered
+// with status and code. It is safe for parallel requests.
+type fakeS3 struct {
+	lock      sync.Mutex
+	objects   map[string][]byte
+	methods   []string
+	throttled int
+	status    int
+	code      string
+	// requests counts the throttled requests by method and object
+	requests map[string]int
+	uploads  map[string]*fakeUpload
+	// served lists the requests served, with the part number or range if any
+	served []string
+}
+
+type fakeUpload struct {
+	path  string
+	parts map[int][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.throttle(r) {
+		f.writeError(w, f.status, f.code)
+		return
+	}
+	served := r.Method + " " + r.URL.Path
+	if part := r.URL.Query().Get("partNumber"); part != "" {
+		served += " part " + part
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		served += " " + rng
+	}
+	f.served = append(f.served, served)
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.createUpload(w, r)
+	case query.Get("uploadId") != "":
+		f.serveUpload(w, r, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[r.URL.Path] = body
+		w.Header().Set("ETag", etagOf(body))
+	case r.Method == http.MethodHead, r.Method == http.MethodGet:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etagOf(body))
+		status := http.StatusOK
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			if end >= len(body) {
+				end = len(body) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+			body = body[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) createUpload(w http.ResponseWriter, r *http.Request) {
+	if f.uploads == nil {
+		f.uploads = make(map[string]*fakeUpload)
+	}
+	uploadID := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+	f.uploads[uploadID] = &fakeUpload{path: r.URL.Path, parts: make(map[int][]byte)}
+	_, _ = fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, uploadID)
+}
+
+func (f *fakeS3) serveUpload(w http.ResponseWriter, r *http.Request, uploadID string) {
+	upload, ok := f.uploads[uploadID]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		upload.parts[partNumber] = body
+		w.Header().Set("ETag", etagOf(body))
+	case http.MethodGet:
+		var parts strings.Builder
+		for _, partNumber := range upload.partNumbers() {
+			body := upload.parts[partNumber]
+			_, _ = fmt.Fprintf(&parts, `<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>`,
+				partNumber, html.EscapeString(etagOf(body)), len(body))
+		}
+		_, _ = fmt.Fprintf(w, `<ListPartsResult><UploadId>%s</UploadId><IsTruncated>false</IsTruncated>%s</ListPartsResult>`,
+			uploadID, parts.String())
+	case http.MethodPost:
+		var content []byte
+		for _, partNumber := range upload.partNumbers() {
+			content = append(content, upload.parts[partNumber]...)
+		}
+		f.objects[upload.path] = content
+		delete(f.uploads, uploadID)
+		_, _ = fmt.Fprintf(w, `<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>`,
+			html.EscapeString(etagOf(content)))
+	case http.MethodDelete:
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (u *fakeUpload) partNumbers() []int {
+	var res []int
+	for partNumber := range u.parts {
+		res = append(res, partNumber)
+	}
+	sort.Ints(res)
+	return res
+}
+
+func etagOf(body []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(body))
+}
+
+// throttle reports whether r is one of the first throttled requests of its
+// method to its object.
+func (f *fakeS3) throttle(r *http.Request) bool {
+	for _, method := range f.methods {
+		if r.Method != method {
+			continue
+		}
+		if f.requests == nil {
+			f.requests = make(map[string]int)
+		}
+		key := r.Method + " " + r.URL.Path
+		if f.requests[key] >= f.throttled {
+			return false
+		}
+		f.requests[key]++
+		return true
+	}
+	return false
+}
+
+// object returns the content of the object of path.
+func (f *fakeS3) object(path string) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.objects[path]
+}
+
+// servedOf returns the requests served whose description starts with prefix.
+func (f *fakeS3) servedOf(prefix string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var res []string
+	for _, served := range f.served {
+		if strings.HasPrefix(served, prefix) {
+			res = append(res, served)
+		}
+	}
+	return res
+}
+
+// pendingUploads returns the number of multipart uploads neither completed nor aborted.
+func (f *fakeS3) pendingUploads() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.uploads)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func newFakeS3Transput(t *testing.T, endpoint string, maxBandwidth int64) (*s3Transput, error) {
+	// the sdk can not load a custom ca bundle into the rate limiting transport
+	t.Setenv("AWS_CA_BUNDLE", "")
+	cfg := &Config{}
+	cfg.Endpoint = endpoint
+	cfg.Region = "us-east-1"
+	cfg.ForcePathStyle = true
+	cfg.MaxBandwidth = maxBandwidth
+	// one retry of the sdk, so that the throttle is seen after two requests
+	cfg.MaxRetryCount = 1
+	trans, err := NewS3Transput(cfg, url.UserPassword("ak", "sk"), nil)
+	if err != nil {
+		return nil, err
+	}
+	return trans.(*s3Transput), nil
+}
+
+// shortenThrottleBackoff shortens the backoff of the throttled transfers
+// until the returned func restores it.
+func shortenThrottleBackoff() func() {
+	backoff := throttleBackoff
+	throttleBackoff = ratelimit.Backoff{Base: time.Millisecond, Max: 10 * time.Millisecond}
+	return func() {
+		throttleBackoff = backoff
+	}
+}
+
+func TestS3Transput_throttle(t *testing.T) {
+	defer shortenThrottleBackoff()()
+	tests := []struct {
+		name            string
+		download        bool
+		maxBandwidth    int64
+		method          string
+		status          int
+		code            string
+		expectCode      string
+		expectBandwidth int64
+	}{
+		{
+			name:            "upload slowed down",
+			maxBandwidth:    8 * consts.DefaultMinBandwidth,
+			method:          http.MethodPut,
+			status:          http.StatusServiceUnavailable,
+			code:            "SlowDown",
+			expectBandwidth: 4 * consts.DefaultMinBandwidth,
+		},
+		{
+			name:            "download slowed down by too many requests",
+			download:        true,
+			maxBandwidth:    8 * consts.DefaultMinBandwidth,
+			method:          http.MethodGet,
+			status:          http.StatusTooManyRequests,
+			code:            "TooManyRequests",
+			expectBandwidth: 4 * consts.DefaultMinBandwidth,
+		},
+		{
+			name:            "throttled by status only",
+			maxBandwidth:    8 * consts.DefaultMinBandwidth,
+			method:          http.MethodPut,
+			status:          http.StatusServiceUnavailable,
+			code:            "Unavailable",
+			expectBandwidth: 4 * consts.DefaultMinBandwidth,
+		},
+		{
+			name:            "not throttled",
+			maxBandwidth:    8 * consts.DefaultMinBandwidth,
+			method:          http.MethodPut,
+			status:          http.StatusForbidden,
+			code:            "AccessDenied",
+			expectCode:      "1000004",
+			expectBandwidth: 8 * consts.DefaultMinBandwidth,
+		},
+		{
+			name:            "throttled at the minimum bandwidth",
+			maxBandwidth:    consts.DefaultMinBandwidth,
+			method:          http.MethodPut,
+			status:          http.StatusServiceUnavailable,
+			code:            "SlowDown",
+			expectCode:      "1000006",
+			expectBandwidth: consts.DefaultMinBandwidth,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			content := []byte("hello world")
+			fake := &fakeS3{
+				objects:   map[string][]byte{"/bucket/remote": content},
+				methods:   []string{tc.method},
+				throttled: 2,
+				status:    tc.status,
+				code:      tc.code,
+			}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			trans, err := newFakeS3Transput(t, server.URL, tc.maxBandwidth)
+			convey.So(err, convey.ShouldBeNil)
+
+			dir := t.TempDir()
+			if tc.download {
+				local := filepath.Join(dir, "local")
+				err = trans.DownloadFile(context.Background(), local, "s3://bucket/remote")
+				if err == nil {
+					res, readErr := os.ReadFile(local)
+					convey.So(readErr, convey.ShouldBeNil)
+					convey.So(res, convey.ShouldResemble, content)
+				}
+			} else {
+				local := filepath.Join(dir, "local")
+				convey.So(os.WriteFile(local, content, 0644), convey.ShouldBeNil)
+				err = trans.UploadFile(context.Background(), local, "s3://bucket/uploaded")
+				if err == nil {
+					// the retry uploads the whole file again
+					convey.So(fake.object("/bucket/uploaded"), convey.ShouldResemble, content)
+				}
+			}
+			if tc.expectCode != "" {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(apperror.CodeOf(err), convey.ShouldEqual, tc.expectCode)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+			}
+			limiter := trans.uploadLimiter
+			if tc.download {
+				limiter = trans.downloadLimiter
+			}
+			convey.So(limiter.Bandwidth(), convey.ShouldEqual, tc.expectBandwidth)
+		})
+	}
+}
+
+func TestS3Transput_parallel(t *testing.T) {
+	defer shortenThrottleBackoff()()
+	const transfers = 8
+	fake := &fakeS3{
+		objects:   make(map[string][]byte),
+		methods:   []string{http.MethodPut, http.MethodGet},
+		throttled: 2,
+		status:    http.StatusServiceUnavailable,
+		code:      "SlowDown",
+	}
+	for i := 0; i < transfers; i++ {
+		fake.objects[fmt.Sprintf("/bucket/remote-%d", i)] = []byte(fmt.Sprintf("download %d", i))
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	convey.Convey("parallel transfers throttled", t, func() {
+		trans, err := newFakeS3Transput(t, server.URL, 8*consts.DefaultMinBandwidth)
+		convey.So(err, convey.ShouldBeNil)
+
+		dir := t.TempDir()
+		errs := make([]error, 2*transfers)
+		var wg sync.WaitGroup
+		for i := 0; i < transfers; i++ {
+			local := filepath.Join(dir, fmt.Sprintf("upload-%d", i))
+			convey.So(os.WriteFile(local, []byte(fmt.Sprintf("upload %d", i)), 0644), convey.ShouldBeNil)
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = trans.UploadFile(context.Background(), local, fmt.Sprintf("s3://bucket/uploaded-%d", i))
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				errs[transfers+i] = trans.DownloadFile(context.Background(),
+					filepath.Join(dir, fmt.Sprintf("download-%d", i)), fmt.Sprintf("s3://bucket/remote-%d", i))
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			convey.So(err, convey.ShouldBeNil)
+		}
+		for i := 0; i < transfers; i++ {
+			convey.So(string(fake.object(fmt.Sprintf("/bucket/uploaded-%d", i))), convey.ShouldEqual, fmt.Sprintf("upload %d", i))
+			res, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("download-%d", i)))
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(string(res), convey.ShouldEqual, fmt.Sprintf("download %d", i))
+		}
+		// every transfer is throttled, but the ones at the same bandwidth slow
+		// down only once
+		convey.So(trans.uploadLimiter.Bandwidth(), convey.ShouldEqual, 4*consts.DefaultMinBandwidth)
+		convey.So(trans.downloadLimiter.Bandwidth(), convey.ShouldEqual, 4*consts.DefaultMinBandwidth)
+	})
+}
+
+func TestS3Transput_throttleCancelled(t *testing.T) {
+	convey.Convey("a throttled transfer cancelled during the backoff", t, func() {
+		fake := &fakeS3{
+			objects:   map[string][]byte{"/bucket/remote": []byte("hello world")},
+			methods:   []string{http.MethodGet},
+			throttled: 100,
+			status:    http.StatusServiceUnavailable,
+			code:      "SlowDown",
+		}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		trans, err := newFakeS3Transput(t, server.URL, 8*consts.DefaultMinBandwidth)
+		convey.So(err, convey.ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		throttledOf := func() int {
+			fake.lock.Lock()
+			defer fake.lock.Unlock()
+			return fake.requests["GET /bucket/remote"]
+		}
+		cancelled := make(chan time.Time, 1)
+		go func() {
+			// cancelled once the first attempt of two requests is throttled
+			for throttledOf() < 2 {
+				time.Sleep(time.Millisecond)
+			}
+			cancelled <- time.Now()
+			cancel()
+		}()
+
+		err = trans.DownloadFile(ctx, filepath.Join(t.TempDir(), "local"), "s3://bucket/remote")
+		convey.So(apperror.CodeOf(err), convey.ShouldEqual, "1000009")
+		// stopped right away instead of retrying
+		convey.So(time.Since(<-cancelled), convey.ShouldBeLessThan, throttleBackoff.Base/2)
+		convey.So(throttledOf(), convey.ShouldEqual, 2)
+	})
+}
+
+func TestNewS3Transput_maxBandwidth(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxBandwidth    int64
+		expectBandwidth int64
+	}{
+		{
+			name:            "default max bandwidth",
+			expectBandwidth: consts.DefaultMaxBandwidth,
+		},
+		{
+			name:            "configured max bandwidth",
+			maxBandwidth:    8 * consts.DefaultMinBandwidth,
+			expectBandwidth: 8 * consts.DefaultMinBandwidth,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			trans, err := newFakeS3Transput(t, "http://127.0.0.1", tc.maxBandwidth)
+			convey.So(err, convey.ShouldBeNil)
+			convey.So(trans.uploadLimiter.Bandwidth(), convey.ShouldEqual, tc.expectBandwidth)
+			convey.So(trans.downloadLimiter.Bandwidth(), convey.ShouldEqual, tc.expectBandwidth)
+		})
+	}
+}
@@ -1,27 +1,34 @@
 package s3
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"golang.org/x/time/rate"
 
+	"github.com/GBA-BI/tes-filer/pkg/checker"
+	md5checker "github.com/GBA-BI/tes-filer/pkg/checker/md5"
 	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
 	utilspath "github.com/GBA-BI/tes-filer/pkg/utils/path"
 	utilsstrings "github.com/GBA-BI/tes-filer/pkg/utils/strings"
@@ -30,35 +37,46 @@ import (
 
 const batchSize = 1000
 
+const abortTimeout = 30 * time.Second
+
+// throttleBackoff is the wait before retrying a throttled transfer.
+var throttleBackoff = ratelimit.ThrottleBackoff()
+
+// s3Transput is safe for concurrent transfers, its fields are not changed
+// after NewS3Transput and the throttle state is kept in the limiters.
 type s3Transput struct {
 	transput.DefaultTransput
 
 	client     s3iface.S3API
 	uploader   *s3manager.Uploader
 	downloader *s3manager.Downloader
-	limiter    *rate.Limiter
-
-	bandwidth        int64
-	limitErrCount    int64
-	lastLimitErrTime time.Time
+	// the limiters slow down on the throttling of the server
+	uploadLimiter   *ratelimit.Limiter
+	downloadLimiter *ratelimit.Limiter
+
+	// partSize and taskNum are of the resumable multipart transfers, the
+	// uploads scale partSize up to stay within consts.MaxPartNum
+	partSize int64
+	taskNum  int
 }
 
-func NewS3Transput(cfg *Config, userInfo *url.Userinfo) (transput.Transput, error) {
+// NewS3Transput returns the s3 transput limited to cfg.MaxBandwidth in each
+// direction within limits, consts.DefaultMaxBandwidth if not set.
+func NewS3Transput(cfg *Config, userInfo *url.Userinfo, limits *ratelimit.Limits) (transput.Transput, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("nil s3 transput config")
 	}
 
 	maxBandwidth := cfg.MaxBandwidth
-	if cfg.MaxBandwidth == 0 {
+	if maxBandwidth <= 0 {
 		maxBandwidth = consts.DefaultMaxBandwidth
 	}
-	sharedLimiter := rate.NewLimiter(rate.Limit(maxBandwidth), int(maxBandwidth))
-
+	limits = limits.Child(maxBandwidth)
 	// Create an HTTP client with the rate limiter.
 	httpClient := &http.Client{
 		Transport: &rateLimitingTransport{
-			upLimiter:   sharedLimiter,
-			downLimiter: sharedLimiter,
+			upLimiter:   limits.Upload(),
+			downLimiter: limits.Download(),
 			transport:   http.DefaultTransport,
 		},
 	}
@@ -76,12 +94,17 @@ func NewS3Transput(cfg *Config, userInfo *url.Userinfo) (transput.Transput, erro
 	if cfg.PartSize > 0 {
 		partSize = cfg.PartSize
 	}
+	var taskNum int64 = consts.DefaultTaskNum
+	if cfg.TaskNum > 0 {
+		taskNum = cfg.TaskNum
+	}
 	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(cfg.Region),
-		Endpoint:    aws.String(cfg.Endpoint),
-		Credentials: cre,
-		MaxRetries:  aws.Int(maxRetryCount),
-		HTTPClient:  httpClient,
+		Region:           aws.String(cfg.Region),
+		Endpoint:         aws.String(cfg.Endpoint),
+		Credentials:      cre,
+		MaxRetries:       aws.Int(maxRetryCount),
+		HTTPClient:       httpClient,
+		S3ForcePathStyle: aws.Bool(cfg.ForcePathStyle),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create s3 transput: %w", err)
@@ -90,14 +113,18 @@ func NewS3Transput(cfg *Config, userInfo *url.Userinfo) (transput.Transput, erro
 	return &s3Transput{
 		uploader: s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
 			u.PartSize = partSize
+			u.Concurrency = int(taskNum)
+			u.LeavePartsOnError = true
 		}),
 		downloader: s3manager.NewDownloader(sess, func(u *s3manager.Downloader) {
 			u.PartSize = partSize
+			u.Concurrency = int(taskNum)
 		}),
-		client:        s3.New(sess),
-		limiter:       sharedLimiter,
-		bandwidth:     cfg.MaxBandwidth,
-		limitErrCount: 0,
+		client:          s3.New(sess),
+		uploadLimiter:   limits.Upload(),
+		downloadLimiter: limits.Download(),
+		partSize:        partSize,
+		taskNum:         int(taskNum),
 	}, nil
 }
 
@@ -138,30 +165,88 @@ func (t *s3Transput) DownloadDir(ctx context.Context, local, remote string) erro
 	if err != nil {
 		return err
 	}
-	objects, err := t.listObjects(ctx, bucketName, &objectPrefix, false)
+	markers := transput.DirMarkersFrom(ctx)
+	objects, err := t.listObjects(ctx, bucketName, &objectPrefix, markers)
 	if err != nil {
+		if isNotFoundError(err) {
+			return transput.ClassifyError(transput.NotExistError(remote, err))
+		}
 		return err
 	}
+	if len(objects) == 0 {
+		return transput.ClassifyError(transput.NotExistError(remote, transput.ErrEmptyListing))
+	}
+	filter := transput.FilterFrom(ctx)
+	g := transput.NewGroup(ctx)
+	if markers {
+		if err := transput.MkdirAll(ctx, local); err != nil {
+			return transput.ClassifyError(fmt.Errorf("failed to mkdir: %w", err))
+		}
+	}
 	for _, obj := range objects {
 		pureObj := strings.TrimPrefix(obj, objectPrefix)
-		filePath := path.Join(local, pureObj)
-		remotePath := fmt.Sprintf("%s%s", consts.S3Prefix, path.Join(bucketName, obj))
-		fileDir := path.Dir(filePath)
-		if err := os.MkdirAll(fileDir, os.FileMode(consts.DefaultFileMode)); err != nil {
-			return fmt.Errorf("failed to mkdir: %w", err)
+		if utilsstrings.IsDir(obj) {
+			// the marker of an empty directory, only listed if markers
+			if err := t.downloadDirMarker(ctx, local, pureObj, obj, filter); err != nil {
+				_ = g.Wait()
+				return err
+			}
+			continue
+		}
+		if !filter.Match(pureObj) {
+			continue
 		}
-		if err := t.DownloadFile(ctx, filePath, remotePath); err != nil {
+		filePath, err := transput.JoinLocal(local, pureObj, obj)
+		if err != nil {
+			_ = g.Wait()
 			return err
 		}
+		// not path.Join, which cleans the dot segments of the key
+		remotePath := fmt.Sprintf("%s%s/%s", consts.S3Prefix, bucketName, obj)
+		fileDir := path.Dir(filePath)
+		if err := transput.MkdirAll(ctx, fileDir); err != nil {
+			_ = g.Wait()
+			return transput.ClassifyError(fmt.Errorf("failed to mkdir: %w", err))
+		}
+		g.Download(t, filePath, remotePath)
+	}
+	return g.Wait()
+}
+
+// downloadDirMarker recreates the directory of the marker whose key relative
+// to the downloaded directory is relDir.
+func (t *s3Transput) downloadDirMarker(ctx context.Context, local, relDir, key string, filter *transput.Filter) error {
+	if strings.Trim(relDir, "/") == "" || filter.SkipDir(relDir) {
+		return nil
+	}
+	dirPath, err := transput.JoinLocal(local, relDir, key)
+	if err != nil {
+		return err
+	}
+	if err := transput.MkdirAll(ctx, dirPath); err != nil {
+		return transput.ClassifyError(fmt.Errorf("failed to mkdir: %w", err))
 	}
 	return nil
 }
 
-func (t *s3Transput) UploadFile(ctx context.Context, local, remote string) error {
-	// 5 minutes do not trigger rate limit error, restore
-	if time.Since(t.lastLimitErrTime).Minutes() > 5 {
-		t.updateRateLimit(t.bandwidth)
+// UploadDirMarker implements transput.DirMarkerUploader.
+func (t *s3Transput) UploadDirMarker(ctx context.Context, remote string) error {
+	bucketName, objectName, err := utilspath.ParseURL(remote)
+	if err != nil {
+		return err
+	}
+	_, err = t.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: &bucketName,
+		Key:    aws.String(utilsstrings.CheckDir(objectName)),
+		Body:   bytes.NewReader(nil),
+	})
+	if err != nil {
+		return classifyError(fmt.Errorf("failed to upload directory marker to s3: %w", err))
 	}
+	return nil
+}
+
+func (t *s3Transput) UploadFile(ctx context.Context, local, remote string) error {
 	bucketName, objectName, err := utilspath.ParseURL(remote)
 	if err != nil {
 		return err
@@ -171,23 +256,91 @@ func (t *s3Transput) UploadFile(ctx context.Context, local, remote string) error
 	if err != nil {
 		return fmt.Errorf("unable to open file, %w", err)
 	}
+	defer fileReader.Close()
+	info, err := fileReader.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat file, %w", err)
+	}
 
-	for {
-		_, uploadErr := t.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-			Bucket: aws.String(bucketName),
-			Key:    aws.String(objectName),
-			Body:   fileReader,
-		})
+	partSize, err := transput.UploadPartSize(info.Size(), t.partSize)
+	if err != nil {
+		return err
+	}
+	checkpointDir, err := transput.CheckpointDirFrom(ctx)
+	if err != nil {
+		return transput.ClassifyError(err)
+	}
 
+	for retries := 0; ; retries++ {
+		var uploadErr error
+		if checkpointDir != "" && info.Size() > partSize {
+			uploadErr = t.uploadResumable(ctx, checkpointDir, fileReader, info, bucketName, objectName, partSize)
+		} else {
+			uploadErr = t.upload(ctx, fileReader, info, bucketName, objectName, partSize)
+		}
 		if uploadErr == nil {
 			return nil
 		}
-
-		if !t.handleRateLimitError(uploadErr) {
-			return fmt.Errorf("failed to upload file from s3: %w", uploadErr)
+		if !handleRateLimitError(uploadErr, t.uploadLimiter) {
+			return classifyError(fmt.Errorf("failed to upload file to s3: %w", uploadErr))
+		}
+		if err := throttleBackoff.Wait(ctx, retries); err != nil {
+			return classifyError(fmt.Errorf("failed to upload file to s3: %w", err))
 		}
 	}
+}
+
+// upload uploads file by the uploader in parts of partSize, the parts of a
+// failed multipart upload are aborted.
+func (t *s3Transput) upload(ctx context.Context, file *os.File, info os.FileInfo, bucketName, objectName string, partSize int64) error {
+	// the reader is consumed by the failed attempt
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek file, %w", err)
+	}
+	_, err := t.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(objectName),
+		Body:     file,
+		Metadata: aws.StringMap(transput.FileMeta(info)),
+	}, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+	// the parts are left by the uploader, since aborting by the cancelled ctx fails
+	var multiErr s3manager.MultiUploadFailure
+	if errors.As(err, &multiErr) {
+		t.abortMultipartUpload(bucketName, objectName, multiErr.UploadID())
+	}
+	return err
+}
 
+// UploadSymlink implements transput.SymlinkUploader.
+func (t *s3Transput) UploadSymlink(ctx context.Context, target, remote string) error {
+	bucketName, objectName, err := utilspath.ParseURL(remote)
+	if err != nil {
+		return err
+	}
+	_, err = t.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:   &bucketName,
+		Key:      &objectName,
+		Body:     bytes.NewReader(nil),
+		Metadata: map[string]*string{consts.MetaSymlinkTarget: aws.String(target)},
+	})
+	if err != nil {
+		return classifyError(fmt.Errorf("failed to upload symlink to s3: %w", err))
+	}
+	return nil
+}
+
+// abortMultipartUpload aborts the upload even if the transfer is cancelled,
+// the failure is ignored as the parts are removed by the lifecycle of the bucket at last.
+func (t *s3Transput) abortMultipartUpload(bucketName, objectName, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	_, _ = t.client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(objectName),
+		UploadId: aws.String(uploadID),
+	})
 }
 
 func (t *s3Transput) UploadDir(ctx context.Context, local, remote string) error {
@@ -195,38 +348,71 @@ func (t *s3Transput) UploadDir(ctx context.Context, local, remote string) error
 }
 
 func (t *s3Transput) DownloadFile(ctx context.Context, local, remote string) error {
-	// 5 minutes do not trigger rate limit error, restore
-	if time.Since(t.lastLimitErrTime).Minutes() > 5 {
-		t.updateRateLimit(t.bandwidth)
-	}
-	basedir := filepath.Dir(local)
-	if err := os.MkdirAll(basedir, os.FileMode(consts.DefaultFileMode)); err != nil {
-		return fmt.Errorf("failed to mkdir: %w", err)
-	}
 	bucketName, objectName, err := utilspath.ParseURL(remote)
 	if err != nil {
 		return err
 	}
-
-	file, err := os.Create(local)
+	head, err := t.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: &bucketName, Key: &objectName})
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		if isNotFoundError(err) {
+			return transput.ClassifyError(transput.NotExistError(remote, err))
+		}
+		return classifyError(fmt.Errorf("failed to head object: %w", err))
 	}
-
-	for {
-		_, downloadErr := t.downloader.DownloadWithContext(ctx, file, &s3.GetObjectInput{
-			Bucket: &bucketName,
-			Key:    &objectName,
-		})
-
+	checkpointDir, err := transput.CheckpointDirFrom(ctx)
+	if err != nil {
+		return transput.ClassifyError(err)
+	}
+	for retries := 0; ; retries++ {
+		var downloadErr error
+		if checkpointDir != "" && aws.Int64Value(head.ContentLength) > t.partSize {
+			downloadErr = t.downloadResumable(ctx, checkpointDir, local, bucketName, objectName, head)
+		} else {
+			downloadErr = t.download(ctx, local, bucketName, objectName, head)
+		}
 		if downloadErr == nil {
 			return nil
 		}
-
-		if !t.handleRateLimitError(downloadErr) {
-			return fmt.Errorf("failed to download file from s3: %w", downloadErr)
+		if isNotFoundError(downloadErr) {
+			return transput.ClassifyError(transput.NotExistError(remote, downloadErr))
+		}
+		if !handleRateLimitError(downloadErr, t.downloadLimiter) {
+			return classifyError(fmt.Errorf("failed to download file from s3: %w", downloadErr))
 		}
+		if err := throttleBackoff.Wait(ctx, retries); err != nil {
+			return classifyError(fmt.Errorf("failed to download file from s3: %w", err))
+		}
+	}
+}
+
+// download downloads the object of head by the downloader into the temp file
+// of local, which is renamed into place once complete.
+func (t *s3Transput) download(ctx context.Context, local, bucketName, objectName string, head *s3.HeadObjectOutput) error {
+	file, err := transput.CreateAtomic(ctx, local)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+	file.SetMeta(aws.StringValueMap(head.Metadata))
+	if _, err := t.downloader.DownloadWithContext(ctx, file, &s3.GetObjectInput{Bucket: &bucketName, Key: &objectName}); err != nil {
+		return err
+	}
+	return file.Commit(aws.Int64Value(head.ContentLength), etagChecker(head))
+}
+
+// etagChecker returns the checker comparing the md5 of a download with the
+// etag of its object. It is nil for the objects uploaded in parts, whose etag
+// ending with "-N" is not the md5 of their content, and for the objects
+// encrypted by SSE-KMS or SSE-C, whose etag is not either.
+func etagChecker(head *s3.HeadObjectOutput) checker.Checker {
+	if aws.StringValue(head.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || aws.StringValue(head.SSECustomerAlgorithm) != "" {
+		return nil
 	}
+	sum := strings.ToLower(strings.Trim(aws.StringValue(head.ETag), `"`))
+	if len(sum) != hex.EncodedLen(md5.Size) || strings.Contains(sum, "-") {
+		return nil
+	}
+	return md5checker.NewMD5Checker(sum)
 }
 
 func (t *s3Transput) listObjects(ctx context.Context, bucketName string, prefix *string, withDir bool) ([]string, error) {
@@ -251,7 +437,7 @@ func (t *s3Transput) listObjectAndForeach(ctx context.Context, bucketName string
 	for {
 		listOutput, err := t.client.ListObjectsWithContext(ctx, listInput)
 		if err != nil {
-			return fmt.Errorf("failed to ListObjects of bucket %s: %w", bucketName, err)
+			return classifyError(fmt.Errorf("failed to ListObjects of bucket %s: %w", bucketName, err))
 		}
 		for _, object := range listOutput.Contents {
 			if object != nil {
@@ -268,25 +454,51 @@ func (t *s3Transput) listObjectAndForeach(ctx context.Context, bucketName string
 	return nil
 }
 
-func (t *s3Transput) updateRateLimit(newRate int64) {
-	if newRate > consts.DefaultMinBandwidth {
-		t.limiter.SetLimit(rate.Limit(newRate))
+// classifyError wraps the errors of s3 into the categories of apperror.
+func classifyError(err error) error {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return transput.ClassifyError(err)
 	}
+	switch {
+	case isNotFoundError(err):
+		return apperror.Wrap(apperror.ErrNotFound, err)
+	case isThrottleError(err):
+		return apperror.Wrap(apperror.ErrRateLimited, err)
+	case utilsstrings.Contains(authErrCodes, awsErr.Code()):
+		return apperror.Wrap(apperror.ErrPermissionDenied, err)
+	case awsErr.Code() == request.CanceledErrorCode:
+		return apperror.Wrap(apperror.ErrCancelled, err)
+	case awsErr.Code() == request.ErrCodeRequestError, awsErr.Code() == request.ErrCodeResponseTimeout:
+		return apperror.Wrap(apperror.ErrNetwork, err)
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return transput.ClassifyStatus(reqErr.StatusCode(), err)
+	}
+	return transput.ClassifyError(err)
 }
 
-func (t *s3Transput) handleRateLimitError(err error) bool {
+// authErrCodes are the codes of s3 errors caused by credentials
+var authErrCodes = []string{"AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken"}
+
+func isNotFoundError(err error) bool {
 	var awsErr awserr.Error
-	ok := errors.As(err, &awsErr)
-	if !ok {
+	if !errors.As(err, &awsErr) {
 		return false
 	}
-
-	if utilsstrings.Contains(consts.ErrCodeRateLimitList, awsErr.Code()) {
-		t.limitErrCount++
-		t.lastLimitErrTime = time.Now()
-		t.updateRateLimit(t.bandwidth / (t.limitErrCount + 1))
+	switch awsErr.Code() {
+	case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
 		return true
 	}
-
 	return false
 }
+
+// handleRateLimitError slows down limiter on the throttling of the server, it
+// reports whether the throttled transfer should be retried.
+func handleRateLimitError(err error, limiter *ratelimit.Limiter) bool {
+	if !isThrottleError(err) {
+		return false
+	}
+	return limiter.SpeedDown()
+}
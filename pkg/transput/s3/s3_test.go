@@ -2,35 +2,44 @@ package s3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/transput"
 )
 
 func TestS3Transput_UploadFile(t *testing.T) {
 	tests := []struct {
 		name      string
-		local     string
 		remote    string
 		expectErr bool
 	}{
 		{
 			name:      "successfully upload file",
-			local:     "/path/to/local",
 			remote:    "s3://bucketName/objectName",
 			expectErr: false,
 		},
 		{
 			name:      "failed to upload file",
-			local:     "/path/to/local",
 			remote:    "s3://bucketName/objectName",
 			expectErr: true,
 		},
@@ -41,28 +50,30 @@ func TestS3Transput_UploadFile(t *testing.T) {
 			s3Trans := &s3Transput{
 				uploader: &s3manager.Uploader{},
 			}
+			local := filepath.Join(t.TempDir(), "local")
+			convey.So(os.WriteFile(local, []byte("hello"), 0644), convey.ShouldBeNil)
+			convey.So(os.Chmod(local, 0755), convey.ShouldBeNil)
+			convey.So(os.Chtimes(local, time.Unix(1700000000, 0), time.Unix(1700000000, 0)), convey.ShouldBeNil)
 
-			patch1 := gomonkey.ApplyFunc(os.Open, func(_ string) (*os.File, error) {
-				if tc.expectErr {
-					return nil, fmt.Errorf("failed to open file")
-				}
-				return &os.File{}, nil
-			})
-			defer patch1.Reset()
-
-			patch2 := gomonkey.ApplyMethod(reflect.TypeOf(*s3Trans.uploader), "UploadWithContext", func(_ s3manager.Uploader, _ context.Context, _ *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+			var metadata map[string]*string
+			patch2 := gomonkey.ApplyMethod(reflect.TypeOf(*s3Trans.uploader), "UploadWithContext", func(_ s3manager.Uploader, _ context.Context, input *s3manager.UploadInput, _ ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
 				if tc.expectErr {
 					return nil, fmt.Errorf("failed to upload with context")
 				}
+				metadata = input.Metadata
 				return &s3manager.UploadOutput{}, nil
 			})
 			defer patch2.Reset()
 
-			err := s3Trans.UploadFile(context.Background(), tc.local, tc.remote)
+			err := s3Trans.UploadFile(context.Background(), local, tc.remote)
 			if tc.expectErr {
 				convey.So(err, convey.ShouldNotBeNil)
 			} else {
 				convey.So(err, convey.ShouldBeNil)
+				convey.So(aws.StringValueMap(metadata), convey.ShouldResemble, map[string]string{
+					consts.MetaMode:  "33261",
+					consts.MetaMtime: "1700000000",
+				})
 			}
 		})
 	}
@@ -70,21 +81,86 @@ func TestS3Transput_UploadFile(t *testing.T) {
 
 func TestS3Transput_DownloadFile(t *testing.T) {
 	tests := []struct {
-		name      string
-		local     string
-		remote    string
-		expectErr bool
+		name       string
+		size       int64
+		content    string
+		etag       string
+		sse        string
+		sseC       string
+		meta       map[string]*string
+		headErr    error
+		expectErr  bool
+		expectMode os.FileMode
 	}{
 		{
 			name:      "successfully download file",
-			local:     "/path/to/local",
-			remote:    "s3://bucketName/objectName",
+			size:      5,
+			content:   "hello",
 			expectErr: false,
 		},
+		{
+			name:    "restore the recorded mode",
+			size:    5,
+			content: "hello",
+			// canonicalized by the sdk
+			meta:       map[string]*string{"Mode": aws.String("33261"), "Mtime": aws.String("1700000000")},
+			expectMode: 0755,
+		},
 		{
 			name:      "failed to download file",
-			local:     "/path/to/local",
-			remote:    "s3://bucketName/objectName",
+			size:      5,
+			expectErr: true,
+		},
+		{
+			name:      "size not match",
+			size:      10,
+			content:   "hello",
+			expectErr: true,
+		},
+		{
+			name:    "etag matches",
+			size:    5,
+			content: "hello",
+			etag:    `"5d41402abc4b2a76b9719d911017c592"`,
+		},
+		{
+			name:      "etag not match",
+			size:      5,
+			content:   "hello",
+			etag:      `"00000000000000000000000000000000"`,
+			expectErr: true,
+		},
+		{
+			name:    "etag of multipart upload not checked",
+			size:    5,
+			content: "hello",
+			etag:    `"00000000000000000000000000000000-2"`,
+		},
+		{
+			name:    "etag of sse-kms object not checked",
+			size:    5,
+			content: "hello",
+			etag:    `"00000000000000000000000000000000"`,
+			sse:     s3.ServerSideEncryptionAwsKms,
+		},
+		{
+			name:    "etag of sse-c object not checked",
+			size:    5,
+			content: "hello",
+			etag:    `"00000000000000000000000000000000"`,
+			sseC:    "AES256",
+		},
+		{
+			name:      "etag of sse-s3 object checked",
+			size:      5,
+			content:   "hello",
+			etag:      `"00000000000000000000000000000000"`,
+			sse:       s3.ServerSideEncryptionAes256,
+			expectErr: true,
+		},
+		{
+			name:      "object not found",
+			headErr:   awserr.New("NotFound", "not found", nil),
 			expectErr: true,
 		},
 	}
@@ -92,39 +168,55 @@ func TestS3Transput_DownloadFile(t *testing.T) {
 	for _, tc := range tests {
 		convey.Convey(tc.name, t, func() {
 			s3Trans := &s3Transput{
+				client:     &s3.S3{},
 				downloader: &s3manager.Downloader{},
 			}
+			local := filepath.Join(t.TempDir(), "local")
 
-			patch1 := gomonkey.ApplyFunc(os.MkdirAll, func(_ string, _ os.FileMode) error {
-				if tc.expectErr {
-					return fmt.Errorf("failed to mkdir all")
+			patch1 := gomonkey.ApplyMethod(reflect.TypeOf(s3Trans.client), "HeadObjectWithContext", func(_ *s3.S3, _ context.Context, _ *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+				if tc.headErr != nil {
+					return nil, tc.headErr
 				}
-				return nil
-			})
-			defer patch1.Reset()
-
-			patch2 := gomonkey.ApplyFunc(os.Create, func(_ string) (*os.File, error) {
-				if tc.expectErr {
-					return nil, fmt.Errorf("failed to create file")
+				head := &s3.HeadObjectOutput{ContentLength: &tc.size, ETag: aws.String(tc.etag), Metadata: tc.meta}
+				if tc.sse != "" {
+					head.ServerSideEncryption = aws.String(tc.sse)
+				}
+				if tc.sseC != "" {
+					head.SSECustomerAlgorithm = aws.String(tc.sseC)
 				}
-				return &os.File{}, nil
+				return head, nil
 			})
-			defer patch2.Reset()
+			defer patch1.Reset()
 
-			patch3 := gomonkey.ApplyMethod(reflect.TypeOf(*s3Trans.downloader), "DownloadWithContext", func(_ s3manager.Downloader, _ context.Context, _ io.WriterAt, _ *s3.GetObjectInput, _ ...func(*s3manager.Downloader)) (int64, error) {
-				if tc.expectErr {
+			patch2 := gomonkey.ApplyMethod(reflect.TypeOf(*s3Trans.downloader), "DownloadWithContext", func(_ s3manager.Downloader, _ context.Context, w io.WriterAt, _ *s3.GetObjectInput, _ ...func(*s3manager.Downloader)) (int64, error) {
+				if tc.content == "" {
 					return 0, fmt.Errorf("failed to download with context")
 				}
-				return 0, nil
+				n, err := w.WriteAt([]byte(tc.content), 0)
+				return int64(n), err
 			})
-			defer patch3.Reset()
+			defer patch2.Reset()
 
-			err := s3Trans.DownloadFile(context.Background(), tc.local, tc.remote)
+			err := s3Trans.DownloadFile(context.Background(), local, "s3://bucketName/objectName")
 			if tc.expectErr {
 				convey.So(err, convey.ShouldNotBeNil)
+				_, statErr := os.Stat(local)
+				convey.So(os.IsNotExist(statErr), convey.ShouldBeTrue)
 			} else {
 				convey.So(err, convey.ShouldBeNil)
+				content, readErr := os.ReadFile(local)
+				convey.So(readErr, convey.ShouldBeNil)
+				convey.So(string(content), convey.ShouldEqual, tc.content)
+				if tc.expectMode != 0 {
+					info, statErr := os.Stat(local)
+					convey.So(statErr, convey.ShouldBeNil)
+					convey.So(info.Mode().Perm(), convey.ShouldEqual, tc.expectMode)
+					convey.So(info.ModTime().Unix(), convey.ShouldEqual, 1700000000)
+				}
 			}
+			// no temp file is left
+			_, statErr := os.Stat(transput.TempPath(local))
+			convey.So(os.IsNotExist(statErr), convey.ShouldBeTrue)
 		})
 	}
 }
@@ -134,14 +226,33 @@ func TestS3Transput_DownloadDir(t *testing.T) {
 		name      string
 		local     string
 		remote    string
+		keys      []string
 		expectErr bool
+		// expectNotExist is checked if expectErr
+		expectNotExist bool
 	}{
 		{
 			name:      "successfully download directory",
 			local:     "/path/to/local",
 			remote:    "s3://bucketName/objectPrefix",
+			keys:      []string{"objectPrefix/a", "objectPrefix/b/../c"},
 			expectErr: false,
 		},
+		{
+			name:      "key escaping the local directory",
+			local:     "/path/to/local",
+			remote:    "s3://bucketName/objectPrefix",
+			keys:      []string{"objectPrefix/a", "objectPrefix/../../etc/x"},
+			expectErr: true,
+		},
+		{
+			name:           "empty listing",
+			local:          "/path/to/local",
+			remote:         "s3://bucketName/objectPrefix",
+			keys:           []string{},
+			expectErr:      true,
+			expectNotExist: true,
+		},
 		{
 			name:      "failed to download directory",
 			local:     "/path/to/local",
@@ -157,25 +268,31 @@ func TestS3Transput_DownloadDir(t *testing.T) {
 			}
 
 			patch1 := gomonkey.ApplyMethod(reflect.TypeOf(s3Trans.client), "ListObjectsWithContext", func(_ *s3.S3, _ context.Context, _ *s3.ListObjectsInput, _ ...request.Option) (*s3.ListObjectsOutput, error) {
-				if tc.expectErr {
+				if tc.keys == nil {
 					return nil, fmt.Errorf("failed to list objects")
 				}
-				return &s3.ListObjectsOutput{}, nil
+				contents := make([]*s3.Object, 0, len(tc.keys))
+				for _, key := range tc.keys {
+					contents = append(contents, &s3.Object{Key: aws.String(key)})
+				}
+				return &s3.ListObjectsOutput{Contents: contents}, nil
 			})
 			defer patch1.Reset()
 
+			var downloaded []string
 			patch2 := gomonkey.ApplyFunc(os.MkdirAll, func(_ string, _ os.FileMode) error {
-				if tc.expectErr {
+				if tc.keys == nil {
 					return fmt.Errorf("failed to mkdir all")
 				}
 				return nil
 			})
 			defer patch2.Reset()
 
-			patch3 := gomonkey.ApplyMethod(reflect.TypeOf(s3Trans), "DownloadFile", func(_ *s3Transput, _ context.Context, _ string, _ string) error {
-				if tc.expectErr {
+			patch3 := gomonkey.ApplyMethod(reflect.TypeOf(s3Trans), "DownloadFile", func(_ *s3Transput, _ context.Context, local string, _ string) error {
+				if tc.keys == nil {
 					return fmt.Errorf("failed to download file")
 				}
+				downloaded = append(downloaded, local)
 				return nil
 			})
 			defer patch3.Reset()
@@ -183,9 +300,88 @@ func TestS3Transput_DownloadDir(t *testing.T) {
 			err := s3Trans.DownloadDir(context.Background(), tc.local, tc.remote)
 			if tc.expectErr {
 				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(errors.Is(err, transput.ErrNotExist), convey.ShouldEqual, tc.expectNotExist)
 			} else {
 				convey.So(err, convey.ShouldBeNil)
 			}
+			for _, local := range downloaded {
+				convey.So(strings.HasPrefix(local, tc.local+"/"), convey.ShouldBeTrue)
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectExitCode int
+	}{
+		{
+			name:           "no such key",
+			err:            awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "not found", nil), http.StatusNotFound, "id"),
+			expectExitCode: apperror.ExitNotFound,
+		},
+		{
+			name:           "access denied",
+			err:            awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), http.StatusForbidden, "id"),
+			expectExitCode: apperror.ExitPermissionDenied,
+		},
+		{
+			name:           "slow down",
+			err:            awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), http.StatusServiceUnavailable, "id"),
+			expectExitCode: apperror.ExitRateLimited,
+		},
+		{
+			name:           "request error",
+			err:            awserr.New(request.ErrCodeRequestError, "send request failed", nil),
+			expectExitCode: apperror.ExitNetwork,
+		},
+		{
+			name:           "internal error status",
+			err:            awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), http.StatusInternalServerError, "id"),
+			expectExitCode: apperror.ExitNetwork,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			err := classifyError(fmt.Errorf("failed to download file from s3: %w", tc.err))
+			convey.So(apperror.ExitCode(err), convey.ShouldEqual, tc.expectExitCode)
+		})
+	}
+}
+
+func TestNewS3Transput_taskNum(t *testing.T) {
+	tests := []struct {
+		name          string
+		taskNum       int64
+		expectTaskNum int
+	}{
+		{
+			name:          "default",
+			expectTaskNum: consts.DefaultTaskNum,
+		},
+		{
+			name:          "configured",
+			taskNum:       16,
+			expectTaskNum: 16,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			// the sdk can not load a custom ca bundle into the rate limiting transport
+			t.Setenv("AWS_CA_BUNDLE", "")
+			cfg := &Config{}
+			cfg.Region = "us-east-1"
+			cfg.TaskNum = tc.taskNum
+			trans, err := NewS3Transput(cfg, url.UserPassword("ak", "sk"), nil)
+			convey.So(err, convey.ShouldBeNil)
+			s3Trans := trans.(*s3Transput)
+			convey.So(s3Trans.taskNum, convey.ShouldEqual, tc.expectTaskNum)
+			convey.So(s3Trans.uploader.Concurrency, convey.ShouldEqual, tc.expectTaskNum)
+			convey.So(s3Trans.downloader.Concurrency, convey.ShouldEqual, tc.expectTaskNum)
 		})
 	}
 }
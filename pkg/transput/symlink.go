@@ -0,0 +1,90 @@
+package transput
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+)
+
+// SymlinkPolicy decides how CommonUploadDir handles the symlinks in the
+// uploaded directory.
+type SymlinkPolicy struct {
+	// Mode is one of consts.SymlinkPolicy*, follow if empty.
+	Mode string
+	// Confine rejects the followed symlinks resolving outside of the uploaded directory.
+	Confine bool
+}
+
+// SymlinkUploader is implemented by the transputs able to keep a symlink as
+// an empty object whose metadata holds the link target.
+type SymlinkUploader interface {
+	UploadSymlink(ctx context.Context, target, remote string) error
+}
+
+type symlinkPolicyCtxKey struct{}
+
+// WithSymlinkPolicy returns a copy of ctx in which the directory uploads handle
+// symlinks by policy.
+func WithSymlinkPolicy(ctx context.Context, policy *SymlinkPolicy) context.Context {
+	return context.WithValue(ctx, symlinkPolicyCtxKey{}, policy)
+}
+
+func symlinkPolicyFrom(ctx context.Context) *SymlinkPolicy {
+	policy, _ := ctx.Value(symlinkPolicyCtxKey{}).(*SymlinkPolicy)
+	if policy == nil {
+		return &SymlinkPolicy{Mode: consts.SymlinkPolicyFollow}
+	}
+	return policy
+}
+
+// fileID identifies a directory by device and inode, it detects the symlinks
+// linking back to a directory being walked whatever path they use.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func fileIDOf(path string) (fileID, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileID{}, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		// unique by path if the platform has no inode
+		return fileID{}, nil
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, nil
+}
+
+// ancestorIDs returns the ids of the directories from the parent of path up
+// to root.
+func ancestorIDs(root, path string) ([]fileID, error) {
+	root = filepath.Clean(root)
+	var res []fileID
+	dir := filepath.Dir(path)
+	for {
+		id, err := fileIDOf(dir)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+		if dir == root || !isWithin(root, dir) {
+			return res, nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// isWithin reports whether path is root or under it, both are cleaned.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
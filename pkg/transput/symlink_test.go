@@ -0,0 +1,126 @@
+package transput
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+)
+
+type fakeUploader struct {
+	DefaultTransput
+
+	lock     sync.Mutex
+	uploaded []string
+	symlinks map[string]string
+}
+
+func (f *fakeUploader) UploadFile(_ context.Context, _, remote string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.uploaded = append(f.uploaded, remote)
+	return nil
+}
+
+func (f *fakeUploader) UploadSymlink(_ context.Context, target, remote string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.symlinks[remote] = target
+	return nil
+}
+
+func TestCommonUploadDir_symlink(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         *SymlinkPolicy
+		expectErr      bool
+		expectCode     string
+		expectUploaded []string
+		expectSymlinks map[string]string
+	}{
+		{
+			name:   "follow by default and skip the loop",
+			policy: nil,
+			expectUploaded: []string{
+				"remote/a",
+				"remote/dir/b",
+				"remote/dir/link-file",
+				"remote/link-dir/b",
+				"remote/link-dir/link-file",
+				"remote/link-outside",
+			},
+		},
+		{
+			name:       "follow confined to the output directory",
+			policy:     &SymlinkPolicy{Mode: consts.SymlinkPolicyFollow, Confine: true},
+			expectErr:  true,
+			expectCode: "1000004",
+		},
+		{
+			name:           "skip",
+			policy:         &SymlinkPolicy{Mode: consts.SymlinkPolicySkip},
+			expectUploaded: []string{"remote/a", "remote/dir/b"},
+		},
+		{
+			name:           "preserve",
+			policy:         &SymlinkPolicy{Mode: consts.SymlinkPolicyPreserve},
+			expectUploaded: []string{"remote/a", "remote/dir/b"},
+			expectSymlinks: map[string]string{
+				"remote/dir/link-file": "../a",
+				"remote/dir/loop":      "..",
+				"remote/dangling":      "missing",
+				"remote/link-dir":      "dir",
+			},
+		},
+		{
+			name:       "fail",
+			policy:     &SymlinkPolicy{Mode: consts.SymlinkPolicyFail},
+			expectErr:  true,
+			expectCode: "1000002",
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			base := t.TempDir()
+			local := filepath.Join(base, "local")
+			outside := filepath.Join(base, "outside")
+			convey.So(os.MkdirAll(filepath.Join(local, "dir"), 0755), convey.ShouldBeNil)
+			convey.So(os.WriteFile(filepath.Join(local, "a"), []byte("a"), 0644), convey.ShouldBeNil)
+			convey.So(os.WriteFile(filepath.Join(local, "dir", "b"), []byte("b"), 0644), convey.ShouldBeNil)
+			convey.So(os.WriteFile(outside, []byte("outside"), 0644), convey.ShouldBeNil)
+			convey.So(os.Symlink("../a", filepath.Join(local, "dir", "link-file")), convey.ShouldBeNil)
+			convey.So(os.Symlink("..", filepath.Join(local, "dir", "loop")), convey.ShouldBeNil)
+			convey.So(os.Symlink("missing", filepath.Join(local, "dangling")), convey.ShouldBeNil)
+			convey.So(os.Symlink("dir", filepath.Join(local, "link-dir")), convey.ShouldBeNil)
+			if tc.policy == nil || tc.policy.Mode != consts.SymlinkPolicyPreserve {
+				convey.So(os.Symlink(outside, filepath.Join(local, "link-outside")), convey.ShouldBeNil)
+			}
+
+			ctx := context.Background()
+			if tc.policy != nil {
+				ctx = WithSymlinkPolicy(ctx, tc.policy)
+			}
+			uploader := &fakeUploader{symlinks: make(map[string]string)}
+			err := CommonUploadDir(ctx, local, "remote", uploader)
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(apperror.CodeOf(err), convey.ShouldEqual, tc.expectCode)
+				return
+			}
+			convey.So(err, convey.ShouldBeNil)
+			sort.Strings(uploader.uploaded)
+			convey.So(uploader.uploaded, convey.ShouldResemble, tc.expectUploaded)
+			if tc.expectSymlinks != nil {
+				convey.So(uploader.symlinks, convey.ShouldResemble, tc.expectSymlinks)
+			}
+		})
+	}
+}
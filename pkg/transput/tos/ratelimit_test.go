@@ -0,0 +1,184 @@
+package tos
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smartystreets/goconvey/convey"
+
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
+	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
+)
+
+// fakeTOS is a local tos endpoint keeping the objects in memory, the first
+// throttled requests of method are answered with 429. It is safe for
+// parallel requests.
+type fakeTOS struct {
+	lock      sync.Mutex
+	objects   map[string][]byte
+	method    string
+	throttled int
+	// requests counts the throttled requests
+	requests int
+}
+
+func (f *fakeTOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.Method == f.method && f.requests < f.throttled {
+		f.requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = fmt.Fprint(w, `{"Code":"ExceedAccountQPSLimit","Message":"throttled"}`)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		w.WriteHeader(http.StatusOK)
+	case http.MethodHead, http.MethodGet:
+		content, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(content))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeTOS) object(path string) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.objects[path]
+}
+
+func newFakeTOSTransput(endpoint string, maxBandwidth int64) (*tosTransput, error) {
+	cfg := &Config{}
+	cfg.Endpoint = endpoint
+	cfg.Region = "cn-beijing"
+	cfg.MaxBandwidth = maxBandwidth
+	// one retry of the sdk, so that the throttle is seen after two requests
+	cfg.MaxRetryCount = 1
+	trans, err := NewTOSTransput(cfg, url.UserPassword("ak", "sk"), nil, log.NewNopLogger())
+	if err != nil {
+		return nil, err
+	}
+	return trans.(*tosTransput), nil
+}
+
+// shortenThrottleBackoff shortens the backoff of the throttled transfers
+// until the returned func restores it.
+func shortenThrottleBackoff() func() {
+	backoff := throttleBackoff
+	throttleBackoff = ratelimit.Backoff{Base: time.Millisecond, Max: 10 * time.Millisecond}
+	return func() {
+		throttleBackoff = backoff
+	}
+}
+
+func TestTosTransput_throttle(t *testing.T) {
+	defer shortenThrottleBackoff()()
+
+	tests := []struct {
+		name            string
+		download        bool
+		maxBandwidth    int64
+		method          string
+		throttled       int
+		expectCode      string
+		expectBandwidth int64
+	}{
+		{
+			name:            "upload slowed down",
+			maxBandwidth:    8 * consts.DefaultMinBandwidth,
+			method:          http.MethodPut,
+			throttled:       2,
+			expectBandwidth: 4 * consts.DefaultMinBandwidth,
+		},
+		{
+			name:            "download slowed down",
+			download:        true,
+			maxBandwidth:    8 * consts.DefaultMinBandwidth,
+			method:          http.MethodHead,
+			throttled:       2,
+			expectBandwidth: 4 * consts.DefaultMinBandwidth,
+		},
+		{
+			name:            "upload throttled at the minimum bandwidth",
+			maxBandwidth:    consts.DefaultMinBandwidth,
+			method:          http.MethodPut,
+			throttled:       100,
+			expectCode:      "1000006",
+			expectBandwidth: consts.DefaultMinBandwidth,
+		},
+		{
+			name:            "download throttled at the minimum bandwidth",
+			download:        true,
+			maxBandwidth:    consts.DefaultMinBandwidth,
+			method:          http.MethodHead,
+			throttled:       100,
+			expectCode:      "1000006",
+			expectBandwidth: consts.DefaultMinBandwidth,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			content := []byte("hello world")
+			fake := &fakeTOS{
+				objects:   map[string][]byte{"/bucket/remote": content},
+				method:    tc.method,
+				throttled: tc.throttled,
+			}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			trans, err := newFakeTOSTransput(server.URL, tc.maxBandwidth)
+			convey.So(err, convey.ShouldBeNil)
+
+			dir := t.TempDir()
+			local := filepath.Join(dir, "local")
+			if tc.download {
+				err = trans.DownloadFile(context.Background(), local, "tos://bucket/remote")
+				if err == nil {
+					res, readErr := os.ReadFile(local)
+					convey.So(readErr, convey.ShouldBeNil)
+					convey.So(res, convey.ShouldResemble, content)
+				}
+			} else {
+				convey.So(os.WriteFile(local, content, 0644), convey.ShouldBeNil)
+				err = trans.UploadFile(context.Background(), local, "tos://bucket/uploaded")
+				if err == nil {
+					convey.So(fake.object("/bucket/uploaded"), convey.ShouldResemble, content)
+				}
+			}
+			if tc.expectCode != "" {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(apperror.CodeOf(err), convey.ShouldEqual, tc.expectCode)
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+			}
+			limiter := trans.uploadEventListenerAndRateLimiter.limiter
+			if tc.download {
+				limiter = trans.downloadEventListenerAndRateLimiter.limiter
+			}
+			convey.So(limiter.Bandwidth(), convey.ShouldEqual, tc.expectBandwidth)
+		})
+	}
+}
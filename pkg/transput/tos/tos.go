@@ -1,27 +1,29 @@
 package tos
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 
 	"github.com/volcengine/ve-tos-golang-sdk/v2/tos"
 
 	"github.com/GBA-BI/tes-filer/pkg/consts"
 	"github.com/GBA-BI/tes-filer/pkg/log"
+	"github.com/GBA-BI/tes-filer/pkg/ratelimit"
 	"github.com/GBA-BI/tes-filer/pkg/transput"
 	utilspath "github.com/GBA-BI/tes-filer/pkg/utils/path"
 	utilsstrings "github.com/GBA-BI/tes-filer/pkg/utils/strings"
 	"github.com/GBA-BI/tes-filer/pkg/viper"
 )
 
-const (
-	tosMaximumPartNum  = 10000
-	tosMaximumPartSize = 5 * 1024 * 1024 * 1024 // 5GiB
-)
+// throttleBackoff is the wait before retrying a throttled transfer.
+var throttleBackoff = ratelimit.ThrottleBackoff()
 
 type tosTransput struct {
 	transput.DefaultTransput
@@ -35,7 +37,9 @@ type tosTransput struct {
 	logger log.Logger
 }
 
-func NewTOSTransput(cfg *Config, userInfo *url.Userinfo, logger log.Logger) (transput.Transput, error) {
+// NewTOSTransput returns the tos transput limited to cfg.MaxBandwidth in each
+// direction within limits.
+func NewTOSTransput(cfg *Config, userInfo *url.Userinfo, limits *ratelimit.Limits, logger log.Logger) (transput.Transput, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("nil config of tos transput")
 	}
@@ -54,6 +58,10 @@ func NewTOSTransput(cfg *Config, userInfo *url.Userinfo, logger log.Logger) (tra
 	if cfg.PartSize > 0 {
 		partSize = cfg.PartSize
 	}
+	var taskNum int64 = consts.DefaultTaskNum
+	if cfg.TaskNum > 0 {
+		taskNum = cfg.TaskNum
+	}
 	client, err := tos.NewClientV2(cfg.Endpoint,
 		tos.WithRegion(cfg.Region),
 		tos.WithCredentials(fCredentials),
@@ -63,13 +71,14 @@ func NewTOSTransput(cfg *Config, userInfo *url.Userinfo, logger log.Logger) (tra
 		return nil, fmt.Errorf("init tos client failed: %w", err)
 	}
 
+	limits = limits.Child(cfg.MaxBandwidth)
 	return &tosTransput{
 		client:                              client,
 		partSize:                            partSize,
-		taskNum:                             cfg.TaskNum,
+		taskNum:                             taskNum,
 		logger:                              logger,
-		uploadEventListenerAndRateLimiter:   newUploadEventListenerAndRateLimiter(cfg.MaxBandwidth, cfg.MaxBandwidth, logger),
-		downloadEventListenerAndRateLimiter: newDownloadEventListenerAndRateLimiter(cfg.MaxBandwidth, cfg.MaxBandwidth, logger),
+		uploadEventListenerAndRateLimiter:   newUploadEventListenerAndRateLimiter(limits.Upload(), logger),
+		downloadEventListenerAndRateLimiter: newDownloadEventListenerAndRateLimiter(limits.Download(), logger),
 	}, nil
 }
 
@@ -113,6 +122,13 @@ func (t *tosTransput) UploadDir(ctx context.Context, local, remote string) error
 }
 
 func (t *tosTransput) DownloadDir(ctx context.Context, local, remote string) error {
+	return t.downloadDir(ctx, local, remote, "")
+}
+
+// downloadDir downloads remote whose path relative to the downloaded directory
+// is relDir, level by level.
+func (t *tosTransput) downloadDir(ctx context.Context, local, remote, relDir string) error {
+	filter := transput.FilterFrom(ctx)
 	local = utilsstrings.CheckDir(local)
 	remote = utilsstrings.CheckDir(remote)
 	bucket, remotePath, err := utilspath.ParseURL(remote)
@@ -120,6 +136,7 @@ func (t *tosTransput) DownloadDir(ctx context.Context, local, remote string) err
 		return fmt.Errorf("failed to parse url %w", err)
 	}
 	truncated := true
+	listed := false
 	continuationToken := ""
 	subFileList := make([]string, 0)
 	subDirList := make([]string, 0)
@@ -131,7 +148,10 @@ func (t *tosTransput) DownloadDir(ctx context.Context, local, remote string) err
 			Prefix:            remotePath,
 		})
 		if err != nil {
-			return fmt.Errorf("failed to list file of tos: %w", err)
+			if isNotFoundError(err) {
+				return transput.ClassifyError(transput.NotExistError(remote, err))
+			}
+			return classifyError(fmt.Errorf("failed to list file of tos: %w", err))
 		}
 		for _, prefix := range output.CommonPrefixes {
 			subDirList = append(subDirList, filepath.Base(prefix.Prefix))
@@ -141,27 +161,52 @@ func (t *tosTransput) DownloadDir(ctx context.Context, local, remote string) err
 				subFileList = append(subFileList, filepath.Base(obj.Key))
 			}
 		}
+		listed = listed || len(output.CommonPrefixes) > 0 || len(output.Contents) > 0
 		truncated = output.IsTruncated
 		continuationToken = output.NextContinuationToken
 	}
+	if !listed && relDir == "" {
+		return transput.ClassifyError(transput.NotExistError(remote, transput.ErrEmptyListing))
+	}
+	if transput.DirMarkersFrom(ctx) {
+		// every listed level is recreated, including the empty ones kept by markers
+		if err := transput.MkdirAll(ctx, local); err != nil {
+			return transput.ClassifyError(fmt.Errorf("failed to mkdir: %w", err))
+		}
+	}
 
+	g := transput.NewGroup(ctx)
 	for _, obj := range subFileList {
+		if !filter.Match(path.Join(relDir, obj)) {
+			continue
+		}
 		remoteObj := fmt.Sprintf("%s%s", remote, obj)
-		localObj := fmt.Sprintf("%s%s", local, obj)
-		if err := t.DownloadFile(ctx, localObj, remoteObj); err != nil {
+		localObj, err := transput.JoinLocal(local, obj, remoteObj)
+		if err != nil {
+			_ = g.Wait()
 			return err
 		}
+		g.Download(t, localObj, remoteObj)
 	}
 
+	// sub directories are listed while the files of this level are transferring
 	for _, prefix := range subDirList {
+		if filter.SkipDir(path.Join(relDir, prefix)) {
+			continue
+		}
 		remotePath := fmt.Sprintf("%s%s", remote, prefix)
-		localPath := fmt.Sprintf("%s%s", local, prefix)
-		if err := t.DownloadDir(ctx, localPath, remotePath); err != nil {
+		localPath, err := transput.JoinLocal(local, prefix, remotePath)
+		if err != nil {
+			_ = g.Wait()
+			return err
+		}
+		if err := t.downloadDir(ctx, localPath, remotePath, path.Join(relDir, prefix)); err != nil {
+			_ = g.Wait()
 			return err
 		}
 	}
 
-	return nil
+	return g.Wait()
 }
 
 func (t *tosTransput) UploadFile(ctx context.Context, local, remote string) error {
@@ -174,11 +219,20 @@ func (t *tosTransput) UploadFile(ctx context.Context, local, remote string) erro
 	if err != nil {
 		return fmt.Errorf("failed to stat file of path %s: %w", local, err)
 	}
+	meta := transput.FileMeta(stat)
+	// the checkpoint is next to the file if empty
+	checkpointDir, err := transput.CheckpointDirFrom(ctx)
+	if err != nil {
+		return transput.ClassifyError(err)
+	}
 
 	var uploadErr error
 
 	fileSize := stat.Size()
-	for {
+	for retries := 0; ; retries++ {
+		if err := ctx.Err(); err != nil {
+			return classifyError(err)
+		}
 		if fileSize < t.partSize {
 			// do not slice to be compatible with cromwell
 			t.logger.Debugf("file %s size is %d, less than partSize %d, no need to do multipart", local, fileSize, t.partSize)
@@ -190,68 +244,105 @@ func (t *tosTransput) UploadFile(ctx context.Context, local, remote string) erro
 				PutObjectBasicInput: tos.PutObjectBasicInput{
 					Bucket:      bucket,
 					Key:         object,
+					Meta:        meta,
 					RateLimiter: t.uploadEventListenerAndRateLimiter,
 				},
 				Content: fileReader,
 			})
+			_ = fileReader.Close()
 		} else {
-			partSize, err := getUploadPartSize(fileSize, t.partSize)
+			partSize, err := transput.UploadPartSize(fileSize, t.partSize)
 			if err != nil {
 				return err
 			}
-			_, uploadErr = t.client.UploadFile(ctx, &tos.UploadFileInput{
+			// the multipart upload runs in its own ctx, so that it is stopped by
+			// the hook keeping its checkpoint once ctx is cancelled
+			uploadCtx, cancelUpload := context.WithCancel(context.Background())
+			hook := tos.NewCancelHook()
+			stop := cancelOnDone(ctx, hook, cancelUpload)
+			_, uploadErr = t.client.UploadFile(uploadCtx, &tos.UploadFileInput{
 				CreateMultipartUploadV2Input: tos.CreateMultipartUploadV2Input{
 					Bucket: bucket,
 					Key:    object,
+					Meta:   meta,
 				},
 				FilePath:            local,
 				PartSize:            partSize,
 				TaskNum:             int(t.taskNum),
 				EnableCheckpoint:    true,
+				CheckpointFile:      checkpointDir,
 				UploadEventListener: t.uploadEventListenerAndRateLimiter,
 				RateLimiter:         t.uploadEventListenerAndRateLimiter,
+				CancelHook:          hook,
 			})
+			stop()
 		}
 
 		if uploadErr == nil {
 			return nil
 		}
 
+		if ctx.Err() != nil {
+			return classifyError(fmt.Errorf("failed to upload file to tos: %w", ctx.Err()))
+		}
 		if !t.handleUploadRateLimitError(uploadErr) {
-			return fmt.Errorf("failed to upload file to tos: %w", uploadErr)
+			return classifyError(fmt.Errorf("failed to upload file to tos: %w", uploadErr))
+		}
+		if err := throttleBackoff.Wait(ctx, retries); err != nil {
+			return classifyError(fmt.Errorf("failed to upload file to tos: %w", err))
 		}
 	}
 }
 
-func getUploadPartSize(fileSize, defaultPartSize int64) (int64, error) {
-	// ceil divide
-	minimumPartSize := (fileSize-1)/tosMaximumPartNum + 1
-	if minimumPartSize > tosMaximumPartSize {
-		return 0, fmt.Errorf("fileSize too large, fileSize: %d, maximumPartSize: %d, maximumPartNum: %d", fileSize, tosMaximumPartSize, tosMaximumPartNum)
-	}
-	for {
-		if minimumPartSize <= defaultPartSize {
-			return defaultPartSize, nil
+// cancelOnDone stops the resumable transfer by hook once ctx is done, and then
+// calls cancelTransfer if not nil. As the s3 transfers do, the checkpoint and
+// the parts already transferred are kept, so that a restarted filer resumes
+// them. The returned stop must be called after the transfer.
+func cancelOnDone(ctx context.Context, hook tos.CancelHook, cancelTransfer context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			hook.Cancel(false)
+		case <-done:
 		}
-		defaultPartSize *= 2
-		if defaultPartSize > tosMaximumPartSize {
-			return tosMaximumPartSize, nil
+		if cancelTransfer != nil {
+			cancelTransfer()
 		}
+	}()
+	return func() {
+		close(done)
+		<-finished
 	}
 }
 
 func (t *tosTransput) DownloadFile(ctx context.Context, local, remote string) error {
 	basedir := filepath.Dir(local)
-	if err := os.MkdirAll(basedir, os.FileMode(consts.DefaultFileMode)); err != nil {
-		return fmt.Errorf("failed to mkdir: %w", err)
+	if err := transput.MkdirAll(ctx, basedir); err != nil {
+		return transput.ClassifyError(fmt.Errorf("failed to mkdir: %w", err))
 	}
 	bucket, object, err := utilspath.ParseURL(remote)
 	if err != nil {
 		return fmt.Errorf("failed to parse bucket and object from url: %w", err)
 	}
+	// the checkpoint is next to the file if empty
+	checkpointDir, err := transput.CheckpointDirFrom(ctx)
+	if err != nil {
+		return transput.ClassifyError(err)
+	}
 
-	for {
-		_, downloadErr := t.client.DownloadFile(ctx, &tos.DownloadFileInput{
+	for retries := 0; ; retries++ {
+		if err := ctx.Err(); err != nil {
+			return classifyError(err)
+		}
+		// the sdk already downloads to a temp file, verifies the crc and renames
+		// it into place; the hook keeps the temp file and checkpoint of the
+		// cancelled download to resume from
+		hook := tos.NewCancelHook()
+		stop := cancelOnDone(ctx, hook, nil)
+		output, downloadErr := t.client.DownloadFile(ctx, &tos.DownloadFileInput{
 			HeadObjectV2Input: tos.HeadObjectV2Input{
 				Bucket: bucket,
 				Key:    object,
@@ -260,44 +351,129 @@ func (t *tosTransput) DownloadFile(ctx context.Context, local, remote string) er
 			PartSize:              t.partSize,
 			TaskNum:               int(t.taskNum),
 			EnableCheckpoint:      true,
+			CheckpointFile:        checkpointDir,
 			DownloadEventListener: t.downloadEventListenerAndRateLimiter,
 			RateLimiter:           t.downloadEventListenerAndRateLimiter,
+			CancelHook:            hook,
 		})
+		stop()
 
 		if downloadErr == nil {
-			return nil
+			return transput.ClassifyError(transput.SetLocalAttrs(ctx, local, metaOf(output)))
 		}
 
+		if isNotFoundError(downloadErr) {
+			return transput.ClassifyError(transput.NotExistError(remote, downloadErr))
+		}
 		if !t.handleDownloadRateLimitError(downloadErr) {
-			return fmt.Errorf("failed to download file from tos: %w", downloadErr)
+			return classifyError(fmt.Errorf("failed to download file from tos: %w", downloadErr))
+		}
+		if err := throttleBackoff.Wait(ctx, retries); err != nil {
+			return classifyError(fmt.Errorf("failed to download file from tos: %w", err))
 		}
 	}
 }
 
-func (t *tosTransput) handleUploadRateLimitError(err error) bool {
-	if err == nil {
+// metaOf returns the user metadata of the downloaded object.
+func metaOf(output *tos.DownloadFileOutput) map[string]string {
+	res := make(map[string]string)
+	if output == nil || output.Meta == nil {
+		return res
+	}
+	output.Meta.Range(func(key, value string) bool {
+		res[key] = value
 		return true
+	})
+	return res
+}
+
+// UploadDirMarker implements transput.DirMarkerUploader.
+func (t *tosTransput) UploadDirMarker(ctx context.Context, remote string) error {
+	bucket, object, err := utilspath.ParseURL(remote)
+	if err != nil {
+		return fmt.Errorf("failed to parse url of tos while uploading directory marker: %w", err)
+	}
+	_, err = t.client.PutObjectV2(ctx, &tos.PutObjectV2Input{
+		PutObjectBasicInput: tos.PutObjectBasicInput{
+			Bucket: bucket,
+			Key:    utilsstrings.CheckDir(object),
+		},
+		Content: bytes.NewReader(nil),
+	})
+	if err != nil {
+		return classifyError(fmt.Errorf("failed to upload directory marker to tos: %w", err))
 	}
+	return nil
+}
 
-	// adapt to PutObjectV2
-	if isRateLimitError(err) {
-		return true
+// UploadSymlink implements transput.SymlinkUploader.
+func (t *tosTransput) UploadSymlink(ctx context.Context, target, remote string) error {
+	bucket, object, err := utilspath.ParseURL(remote)
+	if err != nil {
+		return fmt.Errorf("failed to parse url of tos while uploading symlink: %w", err)
+	}
+	_, err = t.client.PutObjectV2(ctx, &tos.PutObjectV2Input{
+		PutObjectBasicInput: tos.PutObjectBasicInput{
+			Bucket: bucket,
+			Key:    object,
+			Meta:   map[string]string{consts.MetaSymlinkTarget: target},
+		},
+		Content: bytes.NewReader(nil),
+	})
+	if err != nil {
+		return classifyError(fmt.Errorf("failed to upload symlink to tos: %w", err))
 	}
+	return nil
+}
 
-	return t.uploadEventListenerAndRateLimiter.onlyOccurRateLimitErr()
+// handleUploadRateLimitError slows down the uploads on the throttling of the
+// server, it reports whether the throttled upload should be retried.
+func (t *tosTransput) handleUploadRateLimitError(err error) bool {
+	return handleRateLimitError(err, &t.uploadEventListenerAndRateLimiter.eventListenerAndRateLimiter)
 }
 
+// handleDownloadRateLimitError is handleUploadRateLimitError of the downloads.
 func (t *tosTransput) handleDownloadRateLimitError(err error) bool {
-	if err == nil {
-		return true
+	return handleRateLimitError(err, &t.downloadEventListenerAndRateLimiter.eventListenerAndRateLimiter)
+}
+
+// handleRateLimitError speeds down the limiter of listener if err is caused by
+// the throttling of the server, seen in err itself, e.g. of PutObjectV2 and the
+// HeadObject in DownloadFile, or in the events of the multipart transfers. It
+// reports whether the transfer should be retried, which is not the case once
+// the bandwidth is already the minimum.
+func handleRateLimitError(err error, listener *eventListenerAndRateLimiter) bool {
+	if !isRateLimitError(err) && !listener.onlyOccurRateLimitErr() {
+		return false
 	}
+	// after the speed down of the events, it is not halved again within the interval
+	return listener.speedDown()
+}
 
-	// adapt to HeadObject in DownloadFile
-	if isRateLimitError(err) {
-		return true
+// classifyError wraps the errors of tos into the categories of apperror by
+// their status codes.
+func classifyError(err error) error {
+	if statusCode := statusCodeOf(err); statusCode != 0 {
+		return transput.ClassifyStatus(statusCode, err)
+	}
+	return transput.ClassifyError(err)
+}
+
+// statusCodeOf is tos.StatusCode looking into the wrapped errors.
+func statusCodeOf(err error) int {
+	var serverErr *tos.TosServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.StatusCode
+	}
+	var statusErr *tos.UnexpectedStatusCodeError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
 	}
+	return 0
+}
 
-	return t.downloadEventListenerAndRateLimiter.onlyOccurRateLimitErr()
+func isNotFoundError(err error) bool {
+	return tos.StatusCode(err) == http.StatusNotFound
 }
 
 func isRateLimitError(err error) bool {
@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/golang/mock/gomock"
@@ -22,8 +23,12 @@ func TestTosTransput_UploadFile(t *testing.T) {
 	defer ctrl.Finish()
 	mockFile1 := mock.NewMockFileInfo(ctrl)
 	mockFile1.EXPECT().Size().Return(int64(100000000)).AnyTimes()
+	mockFile1.EXPECT().Mode().Return(os.FileMode(0755)).AnyTimes()
+	mockFile1.EXPECT().ModTime().Return(time.Unix(1700000000, 0)).AnyTimes()
 	mockFile2 := mock.NewMockFileInfo(ctrl)
 	mockFile2.EXPECT().Size().Return(int64(10)).AnyTimes()
+	mockFile2.EXPECT().Mode().Return(os.FileMode(0755)).AnyTimes()
+	mockFile2.EXPECT().ModTime().Return(time.Unix(1700000000, 0)).AnyTimes()
 
 	tests := []struct {
 		name      string
@@ -161,56 +166,33 @@ func TestTosTransput_DownloadFile(t *testing.T) {
 	}
 }
 
-func TestGetUploadPartSize(t *testing.T) {
-	tests := []struct {
-		name     string
-		fileSize int64
-		want     int64
-		wantErr  bool
-	}{
-		{
-			name:     "too large",
-			fileSize: tosMaximumPartSize*tosMaximumPartNum + 1,
-			want:     0,
-			wantErr:  true,
-		},
-		{
-			name:     "largest",
-			fileSize: tosMaximumPartSize * tosMaximumPartNum,
-			want:     tosMaximumPartSize,
-			wantErr:  false,
-		},
-		{
-			name:     "larger than default, divide exactly",
-			fileSize: 1024 * 1024 * 1024 * tosMaximumPartNum,
-			want:     1024 * 1024 * 1024,
-			wantErr:  false,
-		},
-		{
-			name:     "larger than default",
-			fileSize: 1025 * 1024 * 1024 * tosMaximumPartNum,
-			want:     2048 * 1024 * 1024,
-			wantErr:  false,
-		},
-		{
-			name:     "default, divide exactly",
-			fileSize: consts.DefaultPartSize * tosMaximumPartNum,
-			want:     consts.DefaultPartSize,
-			wantErr:  false,
-		},
-		{
-			name:     "default",
-			fileSize: 300 * 1024 * 1024, // 300MiB
-			want:     consts.DefaultPartSize,
-			wantErr:  false,
-		},
-	}
+// fakeCancelHook records the calls of Cancel.
+type fakeCancelHook struct {
+	tos.CancelHook
+	aborts chan bool
+}
 
-	for _, tc := range tests {
-		convey.Convey(tc.name, t, func() {
-			partSize, err := getUploadPartSize(tc.fileSize, consts.DefaultPartSize)
-			convey.So(err != nil, convey.ShouldEqual, tc.wantErr)
-			convey.So(partSize, convey.ShouldEqual, tc.want)
-		})
-	}
+func (f *fakeCancelHook) Cancel(isAbort bool) {
+	f.aborts <- isAbort
+}
+
+func TestCancelOnDone(t *testing.T) {
+	convey.Convey("a cancelled transfer keeps its checkpoint", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		hook := &fakeCancelHook{aborts: make(chan bool, 1)}
+		transferCtx, cancelTransfer := context.WithCancel(context.Background())
+		stop := cancelOnDone(ctx, hook, cancelTransfer)
+
+		cancel()
+		convey.So(<-hook.aborts, convey.ShouldBeFalse)
+		<-transferCtx.Done()
+		stop()
+	})
+
+	convey.Convey("a finished transfer is not cancelled", t, func() {
+		hook := &fakeCancelHook{aborts: make(chan bool, 1)}
+		stop := cancelOnDone(context.Background(), hook, nil)
+		stop()
+		convey.So(len(hook.aborts), convey.ShouldEqual, 0)
+	})
 }
@@ -4,13 +4,57 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
-	utilspath "github.com/GBA-BI/tes-filer/pkg/utils/path"
+	"github.com/GBA-BI/tes-filer/pkg/consts"
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
 	utilsstrings "github.com/GBA-BI/tes-filer/pkg/utils/strings"
 )
 
+// ErrNotExist is wrapped by the errors of transputs when the remote file or
+// directory does not exist.
+var ErrNotExist = errors.New("remote object does not exist")
+
+// ErrEmptyListing is wrapped by NotExistError when nothing is listed under a
+// remote directory of the object storages, which have no directories of their own.
+var ErrEmptyListing = errors.New("no object listed under the directory")
+
+// NotExistError wraps err of the missing remote with ErrNotExist.
+func NotExistError(remote string, err error) error {
+	return fmt.Errorf("%s: %w: %w", redactURL(remote), ErrNotExist, err)
+}
+
+// JoinLocal joins local with the path of a remote key relative to the
+// downloaded directory, it fails if the key escapes the directory.
+func JoinLocal(local, relPath, key string) (string, error) {
+	local = filepath.Clean(local)
+	joined := filepath.Join(local, filepath.FromSlash(relPath))
+	if joined == local || !isWithin(local, joined) {
+		return "", apperror.Wrap(apperror.ErrInvalidArgument, fmt.Errorf("remote key %s escapes the local directory %s", redactURL(key), local))
+	}
+	return joined, nil
+}
+
+// NewContextReader returns a reader of r which fails with the error of ctx
+// once ctx is done, so that a copy loop stops on cancellation.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, reader: r}
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
 type Transput interface {
 	UploadDir(ctx context.Context, local, remote string) error
 	DownloadDir(ctx context.Context, local, remote string) error
@@ -37,10 +81,51 @@ func (d *DefaultTransput) UploadDir(ctx context.Context, local, remote string) e
 }
 
 func CommonUploadDir(ctx context.Context, local, remote string, transput Transput) error {
+	root, err := filepath.EvalSymlinks(local)
+	if err != nil {
+		return err
+	}
+	w := &uploadDirWalker{
+		ctx:      ctx,
+		transput: transput,
+		filter:   FilterFrom(ctx),
+		policy:   symlinkPolicyFrom(ctx),
+		markers:  DirMarkersFrom(ctx),
+		root:     root,
+		g:        NewGroup(ctx),
+	}
+	walkErr := w.walk(local, remote, "", nil)
+	if err := w.g.Wait(); err != nil {
+		return err
+	}
+	return walkErr
+}
+
+// uploadDirWalker walks the uploaded directory and the directories linked
+// into it, and schedules uploading their files.
+type uploadDirWalker struct {
+	ctx      context.Context
+	transput Transput
+	filter   *Filter
+	policy   *SymlinkPolicy
+	// markers keeps the empty directories
+	markers bool
+	// root is the real path of the uploaded directory
+	root string
+	g    *Group
+}
+
+// walk uploads local whose path relative to the uploaded directory is relBase,
+// it is not empty for the directories linked by symlinks. chain holds the ids
+// of the directories containing the symlinks followed to reach local.
+func (w *uploadDirWalker) walk(local, remote, relBase string, chain []fileID) error {
 	return filepath.Walk(local, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
 
 		fileInfo, err := os.Lstat(path)
 		if err != nil {
@@ -51,42 +136,139 @@ func CommonUploadDir(ctx context.Context, local, remote string, transput Transpu
 			return err
 		}
 
+		relativePath, err := filepath.Rel(local, path)
+		if err != nil {
+			return err
+		}
+		relPath := filepath.ToSlash(filepath.Join(relBase, relativePath))
+		dstPath := fmt.Sprintf("%s%s", utilsstrings.CheckDir(remote), filepath.ToSlash(relativePath))
+
 		// dir
 		if fileInfo.IsDir() {
+			if w.filter.SkipDir(relPath) {
+				return filepath.SkipDir
+			}
+			if w.markers {
+				if relativePath == "." {
+					dstPath = remote
+				}
+				return w.dirMarker(path, dstPath)
+			}
 			return nil
 		}
 
 		// symlink
 		if fileInfo.Mode()&os.ModeSymlink != 0 {
-			realPath, err := utilspath.GetRealPathOfLink(path)
-			if err != nil {
-				return err
-			}
-
-			realFileInfo, err := os.Stat(realPath)
-			if err != nil {
-				if errors.Is(err, os.ErrNotExist) {
-					// skip invalid symlink
-					return nil
-				}
-				return err
-			}
-
-			dstPath := fmt.Sprintf("%s%s", utilsstrings.CheckDir(remote), filepath.Base(path))
-			if realFileInfo.IsDir() {
-				return CommonUploadDir(ctx, realPath, dstPath, transput)
-			} else {
-				return transput.UploadFile(ctx, realPath, dstPath)
-			}
+			return w.symlink(local, path, dstPath, relPath, chain)
 		}
 
 		// file
-		relativePath, err := filepath.Rel(local, path)
+		if !w.filter.Match(relPath) {
+			return nil
+		}
+		w.g.Upload(w.transput, path, dstPath)
+		return nil
+	})
+}
+
+// symlink handles the symlink of path in local by the symlink policy.
+func (w *uploadDirWalker) symlink(local, path, dstPath, relPath string, chain []fileID) error {
+	switch w.policy.Mode {
+	case consts.SymlinkPolicySkip:
+		if w.filter.Match(relPath) {
+			reportSkipped(w.ctx, path, dstPath)
+		}
+		return nil
+	case consts.SymlinkPolicyFail:
+		return apperror.Wrap(apperror.ErrInvalidArgument, fmt.Errorf("symlink %s is not allowed by symlink policy %s", path, w.policy.Mode))
+	case consts.SymlinkPolicyPreserve:
+		if !w.filter.Match(relPath) {
+			return nil
+		}
+		uploader, ok := w.transput.(SymlinkUploader)
+		if !ok {
+			return apperror.Wrap(apperror.ErrInvalidArgument, fmt.Errorf("symlink policy %s is not supported by the scheme of %s", w.policy.Mode, redactURL(dstPath)))
+		}
+		target, err := os.Readlink(path)
 		if err != nil {
 			return err
 		}
+		w.g.Go(func(ctx context.Context) error {
+			return Track(ctx, consts.TransputModeOutputs, path, dstPath, func(ctx context.Context) error {
+				return uploader.UploadSymlink(ctx, target, dstPath)
+			})
+		})
+		return nil
+	}
+
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// skip invalid symlink
+			return nil
+		}
+		return err
+	}
+	if w.policy.Confine && !isWithin(w.root, realPath) {
+		return apperror.Wrap(apperror.ErrPermissionDenied, fmt.Errorf("symlink %s resolves to %s outside of %s", path, realPath, w.root))
+	}
+	realFileInfo, err := os.Stat(realPath)
+	if err != nil {
+		return err
+	}
+	if !realFileInfo.IsDir() {
+		if w.filter.Match(relPath) {
+			w.g.Upload(w.transput, realPath, dstPath)
+		}
+		return nil
+	}
+	if w.filter.SkipDir(relPath) {
+		return nil
+	}
 
-		dstPath := fmt.Sprintf("%s%s", utilsstrings.CheckDir(remote), relativePath)
-		return transput.UploadFile(ctx, path, dstPath)
+	// the linked directory loops if it contains the symlink
+	ancestors, err := ancestorIDs(local, path)
+	if err != nil {
+		return err
+	}
+	ancestors = append(ancestors, chain...)
+	id, err := fileIDOf(realPath)
+	if err != nil {
+		return err
+	}
+	for _, ancestor := range ancestors {
+		if ancestor == id {
+			reportSkipped(w.ctx, path, dstPath)
+			return nil
+		}
+	}
+	return w.walk(realPath, dstPath, relPath, ancestors)
+}
+
+// dirMarker uploads the marker of the directory of path if it is empty.
+func (w *uploadDirWalker) dirMarker(path, dstPath string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+	uploader, ok := w.transput.(DirMarkerUploader)
+	if !ok {
+		// the scheme has no directory, the empty directory is just not uploaded
+		reportSkipped(w.ctx, path, dstPath)
+		return nil
+	}
+	dstPath = utilsstrings.CheckDir(dstPath)
+	w.g.Go(func(ctx context.Context) error {
+		return uploader.UploadDirMarker(ctx, dstPath)
 	})
+	return nil
+}
+
+func reportSkipped(ctx context.Context, local, remote string) {
+	rec := NewRecord(consts.TransputModeOutputs, local, remote, nil)
+	rec.Status = consts.ResultStatusSkipped
+	Report(ctx, rec)
 }
@@ -3,11 +3,15 @@ package transput
 import (
 	"context"
 	"errors"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/agiledragon/gomonkey/v2"
 	"github.com/smartystreets/goconvey/convey"
+
+	apperror "github.com/GBA-BI/tes-filer/pkg/error"
 )
 
 func TestCommonUploadDir(t *testing.T) {
@@ -52,3 +56,74 @@ func TestCommonUploadDir(t *testing.T) {
 		})
 	}
 }
+
+func TestContextReader(t *testing.T) {
+	convey.Convey("stop reading once ctx is cancelled", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		reader := NewContextReader(ctx, strings.NewReader("hello"))
+
+		buf := make([]byte, 2)
+		n, err := reader.Read(buf)
+		convey.So(err, convey.ShouldBeNil)
+		convey.So(n, convey.ShouldEqual, 2)
+
+		cancel()
+		_, err = io.Copy(io.Discard, reader)
+		convey.So(errors.Is(err, context.Canceled), convey.ShouldBeTrue)
+	})
+}
+
+func TestJoinLocal(t *testing.T) {
+	tests := []struct {
+		name      string
+		relPath   string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "nested key",
+			relPath:  "a/b",
+			expected: "/inputs/dir/a/b",
+		},
+		{
+			name:     "dot segments inside",
+			relPath:  "a/../b",
+			expected: "/inputs/dir/b",
+		},
+		{
+			name:     "absolute key",
+			relPath:  "/etc/x",
+			expected: "/inputs/dir/etc/x",
+		},
+		{
+			name:      "escaping key",
+			relPath:   "../../etc/x",
+			expectErr: true,
+		},
+		{
+			name:      "sibling with the same prefix",
+			relPath:   "../dir2/x",
+			expectErr: true,
+		},
+		{
+			name:      "directory itself",
+			relPath:   "a/..",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		convey.Convey(tc.name, t, func() {
+			joined, err := JoinLocal("/inputs/dir/", tc.relPath, "s3://ak:sk@bucket/prefix/"+tc.relPath)
+			if tc.expectErr {
+				convey.So(err, convey.ShouldNotBeNil)
+				convey.So(apperror.CodeOf(err), convey.ShouldEqual, "1000002")
+				convey.So(err.Error(), convey.ShouldContainSubstring, "s3://bucket/prefix/"+tc.relPath)
+				convey.So(err.Error(), convey.ShouldNotContainSubstring, "sk")
+			} else {
+				convey.So(err, convey.ShouldBeNil)
+				convey.So(joined, convey.ShouldEqual, tc.expected)
+			}
+		})
+	}
+}
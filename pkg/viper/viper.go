@@ -8,7 +8,15 @@ import (
 	"github.com/spf13/viper"
 )
 
+// SetConfigFromEnv sets the fields of config tagged by env from the
+// environment variables, it is safe for concurrent use.
 func SetConfigFromEnv(config interface{}) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	setConfigFromEnv(config)
+}
+
+func setConfigFromEnv(config interface{}) {
 	configValue := reflect.ValueOf(config)
 	if configValue.Kind() == reflect.Ptr {
 		configValue = configValue.Elem()
@@ -31,22 +39,23 @@ func SetConfigFromEnv(config interface{}) {
 				fieldValue = fieldValue.Elem()
 			}
 			if fieldValue.Kind() == reflect.Struct {
-				SetConfigFromEnv(fieldValue.Addr().Interface())
+				setConfigFromEnv(fieldValue.Addr().Interface())
 			}
 		}
 	}
 }
 
+// mutex guards the global viper shared by the transputs created at the same time
 var mutex = &sync.Mutex{}
 
+// SetConfigFromFileINI sets config from the section of the ini configFile, it
+// reads with its own viper so that a slow file does not block the others.
 func SetConfigFromFileINI(configFile string, section string, conf interface{}) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	viper.SetConfigFile(configFile)
-	viper.SetConfigType("ini")
+	v := viper.New()
+	v.SetConfigFile(configFile)
+	v.SetConfigType("ini")
 
-	if err := viper.ReadInConfig(); err != nil {
+	if err := v.ReadInConfig(); err != nil {
 		return fmt.Errorf("failed to read config: %w", err)
 	}
 
@@ -54,7 +63,7 @@ func SetConfigFromFileINI(configFile string, section string, conf interface{}) e
 	if section != "" {
 		sec = section
 	}
-	if err := viper.UnmarshalKey(sec, &conf); err != nil {
+	if err := v.UnmarshalKey(sec, &conf); err != nil {
 		return fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 	return nil